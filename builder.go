@@ -281,6 +281,89 @@ func (stages Stages) ThroughTarget(target string) (Stages, bool) {
 	return nil, false
 }
 
+// ExternalImages returns the names of the images which the stages are based
+// on, other than scratch and earlier stages, in the order in which they are
+// first used. If from is not empty, it is used in place of the first stage's
+// base image. The stages are not modified.
+func (stages Stages) ExternalImages(from string) ([]string, error) {
+	var images []string
+	seen := make(map[string]bool)
+	for i, stage := range stages {
+		image := from
+		if i > 0 || len(from) == 0 {
+			// From() consumes the FROM instruction, so evaluate it using
+			// copies of the stage's builder and node
+			b := newBuilderWithGlobalAllowedArgs(stage.Builder.UserArgs, stage.Builder.HeadingArgs, stage.Builder.BuiltinArgDefaults, stage.Builder.GlobalAllowedArgs)
+			node := &parser.Node{Children: append([]*parser.Node{}, stage.Node.Children...)}
+			var err error
+			if image, err = b.From(node); err != nil {
+				return nil, err
+			}
+		}
+		if image == NoBaseImageSpecifier || seen[image] {
+			continue
+		}
+		if _, ok := stages[:i].ByName(image); ok {
+			continue
+		}
+		seen[image] = true
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// CopyFromImages returns the names of the images which COPY --from
+// instructions in the stages copy from, other than earlier stages, in the
+// order in which they are first used. Variables in the --from flags are
+// expanded using the arguments that are known at each instruction, but not
+// the environment of the stages' base images. The stages are not modified.
+func (stages Stages) CopyFromImages() ([]string, error) {
+	var images []string
+	seen := make(map[string]bool)
+	for i, stage := range stages {
+		b := newBuilderWithGlobalAllowedArgs(stage.Builder.UserArgs, stage.Builder.HeadingArgs, stage.Builder.BuiltinArgDefaults, stage.Builder.GlobalAllowedArgs)
+		for _, child := range stage.Node.Children {
+			switch child.Value {
+			case command.Arg, command.Env:
+				step := b.Step()
+				if err := step.Resolve(child); err != nil {
+					return nil, err
+				}
+				if err := b.Run(step, NoopExecutor, false); err != nil {
+					return nil, err
+				}
+				continue
+			case command.Copy:
+			default:
+				continue
+			}
+			args := make(map[string]string)
+			for k, v := range b.Args {
+				if _, ok := b.AllowedArgs[k]; ok {
+					args[k] = v
+				}
+			}
+			env := mergeEnv(envMapAsSlice(args), b.Env)
+			for _, flag := range child.Flags {
+				value, err := ProcessWord(flag, env)
+				if err != nil {
+					return nil, err
+				}
+				image, ok := strings.CutPrefix(value, "--from=")
+				if !ok || len(image) == 0 || seen[image] {
+					continue
+				}
+				if _, ok := stages[:i].ByName(image); ok {
+					continue
+				}
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+	return images, nil
+}
+
 type Stage struct {
 	Position int
 	Name     string // may just be strconv.Itoa(Position), be sure to search from back to front
@@ -416,8 +499,9 @@ func (b *Builder) extractHeadingArgsFromNode(node *parser.Node) error {
 	// Set children equal to everything except the leading ARG nodes
 	node.Children = children
 
-	// Use a separate builder to evaluate the heading args
-	tempBuilder := NewBuilder(b.UserArgs)
+	// Use a separate builder to evaluate the heading args, with the same
+	// values for the built-in args as this one
+	tempBuilder := newBuilderWithGlobalAllowedArgs(b.UserArgs, nil, b.BuiltinArgDefaults, nil)
 
 	// Built-in ARGs are declared implicitly in the heading and should be resolvable in its scope
 	for k, v := range tempBuilder.BuiltinArgDefaults {
@@ -568,6 +652,16 @@ func ParseFile(path string) (*parser.Node, error) {
 	return ParseDockerfile(f)
 }
 
+// ParsePreprocessedFile reads the file at path, expanding any #include,
+// #define, and conditional directives in it, and parses the result, which
+// includes any warnings from the parser. Line numbers in the returned nodes
+// and warnings refer to the files that they were read from. This is how files
+// with names ending in ".in" are conventionally handled.
+func ParsePreprocessedFile(path string, defines map[string]string) (*parser.Result, error) {
+	preprocessor := parser.Preprocessor{Defines: defines}
+	return preprocessor.ParsePreprocessed(path)
+}
+
 // Step creates a new step from the current state.
 func (b *Builder) Step() *Step {
 	// Include build arguments in the table of variables that we'll use in
@@ -630,7 +724,7 @@ func (b *Builder) Run(step *Step, exec Executor, noRunsRemaining bool) error {
 // to invoke the provided commands
 func (b *Builder) RequiresStart(node *parser.Node) bool {
 	for _, child := range node.Children {
-		if child.Value == command.Run {
+		if requiresStart[child.Value] {
 			return true
 		}
 	}
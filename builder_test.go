@@ -405,6 +405,145 @@ func TestMultiStageParseHeadingArg(t *testing.T) {
 	t.Logf("stages: %#v", stages)
 }
 
+func TestStagesExternalImages(t *testing.T) {
+	n, err := ParseDockerfile(strings.NewReader(`ARG VERSION=1.25
+FROM mirror.gcr.io/golang:$VERSION AS builder
+FROM builder AS tested
+FROM scratch
+FROM mirror.gcr.io/busybox
+FROM mirror.gcr.io/golang:$VERSION
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, err := NewStages(n, NewBuilder(map[string]string{"VERSION": "1.24"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := stages.ExternalImages("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"mirror.gcr.io/golang:1.24", "mirror.gcr.io/busybox"}, images)
+	images, err = stages.ExternalImages("example.com/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"example.com/base", "mirror.gcr.io/busybox", "mirror.gcr.io/golang:1.24"}, images)
+
+	// the stages should still be usable
+	from, err := stages[0].Builder.From(stages[0].Node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "mirror.gcr.io/golang:1.24", from)
+}
+
+func TestParsePreprocessedFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "common"), []byte("RUN echo common \\\n\n  done\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "Containerfile.in")
+	if err := os.WriteFile(path, []byte("FROM busybox\n#include \"common\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ParsePreprocessedFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, result.AST.Children, 2)
+	if assert.NotEmpty(t, result.Warnings) {
+		assert.Contains(t, result.Warnings[0], filepath.Join(dir, "common")+":1: Empty continuation line")
+	}
+}
+
+func TestStagesCopyFromImages(t *testing.T) {
+	n, err := ParseDockerfile(strings.NewReader(`ARG VERSION=1.25
+FROM mirror.gcr.io/golang:$VERSION AS builder
+COPY --from=mirror.gcr.io/busybox /bin/sh /sh
+FROM mirror.gcr.io/busybox
+ARG VERSION
+ARG TOOLS=example.com/tools:$VERSION
+COPY --from=builder /go/bin/app /app
+COPY --from=0 /go/bin/app /app
+COPY --chown=1:1 --from=$TOOLS /bin/tool /tool
+COPY --from=mirror.gcr.io/busybox /bin/sh /sh
+COPY app /app
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, err := NewStages(n, NewBuilder(map[string]string{"VERSION": "1.24"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := stages.CopyFromImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"mirror.gcr.io/busybox", "example.com/tools:1.24"}, images)
+	_, ok := stages[1].Builder.AllowedArgs["TOOLS"]
+	assert.False(t, ok, "the stages should not be modified")
+}
+
+func TestStagePlatformArgs(t *testing.T) {
+	n, err := ParseDockerfile(strings.NewReader(`ARG HEADING=$BUILDARCH
+FROM --platform=$BUILDPLATFORM mirror.gcr.io/golang AS build
+ARG TARGETARCH BUILDARCH HEADING
+FROM --platform=linux/s390x mirror.gcr.io/busybox AS other
+ARG TARGETARCH TARGETPLATFORM
+FROM mirror.gcr.io/busybox
+ARG TARGETARCH
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder(map[string]string{})
+	buildArgs, err := BuildPlatformArgs("linux/x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetArgs, err := TargetPlatformArgs("linux/aarch64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range buildArgs {
+		b.BuiltinArgDefaults[k] = v
+	}
+	for k, v := range targetArgs {
+		b.BuiltinArgDefaults[k] = v
+	}
+	stages, err := NewStages(n, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []struct {
+		platform string
+		args     map[string]string
+	}{
+		{platform: "linux/amd64", args: map[string]string{"TARGETARCH": "arm64", "BUILDARCH": "amd64", "HEADING": "amd64"}},
+		{platform: "linux/s390x", args: map[string]string{"TARGETARCH": "s390x", "TARGETPLATFORM": "linux/s390x"}},
+		{platform: "", args: map[string]string{"TARGETARCH": "arm64"}},
+	} {
+		stage := stages[i]
+		if _, err := stage.Builder.From(stage.Node); err != nil {
+			t.Fatal(err)
+		}
+		for _, child := range stage.Node.Children {
+			step := stage.Builder.Step()
+			if err := step.Resolve(child); err != nil {
+				t.Fatal(err)
+			}
+			if err := stage.Builder.Run(step, NoopExecutor, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, expected.platform, stage.Builder.Platform, "stage %d", i)
+		assert.Equal(t, expected.args, stage.Builder.Args, "stage %d", i)
+	}
+}
+
 func TestHeadingArg(t *testing.T) {
 	for _, tc := range []struct {
 		name         string
@@ -48,6 +48,46 @@ var builtinArgDefaults = map[string]string{
 	"BUILDVARIANT":   "",
 }
 
+// TargetPlatformArgs returns values for the TARGETPLATFORM, TARGETOS,
+// TARGETARCH, and TARGETVARIANT automatic args which describe platform, for
+// use in a Builder's BuiltinArgDefaults when building for a platform other
+// than the one we're running on.
+func TargetPlatformArgs(platform string) (map[string]string, error) {
+	return platformArgs("TARGET", platform)
+}
+
+// BuildPlatformArgs returns values for the BUILDPLATFORM, BUILDOS, BUILDARCH,
+// and BUILDVARIANT automatic args which describe platform, for use in a
+// Builder's BuiltinArgDefaults when the build runs somewhere other than the
+// platform we're running on, such as on a remote daemon.
+func BuildPlatformArgs(platform string) (map[string]string, error) {
+	return platformArgs("BUILD", platform)
+}
+
+func platformArgs(prefix, platform string) (map[string]string, error) {
+	spec, err := platforms.Parse(platform)
+	if err != nil {
+		return nil, err
+	}
+	spec = platforms.Normalize(spec)
+	return map[string]string{
+		prefix + "PLATFORM": platforms.Format(spec),
+		prefix + "OS":       spec.OS,
+		prefix + "ARCH":     spec.Architecture,
+		prefix + "VARIANT":  spec.Variant,
+	}, nil
+}
+
+// normalizePlatform returns the canonical form of platform, so that
+// "linux/aarch64" and "linux/arm64/v8" are both treated as "linux/arm64".
+func normalizePlatform(platform string) (string, error) {
+	spec, err := platforms.Parse(platform)
+	if err != nil {
+		return "", err
+	}
+	return platforms.Format(platforms.Normalize(spec)), nil
+}
+
 // ENV foo bar
 //
 // Sets the environment variable foo to bar, also makes interpolation
@@ -363,7 +403,11 @@ func from(b *Builder, args []string, attributes map[string]bool, flagArgs []stri
 			if platformString == "" {
 				return fmt.Errorf("no value specified for --platform=")
 			}
-			b.Platform = platformString
+			platform, err := normalizePlatform(platformString)
+			if err != nil {
+				return fmt.Errorf("invalid value %q specified for --platform=: %w", platformString, err)
+			}
+			b.Platform = platform
 		case strings.HasPrefix(arg, "--after="):
 			afterStage := strings.TrimPrefix(arg, "--after=")
 			if afterStage == "" {
@@ -374,11 +418,47 @@ func from(b *Builder, args []string, attributes map[string]bool, flagArgs []stri
 			return fmt.Errorf("FROM only supports the --platform and --after flags")
 		}
 	}
+	if len(b.Platform) > 0 {
+		if err := b.setStagePlatform(); err != nil {
+			return err
+		}
+	}
 	b.RunConfig.Image = name
 	// TODO: handle onbuild
 	return nil
 }
 
+// setStagePlatform updates the TARGET automatic args of a stage whose FROM
+// instruction specified a platform. As with BuildKit, a stage that runs on
+// the build platform, which is how stages which cross-compile for the target
+// platform are written, keeps the target platform of the build.
+func (b *Builder) setStagePlatform() error {
+	buildPlatform, ok := b.BuiltinArgDefaults["BUILDPLATFORM"]
+	if !ok {
+		buildPlatform = builtinArgDefaults["BUILDPLATFORM"]
+	}
+	if normalized, err := normalizePlatform(buildPlatform); err == nil && normalized == b.Platform {
+		return nil
+	}
+	targetArgs, err := TargetPlatformArgs(b.Platform)
+	if err != nil {
+		return err
+	}
+	if b.BuiltinArgDefaults == nil {
+		b.BuiltinArgDefaults = make(map[string]string)
+	}
+	for name, value := range targetArgs {
+		b.BuiltinArgDefaults[name] = value
+		// update any which were already declared in the stage
+		if _, declared := b.Args[name]; declared {
+			if _, setByUser := b.UserArgs[name]; !setByUser {
+				b.Args[name] = value
+			}
+		}
+	}
+	return nil
+}
+
 // ONBUILD RUN echo yo
 //
 // ONBUILD triggers run when the image is used in a FROM statement.
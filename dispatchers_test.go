@@ -64,6 +64,37 @@ func TestDispatchArgTargetPlatformBad(t *testing.T) {
 	}
 }
 
+func TestTargetPlatformArgs(t *testing.T) {
+	for platform, expected := range map[string]map[string]string{
+		"linux/arm64":  {"TARGETPLATFORM": "linux/arm64", "TARGETOS": "linux", "TARGETARCH": "arm64", "TARGETVARIANT": ""},
+		"linux/arm":    {"TARGETPLATFORM": "linux/arm/v7", "TARGETOS": "linux", "TARGETARCH": "arm", "TARGETVARIANT": "v7"},
+		"linux/x86_64": {"TARGETPLATFORM": "linux/amd64", "TARGETOS": "linux", "TARGETARCH": "amd64", "TARGETVARIANT": ""},
+	} {
+		got, err := TargetPlatformArgs(platform)
+		if err != nil {
+			t.Errorf("%s: %v", platform, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", platform, expected, got)
+		}
+	}
+	if _, err := TargetPlatformArgs("linux/arm64/v8/extra"); err == nil {
+		t.Errorf("expected an error for an invalid platform")
+	}
+
+	mybuilder := NewBuilder(map[string]string{})
+	mybuilder.BuiltinArgDefaults, _ = TargetPlatformArgs("linux/s390x")
+	if err := arg(mybuilder, []string{"TARGETPLATFORM", "TARGETARCH"}, nil, nil, "", nil); err != nil {
+		t.Fatalf("arg error: %v", err)
+	}
+	got := mybuilder.Arguments()
+	sort.Strings(got)
+	if expected := []string{"TARGETARCH=s390x", "TARGETPLATFORM=linux/s390x"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
 func TestDispatchCopy(t *testing.T) {
 	mybuilder := Builder{
 		RunConfig: docker.Config{
@@ -986,6 +1017,26 @@ func TestDispatchFromFlagsAndUseHeadingArgs(t *testing.T) {
 	}
 }
 
+func TestDispatchFromFlagsNormalizePlatform(t *testing.T) {
+	mybuilder := NewBuilder(map[string]string{})
+	flags := []string{"--platform=linux/aarch64"}
+	if err := from(mybuilder, []string{"busybox"}, nil, flags, "FROM --platform=linux/aarch64 busybox", nil); err != nil {
+		t.Fatalf("from error: %v", err)
+	}
+	if mybuilder.Platform != "linux/arm64" {
+		t.Errorf("Expected linux/arm64, got %v", mybuilder.Platform)
+	}
+	if mybuilder.BuiltinArgDefaults["TARGETARCH"] != "arm64" || mybuilder.BuiltinArgDefaults["TARGETPLATFORM"] != "linux/arm64" {
+		t.Errorf("Expected TARGET args for linux/arm64, got %v", mybuilder.BuiltinArgDefaults)
+	}
+
+	mybuilder = NewBuilder(map[string]string{})
+	flags = []string{"--platform=linux/arm64/v8/extra"}
+	if err := from(mybuilder, []string{"busybox"}, nil, flags, "FROM --platform=linux/arm64/v8/extra busybox", nil); err == nil {
+		t.Errorf("Expected an error for an invalid platform")
+	}
+}
+
 func TestDispatchFromAfterFlag(t *testing.T) {
 	expectedAfter := "builder"
 	mybuilder := Builder{
@@ -0,0 +1,340 @@
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/distribution/reference"
+	dockerregistrytypes "github.com/moby/moby/api/types/registry"
+	"k8s.io/klog"
+)
+
+// dockerHubServerAddress is the name that credential helpers and older
+// configuration files use for Docker Hub.
+const dockerHubServerAddress = "https://index.docker.io/v1/"
+
+// AuthProvider finds credentials for registries in Docker's config.json and
+// containers' auth.json files, including those which are kept by
+// docker-credential-* helper programs. Lookups are cached, so a provider
+// should not be kept for longer than a single build.
+type AuthProvider struct {
+	// Paths are the configuration files to read, in order of preference.
+	// Files which don't exist are skipped.
+	Paths []string
+
+	lock    sync.Mutex
+	files   []authFile
+	loaded  bool
+	cache   map[string][]dockerregistrytypes.AuthConfig
+	helpers map[string]*dockerregistrytypes.AuthConfig
+}
+
+// authFile holds the parts of a config.json or auth.json file that describe
+// credentials.
+type authFile struct {
+	path        string
+	Auths       map[string]authFileEntry `json:"auths"`
+	CredsStore  string                   `json:"credsStore"`
+	CredHelpers map[string]string        `json:"credHelpers"`
+}
+
+// authFileEntry is an entry in the "auths" section of a configuration file.
+type authFileEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// credentialHelperOutput is what a credential helper writes in response to a
+// "get" request.
+type credentialHelperOutput struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// NewAuthProvider returns an AuthProvider which reads the files that podman
+// and docker read, in the same order: $REGISTRY_AUTH_FILE, then the
+// containers auth.json files in $XDG_RUNTIME_DIR and $XDG_CONFIG_HOME (or
+// ~/.config), then config.json in $DOCKER_CONFIG (or ~/.docker), and finally
+// the legacy ~/.dockercfg.
+func NewAuthProvider() *AuthProvider {
+	var paths []string
+	if path := os.Getenv("REGISTRY_AUTH_FILE"); len(path) > 0 {
+		paths = append(paths, path)
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); len(dir) > 0 {
+		paths = append(paths, filepath.Join(dir, "containers", "auth.json"))
+	}
+	home, _ := os.UserHomeDir()
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if len(configDir) == 0 && len(home) > 0 {
+		configDir = filepath.Join(home, ".config")
+	}
+	if len(configDir) > 0 {
+		paths = append(paths, filepath.Join(configDir, "containers", "auth.json"))
+	}
+	dockerConfig := os.Getenv("DOCKER_CONFIG")
+	if len(dockerConfig) == 0 && len(home) > 0 {
+		dockerConfig = filepath.Join(home, ".docker")
+	}
+	if len(dockerConfig) > 0 {
+		paths = append(paths, filepath.Join(dockerConfig, "config.json"))
+	}
+	if len(home) > 0 {
+		paths = append(paths, filepath.Join(home, ".dockercfg"))
+	}
+	return &AuthProvider{Paths: paths}
+}
+
+// AuthFn returns the credentials which are configured for the registry that
+// the image called name is pulled from, most preferred first. It can be used
+// as a ClientExecutor's AuthFn.
+func (p *AuthProvider) AuthFn(name string) ([]dockerregistrytypes.AuthConfig, bool) {
+	auths, err := p.Lookup(name)
+	if err != nil {
+		klog.Warningf("Unable to look up credentials for %s: %v", name, err)
+	}
+	return auths, len(auths) > 0
+}
+
+// Lookup returns the credentials which are configured for the registry that
+// the image called name is pulled from, most preferred first. Entries for a
+// repository or namespace are preferred over those for its whole registry.
+func (p *AuthProvider) Lookup(name string) ([]dockerregistrytypes.AuthConfig, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %q: %v", name, err)
+	}
+	repository := named.Name()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if auths, ok := p.cache[repository]; ok {
+		return auths, nil
+	}
+	p.load()
+
+	registry := reference.Domain(named)
+	var auths []dockerregistrytypes.AuthConfig
+	var errs []error
+	seen := make(map[dockerregistrytypes.AuthConfig]struct{})
+	add := func(auth *dockerregistrytypes.AuthConfig) {
+		if auth == nil {
+			return
+		}
+		if _, ok := seen[*auth]; !ok {
+			seen[*auth] = struct{}{}
+			auths = append(auths, *auth)
+		}
+	}
+	for _, file := range p.files {
+		if helper, ok := file.CredHelpers[registry]; ok {
+			auth, err := p.runHelper(helper, registry)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			add(auth)
+			continue
+		}
+		if entry, ok := file.lookup(repository); ok {
+			auth, err := entry.authConfig(registry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", file.path, err))
+				continue
+			}
+			if auth != nil {
+				add(auth)
+				continue
+			}
+		}
+		if len(file.CredsStore) > 0 {
+			auth, err := p.runHelper(file.CredsStore, registry)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			add(auth)
+		}
+	}
+	if len(errs) == 0 {
+		if p.cache == nil {
+			p.cache = make(map[string][]dockerregistrytypes.AuthConfig)
+		}
+		p.cache[repository] = auths
+	}
+	if len(auths) > 0 {
+		klog.V(4).Infof("Found %d credentials for %s", len(auths), repository)
+	}
+	return auths, errors.Join(errs...)
+}
+
+// load reads the configuration files, if they haven't been read already.
+// Files which can't be read or parsed are logged and skipped, so that they
+// don't hide the credentials in the others.
+func (p *AuthProvider) load() {
+	if p.loaded {
+		return
+	}
+	var files []authFile
+	for _, path := range p.Paths {
+		file, err := readAuthFile(path)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				klog.Warningf("Ignoring credentials configuration: %v", err)
+			}
+			continue
+		}
+		// key the entries by registry or repository, without the URL
+		// schemes and API paths which older clients wrote
+		auths := make(map[string]authFileEntry)
+		for key, entry := range file.Auths {
+			auths[normalizeAuthKey(key)] = entry
+		}
+		file.Auths = auths
+		credHelpers := make(map[string]string)
+		for key, helper := range file.CredHelpers {
+			credHelpers[normalizeAuthKey(key)] = helper
+		}
+		file.CredHelpers = credHelpers
+		klog.V(4).Infof("Read credentials configuration from %s", path)
+		files = append(files, file)
+	}
+	p.files = files
+	p.loaded = true
+}
+
+// readAuthFile reads a configuration file. A file called .dockercfg is read
+// in the legacy format, which has only the contents of the "auths" section.
+func readAuthFile(path string) (authFile, error) {
+	file := authFile{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+	if filepath.Base(path) == ".dockercfg" {
+		err = json.Unmarshal(data, &file.Auths)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return file, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	return file, nil
+}
+
+// lookup returns the entry for the most specific part of repository which the
+// file has an entry for.
+func (f authFile) lookup(repository string) (authFileEntry, bool) {
+	for key := repository; ; {
+		if entry, ok := f.Auths[key]; ok {
+			return entry, true
+		}
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			return authFileEntry{}, false
+		}
+		key = key[:i]
+	}
+}
+
+// authConfig decodes the entry, returning nil if it holds no credentials,
+// which is the case when they are kept by a credsStore helper.
+func (entry authFileEntry) authConfig(registry string) (*dockerregistrytypes.AuthConfig, error) {
+	auth := &dockerregistrytypes.AuthConfig{
+		Username:      entry.Username,
+		Password:      entry.Password,
+		IdentityToken: entry.IdentityToken,
+		RegistryToken: entry.RegistryToken,
+		ServerAddress: registry,
+	}
+	if len(entry.Auth) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials for %s: %v", registry, err)
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid credentials for %s: expected a username and password", registry)
+		}
+		auth.Username, auth.Password = username, password
+	}
+	if len(auth.Username) == 0 && len(auth.Password) == 0 && len(auth.IdentityToken) == 0 && len(auth.RegistryToken) == 0 {
+		return nil, nil
+	}
+	return auth, nil
+}
+
+// runHelper asks the docker-credential-helper program for the credentials
+// that it holds for registry. It returns nil if it has none.
+func (p *AuthProvider) runHelper(helper, registry string) (*dockerregistrytypes.AuthConfig, error) {
+	key := helper + "\x00" + registry
+	if auth, ok := p.helpers[key]; ok {
+		return auth, nil
+	}
+	serverURL := registry
+	if registry == "docker.io" {
+		serverURL = dockerHubServerAddress
+	}
+	program := "docker-credential-" + helper
+	cmd := exec.Command(program, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	klog.V(4).Infof("Running %s for %s", program, serverURL)
+	var auth *dockerregistrytypes.AuthConfig
+	if err := cmd.Run(); err != nil {
+		// helpers report that they have nothing for a server by
+		// printing a well-known message and failing
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if !strings.Contains(message, "credentials not found") {
+			return nil, fmt.Errorf("%s failed: %v: %s", program, err, message)
+		}
+	} else {
+		var output credentialHelperOutput
+		if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+			return nil, fmt.Errorf("unable to parse the output of %s: %v", program, err)
+		}
+		auth = &dockerregistrytypes.AuthConfig{ServerAddress: registry}
+		if output.Username == "<token>" {
+			auth.IdentityToken = output.Secret
+		} else {
+			auth.Username, auth.Password = output.Username, output.Secret
+		}
+	}
+	if p.helpers == nil {
+		p.helpers = make(map[string]*dockerregistrytypes.AuthConfig)
+	}
+	p.helpers[key] = auth
+	return auth, nil
+}
+
+// normalizeAuthKey converts the key of an entry in a configuration file to
+// the registry or repository that it applies to, the way that docker and
+// podman do.
+func normalizeAuthKey(key string) string {
+	if stripped := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://"); stripped != key {
+		// a URL, which names only a registry
+		key, _, _ = strings.Cut(stripped, "/")
+	}
+	switch key {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	for _, prefix := range []string{"index.docker.io/", "registry-1.docker.io/"} {
+		if strings.HasPrefix(key, prefix) {
+			return "docker.io/" + strings.TrimPrefix(key, prefix)
+		}
+	}
+	return key
+}
@@ -0,0 +1,175 @@
+package dockerclient
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	dockerregistrytypes "github.com/moby/moby/api/types/registry"
+)
+
+// installCredentialHelper writes a docker-credential-NAME script to a
+// directory on $PATH which answers "get" requests with the credentials in
+// secrets, recording each request in a log file whose path it returns.
+func installCredentialHelper(t *testing.T, name string, secrets map[string]string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("credential helper stubs are shell scripts")
+	}
+	dir := t.TempDir()
+	log := filepath.Join(dir, "requests.log")
+	script := "#!/bin/sh\nread server\necho \"$server\" >> " + log + "\ncase \"$server\" in\n"
+	for server, output := range secrets {
+		script += server + ") echo '" + output + "' ;;\n"
+	}
+	script += "*) echo 'credentials not found in native keychain'; exit 1 ;;\nesac\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func writeAuthFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthProviderLookup(t *testing.T) {
+	log := installCredentialHelper(t, "stub", map[string]string{
+		"helper.example.com":          `{"ServerURL":"helper.example.com","Username":"helper","Secret":"s3cret"}`,
+		"token.example.com":           `{"ServerURL":"token.example.com","Username":"<token>","Secret":"t0ken"}`,
+		"https://index.docker.io/v1/": `{"ServerURL":"https://index.docker.io/v1/","Username":"hub","Secret":"hubpass"}`,
+	})
+	basic := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+	containersAuth := writeAuthFile(t, `{
+		"auths": {
+			"quay.io": {"auth": "`+basic("quay", "registry")+`"},
+			"quay.io/team": {"auth": "`+basic("team", "namespace")+`"}
+		}
+	}`)
+	dockerConfig := writeAuthFile(t, `{
+		"auths": {
+			"quay.io": {"auth": "`+basic("docker", "fallback")+`"},
+			"https://registry.example.com/v1/": {"username": "legacy", "password": "url"},
+			"https://index.docker.io/v1/": {}
+		},
+		"credsStore": "stub",
+		"credHelpers": {"token.example.com": "stub"}
+	}`)
+	legacyConfig := filepath.Join(t.TempDir(), ".dockercfg")
+	if err := os.WriteFile(legacyConfig, []byte(`{"legacy.example.com": {"auth": "`+basic("old", "format")+`"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// files without credentials, or which can't be parsed, don't hide the
+	// others
+	contextConfig := writeAuthFile(t, `{"currentContext": "colima", "psFormat": "table {{.ID}}"}`)
+	brokenConfig := writeAuthFile(t, `{"auths": `)
+	p := &AuthProvider{Paths: []string{filepath.Join(t.TempDir(), "missing.json"), brokenConfig, containersAuth, contextConfig, dockerConfig, legacyConfig}}
+
+	for _, tc := range []struct {
+		name     string
+		expected []dockerregistrytypes.AuthConfig
+	}{
+		{
+			name: "quay.io/team/tools:latest",
+			expected: []dockerregistrytypes.AuthConfig{
+				{Username: "team", Password: "namespace", ServerAddress: "quay.io"},
+				{Username: "docker", Password: "fallback", ServerAddress: "quay.io"},
+			},
+		},
+		{
+			name: "quay.io/other/tools",
+			expected: []dockerregistrytypes.AuthConfig{
+				{Username: "quay", Password: "registry", ServerAddress: "quay.io"},
+				{Username: "docker", Password: "fallback", ServerAddress: "quay.io"},
+			},
+		},
+		{
+			name:     "registry.example.com/app",
+			expected: []dockerregistrytypes.AuthConfig{{Username: "legacy", Password: "url", ServerAddress: "registry.example.com"}},
+		},
+		{
+			name:     "helper.example.com/app",
+			expected: []dockerregistrytypes.AuthConfig{{Username: "helper", Password: "s3cret", ServerAddress: "helper.example.com"}},
+		},
+		{
+			name:     "token.example.com/app",
+			expected: []dockerregistrytypes.AuthConfig{{IdentityToken: "t0ken", ServerAddress: "token.example.com"}},
+		},
+		{
+			name:     "busybox",
+			expected: []dockerregistrytypes.AuthConfig{{Username: "hub", Password: "hubpass", ServerAddress: "docker.io"}},
+		},
+		{
+			name:     "legacy.example.com/app",
+			expected: []dockerregistrytypes.AuthConfig{{Username: "old", Password: "format", ServerAddress: "legacy.example.com"}},
+		},
+		{
+			name: "unknown.example.com/app",
+		},
+	} {
+		auths, err := p.Lookup(tc.name)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(auths, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.name, tc.expected, auths)
+		}
+	}
+
+	// lookups which were already made, for the same repository or for
+	// another one in the same registry, don't run the helper again
+	for _, name := range []string{"helper.example.com/app", "helper.example.com/other", "docker.io/library/busybox:1.36"} {
+		if _, ok := p.AuthFn(name); !ok {
+			t.Errorf("%s: expected credentials", name)
+		}
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := strings.Fields(string(data))
+	expected := []string{"helper.example.com", "token.example.com", "https://index.docker.io/v1/", "legacy.example.com", "unknown.example.com"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected helper requests %v, got %v", expected, requests)
+	}
+}
+
+func TestAuthProviderHelperFailure(t *testing.T) {
+	installCredentialHelper(t, "stub", nil)
+	p := &AuthProvider{Paths: []string{writeAuthFile(t, `{"credHelpers": {"example.com": "missing"}, "credsStore": "stub"}`)}}
+	if _, err := p.Lookup("example.com/app"); err == nil || !strings.Contains(err.Error(), "docker-credential-missing") {
+		t.Errorf("expected an error running the missing helper, got %v", err)
+	}
+	if auths, err := p.Lookup("other.example.com/app"); err != nil || len(auths) != 0 {
+		t.Errorf("expected no credentials and no error, got %v, %v", auths, err)
+	}
+}
+
+func TestNormalizeAuthKey(t *testing.T) {
+	for key, expected := range map[string]string{
+		"quay.io":                        "quay.io",
+		"quay.io/team":                   "quay.io/team",
+		"https://quay.io":                "quay.io",
+		"https://index.docker.io/v1/":    "docker.io",
+		"http://localhost:5000/v2/":      "localhost:5000",
+		"index.docker.io":                "docker.io",
+		"registry-1.docker.io/library/x": "docker.io/library/x",
+	} {
+		if actual := normalizeAuthKey(key); actual != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, actual)
+		}
+	}
+}
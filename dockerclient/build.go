@@ -0,0 +1,484 @@
+package dockerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/platforms"
+	docker "github.com/fsouza/go-dockerclient"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openshift/imagebuilder"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+	"k8s.io/klog"
+)
+
+// BuildOptions describes a build to be performed by Build.
+type BuildOptions struct {
+	// Executor holds the settings for the build, such as the client,
+	// the context directory, tags, and output streams. If nil, an
+	// executor created by NewClientExecutor() is used. If its Client is
+	// nil, one is created using NewClientFromEnv(), and if its Excludes
+	// are nil, they are read from the context directory.
+	Executor *ClientExecutor
+	// Dockerfiles are the paths of the Dockerfiles to build. The
+	// instructions in second and later files are appended to those in
+	// the first. Files with names that end in ".in" are preprocessed
+	// before they are parsed. Defaults to the Dockerfile in the
+	// executor's Directory.
+	Dockerfiles []string
+	// Args are the values of build arguments.
+	Args map[string]string
+	// From, if set, is used in place of the base image of the first
+	// stage which is built.
+	From string
+	// Target, if set, is the name or position of the stage to build.
+	Target string
+	// Platforms are the platforms to build for, in the form
+	// os/arch[/variant]. If one is listed, it is used as the executor's
+	// Platform. If more than one is listed, the image is built once for
+	// each of them, and each image is tagged with the executor's tags
+	// followed by the platform, for example "busybox:1-linux-arm64". The
+	// executor's tags themselves are not applied, since the daemon can't
+	// hold a manifest list, so only OCILayout gets an image index.
+	Platforms []string
+	// OCILayout, if set, is a directory that the built image is exported
+	// to, as an OCI image layout. If more than one platform is built,
+	// the layout holds an image index which lists the image built for
+	// each of them.
+	OCILayout string
+	// Provenance, if set, is a file that the provenance of the built
+	// image, or of the image built for each platform, is written to, as
+	// in-toto statements of SLSA provenance, one per line.
+	Provenance string
+	// LabelProvenance, if true, records the build definition part of the
+	// provenance of the built image in its ProvenanceLabel label.
+	LabelProvenance bool
+	// SBOM, if set, is a file that a software bill of materials for the
+	// built image is written to, listing the packages in its rpm, dpkg and
+	// apk databases, and the modules that its Go binaries were built from.
+	// If more than one platform is built, the platform is added to the
+	// name of the file for each, before its extension.
+	SBOM string
+	// SBOMFormat is the format of the SBOM. Defaults to SBOMFormatSPDX.
+	SBOMFormat SBOMFormat
+}
+
+// BuildResult describes the outcome of a successful call to Build.
+type BuildResult struct {
+	// ImageID is the ID of the built image. It is empty if more than one
+	// platform was built.
+	ImageID string
+	// Platform is the platform that the image was built for, if one was
+	// specified.
+	Platform string
+	// Stages describes each of the stages which was built, in order.
+	Stages []StageResult
+	// Platforms describes the build for each platform, if more than one
+	// platform was built.
+	Platforms []*BuildResult
+	// OCILayoutDigest is the digest of the image index or manifest that
+	// was written to the OCI layout, if one was requested.
+	OCILayoutDigest string
+	// Warnings collects warnings produced while parsing and building.
+	Warnings []string
+	// Provenance records what went into the built image, if Provenance or
+	// LabelProvenance was set. It is nil if more than one platform was
+	// built.
+	Provenance *ProvenanceStatement
+	// SBOM is the file that the SBOM of the built image was written to,
+	// if one was requested.
+	SBOM string
+}
+
+// StageResult describes a stage that was built by Build.
+type StageResult struct {
+	// Name is the name that the stage was given with FROM ... AS, or its
+	// position if it wasn't given one.
+	Name string
+	// Position is the index of the stage among all of the stages in the
+	// Dockerfiles, starting at zero.
+	Position int
+	// BaseImageID is the ID of the image that the stage was built on.
+	BaseImageID string
+	// ImageID is the ID of the image which was committed for the stage,
+	// if one was. The last stage is always committed. Earlier stages are
+	// only committed when they are used as the base for a later stage,
+	// and those images are removed when the build completes.
+	ImageID string
+}
+
+// Build parses the Dockerfiles described by opts and builds them, returning
+// the ID of the resulting image. It releases all resources it creates before
+// it returns, whether or not the build succeeds, and stops building if ctx is
+// cancelled. When building for more than one platform, the platforms are
+// built one after another, and the failures of every platform which could not
+// be built are returned together. If the executor has a Report, it is filled
+// in whether or not the build succeeds.
+func Build(ctx context.Context, opts BuildOptions) (_ *BuildResult, err error) {
+	e, err := buildExecutor(opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.buildID(); err != nil {
+		return nil, err
+	}
+	e.Report.start()
+	defer func() { e.Report.finish(err) }()
+	ctx, span := e.startSpan(ctx, "build", dockerfilesKey.StringSlice(opts.Dockerfiles))
+	if len(e.Tag) > 0 {
+		span.SetAttributes(tagsKey.StringSlice(append([]string{e.Tag}, e.AdditionalTags...)))
+	}
+	defer func() { endSpan(span, err) }()
+	if e.Excludes == nil && len(e.ContextArchive) == 0 {
+		if err := e.DefaultExcludes(); err != nil {
+			return nil, fmt.Errorf("error: Could not parse default .dockerignore: %v", err)
+		}
+	}
+	if len(e.Annotations) > 0 && len(opts.OCILayout) == 0 {
+		// images in the daemon have nowhere to record them
+		return nil, fmt.Errorf("error: Annotations can only be added to images exported to an OCI layout")
+	}
+
+	// the automatic BUILD args describe the daemon's platform, which is
+	// also the default target platform
+	daemonPlatform, err := e.daemonPlatform()
+	if err != nil {
+		klog.V(4).Infof("Unable to determine the daemon's platform, assuming it is the same as ours: %v", err)
+	}
+
+	if len(opts.Platforms) <= 1 {
+		if len(opts.Platforms) == 1 {
+			e.Platform = opts.Platforms[0]
+		}
+		result, err := buildPlatform(ctx, e, opts, daemonPlatform)
+		if err != nil {
+			return nil, err
+		}
+		span.SetAttributes(imageIDKey.String(result.ImageID))
+		if len(opts.OCILayout) > 0 {
+			desc, err := ExportAnnotatedOCILayout(ctx, e.Client, opts.OCILayout, e.Tag, []string{result.ImageID}, e.Annotations)
+			if err != nil {
+				return nil, err
+			}
+			result.OCILayoutDigest = desc.Digest.String()
+		}
+		if len(opts.Provenance) > 0 {
+			if err := writeProvenanceFile(opts.Provenance, result); err != nil {
+				return nil, fmt.Errorf("unable to write provenance: %v", err)
+			}
+		}
+		return result, nil
+	}
+
+	result := &BuildResult{}
+	var errs []error
+	var images []string
+	seen := make(map[string]struct{})
+	for _, platform := range opts.Platforms {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		platformOpts := opts
+		if len(opts.SBOM) > 0 {
+			platformOpts.SBOM = platformFile(opts.SBOM, platform)
+		}
+		platformExecutor := e.forPlatform(platform)
+		platformExecutor.Report.start()
+		platformCtx, platformSpan := platformExecutor.startSpan(ctx, "platform")
+		platformResult, err := buildPlatform(platformCtx, platformExecutor, platformOpts, daemonPlatform)
+		if err == nil {
+			platformSpan.SetAttributes(imageIDKey.String(platformResult.ImageID))
+		}
+		endSpan(platformSpan, err)
+		platformExecutor.Report.finish(err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", platform, err))
+			continue
+		}
+		result.Platforms = append(result.Platforms, platformResult)
+		images = append(images, platformResult.ImageID)
+		for _, warning := range platformResult.Warnings {
+			if _, ok := seen[warning]; !ok {
+				seen[warning] = struct{}{}
+				result.Warnings = append(result.Warnings, warning)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(opts.OCILayout) > 0 {
+		desc, err := ExportAnnotatedOCILayout(ctx, e.Client, opts.OCILayout, e.Tag, images, e.Annotations)
+		if err != nil {
+			return nil, err
+		}
+		result.OCILayoutDigest = desc.Digest.String()
+	}
+	if len(opts.Provenance) > 0 {
+		if err := writeProvenanceFile(opts.Provenance, result); err != nil {
+			return nil, fmt.Errorf("unable to write provenance: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// buildExecutor returns the executor for opts, creating it or its client if
+// necessary.
+func buildExecutor(opts BuildOptions) (*ClientExecutor, error) {
+	e := opts.Executor
+	if e == nil {
+		e = NewClientExecutor(nil)
+	}
+	if e.Client == nil {
+		client, err := NewClientFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("error: No connection to Docker available: %v", err)
+		}
+		e.Client = client
+	}
+	return e, nil
+}
+
+// forPlatform returns a copy of the executor that builds for platform, and
+// which tags images with names that include the platform.
+func (e *ClientExecutor) forPlatform(platform string) *ClientExecutor {
+	// make sure that every platform uses the same build ID, an invalid one
+	// is reported by Build before any platform is built
+	e.buildID()
+	copied := *e
+	copied.Platform = platform
+	copied.Named = nil
+	copied.Container = nil
+	copied.Deferred = nil
+	copied.Image = nil
+	copied.Volumes = nil
+	copied.Committed = nil
+	copied.Report = e.Report.forPlatform(platform)
+	if len(e.Tag) > 0 {
+		copied.Tag = platformTag(e.Tag, platform)
+	}
+	copied.AdditionalTags = nil
+	for _, tag := range e.AdditionalTags {
+		copied.AdditionalTags = append(copied.AdditionalTags, platformTag(tag, platform))
+	}
+	logFn := e.LogFn
+	copied.LogFn = func(format string, args ...interface{}) {
+		logFn("["+platform+"] "+format, args...)
+	}
+	return &copied
+}
+
+// platformTag adds the platform to the tag in name, so that the images that
+// are built for each platform can be told apart.
+func platformTag(name, platform string) string {
+	repository, tag := docker.ParseRepositoryTag(name)
+	suffix := strings.ReplaceAll(platform, "/", "-")
+	if len(tag) == 0 {
+		return repository + ":" + suffix
+	}
+	return repository + ":" + tag + "-" + suffix
+}
+
+// daemonPlatform returns the platform that the daemon runs containers on.
+func (e *ClientExecutor) daemonPlatform() (string, error) {
+	info, err := e.Client.Info()
+	if err != nil {
+		return "", err
+	}
+	if len(info.OSType) == 0 || len(info.Architecture) == 0 {
+		return "", fmt.Errorf("the daemon did not report its platform")
+	}
+	// the daemon reports the kernel's name for its architecture, which for
+	// 32-bit ARM also includes the variant
+	arch, variant := info.Architecture, ""
+	if strings.HasPrefix(arch, "armv") {
+		arch, variant = "arm", strings.TrimSuffix(strings.TrimPrefix(arch, "arm"), "l")
+	}
+	return platforms.Format(platforms.Normalize(ocispec.Platform{OS: info.OSType, Architecture: arch, Variant: variant})), nil
+}
+
+// buildPlatform parses and builds the Dockerfiles for the executor's
+// platform, or for daemonPlatform if the executor doesn't specify one, and
+// releases the executor's resources.
+func buildPlatform(ctx context.Context, e *ClientExecutor, opts BuildOptions, daemonPlatform string) (*BuildResult, error) {
+	defer func() {
+		for _, err := range e.Release() {
+			if e.ErrOut != nil {
+				fmt.Fprintf(e.ErrOut, "error: Unable to clean up build: %v\n", err)
+			}
+			e.warning(fmt.Sprintf("Unable to clean up build: %v", err))
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b, stages, warnings, err := parseStages(e, opts, daemonPlatform)
+	if err != nil {
+		return nil, err
+	}
+	result := &BuildResult{Platform: e.Platform, Warnings: warnings}
+	stages, ok := stages.ByTarget(opts.Target)
+	if !ok {
+		return nil, fmt.Errorf("error: The target %q was not found in the provided Dockerfile", opts.Target)
+	}
+	if e.LockFile != nil {
+		images, err := stages.ExternalImages(opts.From)
+		if err != nil {
+			return nil, fmt.Errorf("error: Determining base images: %v", err)
+		}
+		for _, name := range e.LockFile.Missing(images) {
+			warning := fmt.Sprintf("base image %s is not in the lock file, so it was not pinned to a digest", name)
+			e.LogFn("Warning: %s", warning)
+			e.warning(warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+
+	started := time.Now()
+	lastExecutor, err := e.StagesWithContext(ctx, b, stages, opts.From)
+	if err != nil {
+		return nil, err
+	}
+	var def ProvenanceBuildDefinition
+	if len(opts.Provenance) > 0 || opts.LabelProvenance {
+		if def, err = e.provenanceBuildDefinition(b, stages, opts); err != nil {
+			return nil, err
+		}
+		if opts.LabelProvenance {
+			if err := labelProvenance(stages[len(stages)-1].Builder, def); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := lastExecutor.CommitWithContext(ctx, stages[len(stages)-1].Builder); err != nil {
+		return nil, err
+	}
+
+	result.ImageID = lastExecutor.Committed.ID
+	if e.Report != nil {
+		e.Report.ImageID = result.ImageID
+		if lastExecutor.stageReport != nil {
+			e.Report.ImageSize = lastExecutor.stageReport.ImageSize
+		}
+	}
+	result.Warnings = append(result.Warnings, b.Warnings...)
+	for _, stage := range stages {
+		result.Warnings = append(result.Warnings, stage.Builder.Warnings...)
+		stageResult := StageResult{
+			Name:     stage.Name,
+			Position: stage.Position,
+		}
+		if stageExecutor, ok := e.Named[strconv.Itoa(stage.Position)]; ok {
+			if stageExecutor.Image != nil {
+				stageResult.BaseImageID = stageExecutor.Image.ID
+			}
+			if stageExecutor.Committed != nil {
+				stageResult.ImageID = stageExecutor.Committed.ID
+			}
+		}
+		result.Stages = append(result.Stages, stageResult)
+	}
+	if len(opts.SBOM) > 0 {
+		warnings, err := lastExecutor.writeImageSBOM(ctx, result.ImageID, opts.SBOM, opts.SBOMFormat)
+		if err != nil {
+			return nil, fmt.Errorf("unable to write SBOM: %v", err)
+		}
+		for _, warning := range warnings {
+			e.LogFn("Warning: %s", warning)
+			e.warning(warning)
+		}
+		result.Warnings = append(result.Warnings, warnings...)
+		result.SBOM = opts.SBOM
+	}
+	if len(opts.Provenance) > 0 || opts.LabelProvenance {
+		statement := e.provenanceStatement(result, def, started, time.Now())
+		result.Provenance = &statement
+	}
+	return result, nil
+}
+
+// parseStages parses the Dockerfiles described by opts and splits them into
+// stages, with the automatic platform args set for the executor's platform,
+// or for daemonPlatform if the executor doesn't specify one. It also returns
+// any warnings from parsing the Dockerfiles.
+func parseStages(e *ClientExecutor, opts BuildOptions, daemonPlatform string) (*imagebuilder.Builder, imagebuilder.Stages, []string, error) {
+	dockerfiles := opts.Dockerfiles
+	if len(dockerfiles) == 0 {
+		dockerfiles = []string{filepath.Join(e.Directory, "Dockerfile")}
+	}
+	var warnings []string
+	var node *parser.Node
+	for _, dockerfile := range dockerfiles {
+		parsed, err := parseDockerfileWithWarnings(dockerfile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		warnings = append(warnings, parsed.Warnings...)
+		if node == nil {
+			node = parsed.AST
+			continue
+		}
+		node.Children = append(node.Children, parsed.AST.Children...)
+	}
+
+	args := opts.Args
+	if e.SourceDateEpoch != nil {
+		if _, ok := args[SourceDateEpochArg]; !ok {
+			args = make(map[string]string, len(opts.Args)+1)
+			for k, v := range opts.Args {
+				args[k] = v
+			}
+			args[SourceDateEpochArg] = strconv.FormatInt(e.SourceDateEpoch.Unix(), 10)
+		}
+	}
+	b := imagebuilder.NewBuilder(args)
+	if len(daemonPlatform) > 0 {
+		buildArgs, err := imagebuilder.BuildPlatformArgs(daemonPlatform)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error: Invalid daemon platform %q: %v", daemonPlatform, err)
+		}
+		for k, v := range buildArgs {
+			b.BuiltinArgDefaults[k] = v
+		}
+	}
+	if target := e.Platform; len(target) > 0 || len(daemonPlatform) > 0 {
+		if len(target) == 0 {
+			target = daemonPlatform
+		}
+		targetArgs, err := imagebuilder.TargetPlatformArgs(target)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error: Invalid platform %q: %v", target, err)
+		}
+		for k, v := range targetArgs {
+			b.BuiltinArgDefaults[k] = v
+		}
+	}
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return b, stages, warnings, nil
+}
+
+// parseDockerfileWithWarnings parses a Dockerfile, preprocessing it first if
+// its name ends in ".in".
+func parseDockerfileWithWarnings(path string) (*parser.Result, error) {
+	if strings.HasSuffix(path, ".in") {
+		return imagebuilder.ParsePreprocessedFile(path, nil)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parser.Parse(f)
+}
@@ -0,0 +1,85 @@
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestPlatformTag(t *testing.T) {
+	for name, expected := range map[string]string{
+		"busybox":                     "busybox:linux-arm64",
+		"busybox:1":                   "busybox:1-linux-arm64",
+		"example.com:5000/busybox":    "example.com:5000/busybox:linux-arm64",
+		"example.com:5000/busybox:v2": "example.com:5000/busybox:v2-linux-arm64",
+	} {
+		if got := platformTag(name, "linux/arm64"); got != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestForPlatform(t *testing.T) {
+	var logged []string
+	e := NewClientExecutor(nil)
+	e.Tag = "busybox:1"
+	e.AdditionalTags = []string{"busybox"}
+	e.Named = map[string]*ClientExecutor{"0": {}}
+	e.LogFn = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	copied := e.forPlatform("linux/arm/v7")
+	if copied.Platform != "linux/arm/v7" || copied.Named != nil {
+		t.Errorf("unexpected executor state: %#v", copied)
+	}
+	if copied.BuildID != e.BuildID || len(e.BuildID) == 0 {
+		t.Errorf("expected build ID %q to be shared, got %q", e.BuildID, copied.BuildID)
+	}
+	if copied.Tag != "busybox:1-linux-arm-v7" || !reflect.DeepEqual(copied.AdditionalTags, []string{"busybox:linux-arm-v7"}) {
+		t.Errorf("unexpected tags %q %v", copied.Tag, copied.AdditionalTags)
+	}
+	if e.Tag != "busybox:1" || e.AdditionalTags[0] != "busybox" {
+		t.Errorf("original tags were modified")
+	}
+	copied.LogFn("STEP %d", 1)
+	if !reflect.DeepEqual(logged, []string{"[linux/arm/v7] STEP 1"}) {
+		t.Errorf("unexpected log output %v", logged)
+	}
+}
+
+func TestDaemonPlatform(t *testing.T) {
+	info := map[string]string{"OSType": "linux", "Architecture": "aarch64"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/info" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(info)
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	platform, err := e.daemonPlatform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform != "linux/arm64" {
+		t.Errorf("expected linux/arm64, got %q", platform)
+	}
+	info["Architecture"] = "armv7l"
+	if platform, err = e.daemonPlatform(); err != nil || platform != "linux/arm/v7" {
+		t.Errorf("expected linux/arm/v7, got %q: %v", platform, err)
+	}
+	delete(info, "OSType")
+	if _, err := e.daemonPlatform(); err == nil {
+		t.Errorf("expected an error when the daemon doesn't report its platform")
+	}
+}
@@ -0,0 +1,233 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseBuildContext(t *testing.T) {
+	d := "sha256:" + strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		value    string
+		name     string
+		expected BuildContext
+		err      bool
+	}{
+		{value: "assets=../assets", name: "assets", expected: BuildContext{Directory: "../assets"}},
+		{value: "golang=docker-image://golang:1.22@" + d, name: "golang", expected: BuildContext{Image: "golang:1.22@" + d}},
+		{value: "base=oci-layout:///layouts/base", name: "base", expected: BuildContext{OCILayout: "/layouts/base"}},
+		{value: "base=oci-layout://layouts/base:v1", name: "base", expected: BuildContext{OCILayout: "layouts/base", OCIReference: "v1"}},
+		{value: "base=oci-layout://layouts/base@" + d, name: "base", expected: BuildContext{OCILayout: "layouts/base", OCIReference: d}},
+		{value: "base=oci-layout://layouts/base@sha256:bad", err: true},
+		{value: "base=docker-image://", err: true},
+		{value: "src=https://github.com/openshift/imagebuilder.git", err: true},
+		{value: "=../assets", err: true},
+		{value: "assets", err: true},
+	} {
+		name, bc, err := ParseBuildContext(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q %#v", tc.value, name, bc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.value, err)
+			continue
+		}
+		if name != tc.name || bc != tc.expected {
+			t.Errorf("%s: expected %q %#v, got %q %#v", tc.value, tc.name, tc.expected, name, bc)
+		}
+	}
+}
+
+func TestBuildContextImages(t *testing.T) {
+	e := NewClientExecutor(nil)
+	e.BuildContexts = map[string]BuildContext{
+		"golang": {Image: "docker.io/library/golang:1.22"},
+		"base":   {OCILayout: "/layouts/base"},
+		"assets": {Directory: "assets"},
+	}
+	images := e.buildContextImages([]string{"busybox", "golang", "base", "assets"})
+	expected := []string{"busybox", "docker.io/library/golang:1.22"}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected %v, got %v", expected, images)
+	}
+}
+
+func TestArchiveFromBuildContext(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"keep.txt":          "keep",
+		"skip.log":          "skip",
+		"sub/keep.txt":      "keep",
+		".containerignore":  "*.log\nsub/ignored\n",
+		"sub/ignored/a.txt": "a",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := NewClientExecutor(nil)
+	r, closer, err := e.archiveFromBuildContext("assets", BuildContext{Directory: dir}, ".", "/assets/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			names = append(names, h.Name)
+		}
+	}
+	sort.Strings(names)
+	expected := []string{"assets/.containerignore", "assets/keep.txt", "assets/sub/keep.txt"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+// fakeLoadDaemon accepts images loaded with "docker load", and reports them
+// as existing afterwards.
+type fakeLoadDaemon struct {
+	loaded map[string][]byte
+}
+
+func (d *fakeLoadDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/images/load":
+		archive, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tr := tar.NewReader(bytes.NewReader(archive))
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				http.Error(w, "no manifest.json", http.StatusBadRequest)
+				return
+			}
+			if h.Name != "manifest.json" {
+				continue
+			}
+			var manifests []dockerArchiveManifest
+			if err := json.NewDecoder(tr).Decode(&manifests); err != nil || len(manifests) != 1 || len(manifests[0].RepoTags) != 1 {
+				http.Error(w, "invalid manifest.json", http.StatusBadRequest)
+				return
+			}
+			d.loaded[manifests[0].RepoTags[0]] = archive
+			return
+		}
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/json"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		if _, ok := d.loaded[name]; !ok {
+			http.Error(w, "no such image", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&docker.Image{ID: "sha256:" + strings.Repeat("1", 64)})
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+func TestImportOCILayout(t *testing.T) {
+	saver := httptest.NewServer(fakeSaveDaemon{
+		"amd64image": dockerSaveArchive(t, "amd64"),
+		"arm64image": dockerSaveArchive(t, "arm64"),
+	})
+	defer saver.Close()
+	saveClient, err := docker.NewClient(saver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := t.TempDir()
+	if _, err := ExportOCILayout(context.Background(), saveClient, layout, "v1", []string{"amd64image", "arm64image"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ociLayoutManifest(layout, "v2", "linux/arm64"); err == nil {
+		t.Errorf("expected an error for a reference that isn't in the layout")
+	}
+	if _, err := ociLayoutManifest(layout, "v1", "linux/s390x"); err == nil {
+		t.Errorf("expected an error for a platform that isn't in the layout")
+	}
+	manifest, err := ociLayoutManifest(layout, "", "linux/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ocispec.Image
+	readLayoutJSON(t, layout, manifest.Config, &config)
+	if config.Architecture != "arm64" {
+		t.Fatalf("expected the arm64 image, got %s", config.Architecture)
+	}
+
+	daemon := &fakeLoadDaemon{loaded: make(map[string][]byte)}
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	e.BuildContexts = map[string]BuildContext{"base": {OCILayout: layout, OCIReference: "v1"}}
+	id, err := e.buildContextImage("base", e.BuildContexts["base"], "linux/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "sha256:"+strings.Repeat("1", 64) {
+		t.Errorf("unexpected image ID %s", id)
+	}
+	if _, err := e.buildContextImage("base", e.BuildContexts["base"], "linux/arm64"); err != nil || len(daemon.loaded) != 1 {
+		t.Errorf("expected the image to be imported once, got %d imports, %v", len(daemon.loaded), err)
+	}
+
+	// the archive that was loaded holds the same image as the layout
+	for tag, archive := range daemon.loaded {
+		if !strings.HasPrefix(tag, stageImagePrefix+e.BuildID+"-") {
+			t.Errorf("expected the image to be named for the build, got %s", tag)
+		}
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, ocispec.ImageBlobsDir, "sha256"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		desc, err := readDockerArchive(dir, bytes.NewReader(archive), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc.Platform == nil || desc.Platform.Architecture != "arm64" {
+			t.Errorf("unexpected platform %#v", desc.Platform)
+		}
+	}
+
+	if _, err := e.buildContextImage("assets", BuildContext{Directory: "assets"}, ""); err == nil {
+		t.Errorf("expected an error using a directory as an image")
+	}
+}
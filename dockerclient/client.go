@@ -6,21 +6,27 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/distribution/reference"
 	docker "github.com/fsouza/go-dockerclient"
 	dockerregistrytypes "github.com/moby/moby/api/types/registry"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog"
 
 	"github.com/openshift/imagebuilder"
+	"github.com/openshift/imagebuilder/dockerfile/command"
 	"github.com/openshift/imagebuilder/dockerfile/parser"
 	"github.com/openshift/imagebuilder/imageprogress"
 )
@@ -60,27 +66,98 @@ type ClientExecutor struct {
 	// from the context. Will be set to the contents of the
 	// .dockerignore file if nil.
 	Excludes []string
+	// BuildContexts are named sources, in addition to the context
+	// directory, that COPY --from=NAME and FROM NAME can refer to. They
+	// take precedence over stages and images with the same names.
+	BuildContexts map[string]BuildContext
 	// Tag is an optional value to tag the resulting built image.
 	Tag string
 	// Additional tags is an optional array of other tags to apply
 	// to the image.
 	AdditionalTags []string
 	// AllowPull when set will pull images that are not present on
-	// the daemon.
+	// the daemon. It is only used if PullPolicy is not set.
+	//
+	// Deprecated: set PullPolicy to PullIfMissing or PullNever instead.
 	AllowPull bool
+	// PullPolicy controls when images are pulled. If not set, images
+	// are pulled if they are missing and AllowPull is set, and are
+	// never pulled otherwise.
+	PullPolicy PullPolicy
+	// Platform, if set, is the platform to build for, in the form
+	// os/arch[/variant]. Base images are checked against it, and pulled
+	// for it, unless a stage's FROM instruction specifies a different
+	// platform. It does not affect the TARGET automatic args, which are
+	// controlled by the Builder's BuiltinArgDefaults.
+	Platform string
+	// LockFile, if set, pins the names of base images to the digests that
+	// it records for them.
+	LockFile *LockFile
+	// Registries, if set, controls where base images are pulled from,
+	// and how short names are resolved.
+	Registries *RegistriesConfig
 	// IgnoreUnrecognizedInstructions, if true, allows instructions
 	// that are not yet supported to be ignored (will be printed)
 	IgnoreUnrecognizedInstructions bool
-	// StrictVolumeOwnership if true will fail the build if a RUN
-	// command follows a VOLUME command, since this client cannot
-	// guarantee that the restored contents of the VOLUME directory
-	// will have the right permissions.
+	// StrictVolumeOwnership has no effect.
+	//
+	// Deprecated: the contents of VOLUME directories are preserved
+	// across RUN commands inside the container, which keeps their
+	// ownership, so builds no longer need to be failed to avoid losing it.
 	StrictVolumeOwnership bool
 	// TransientMounts are a set of mounts from outside the build
 	// to the inside that will not be part of the final image. Any
 	// content created inside the mount's destinationPath will be
 	// omitted from the final image.
 	TransientMounts []Mount
+	// Secrets are values which RUN instructions can mount with
+	// --mount=type=secret,id=ID. They are never part of the final image.
+	Secrets []Secret
+	// SSH are agents which RUN instructions can use by mounting them with
+	// --mount=type=ssh,id=ID.
+	SSH []SSHAgent
+
+	// StageContext, if true, uploads the build context, without the items
+	// that are excluded from it, to a volume once, and mounts it in the
+	// containers of stages which run commands, so that the COPY
+	// instructions in those stages are performed by copying from it inside
+	// the container, rather than by uploading an archive for each source.
+	// The build containers must have /bin/sh, cp and find, and the daemon
+	// must support volumes.
+	StageContext bool
+
+	// SourceDateEpoch, if set, is the time that reproducible builds use in
+	// place of the current time. Files which are added to the image with
+	// later modification times are given this time instead, the committed
+	// image is rewritten so that its creation time, and any later times in
+	// its history and layers, are this time, and it is passed to the build
+	// as the SOURCE_DATE_EPOCH build argument.
+	SourceDateEpoch *time.Time
+
+	// Labels are added to the labels of the committed image, replacing
+	// any with the same names.
+	Labels map[string]string
+	// UnsetLabels are labels, whether they were set by the Dockerfile or
+	// inherited from the base image, which are removed from the committed
+	// image. Labels which are also in Labels are kept.
+	UnsetLabels []string
+	// UnsetEnv are environment variables, whether they were set by the
+	// Dockerfile or inherited from the base image, which are removed from
+	// the committed image.
+	UnsetEnv []string
+	// DropInheritedLabels, if true, leaves the labels of the base image of
+	// each stage, including those of earlier stages, out of the image it
+	// builds, so that only the labels set by the Dockerfile and Labels
+	// remain.
+	DropInheritedLabels bool
+	// Author and Comment, if set, are recorded as the author and the
+	// comment of the committed image. Author replaces the one given by
+	// MAINTAINER.
+	Author, Comment string
+	// Annotations are added to the manifest of the built image, or of the
+	// image built for each platform, when it is exported as an OCI image
+	// layout. Images in the daemon can't have annotations.
+	Annotations map[string]string
 
 	// The path within the container to perform the transient mount.
 	ContainerTransientMount string
@@ -109,6 +186,17 @@ type ClientExecutor struct {
 	HostConfig *docker.HostConfig
 	// LogFn is an optional command to log information to the end user
 	LogFn func(format string, args ...interface{})
+	// Report, if set, is filled in with what happened during the build,
+	// for each stage and each instruction.
+	Report *BuildReport
+	// EventFn, if set, is called with an event for each thing that happens
+	// during the build. The progress of pulls and the output of RUN
+	// instructions are sent as events instead of being passed to LogFn and
+	// written to Out and ErrOut.
+	EventFn func(Event)
+	// TracerProvider, if set, is used to trace the build, in place of the
+	// global provider.
+	TracerProvider trace.TracerProvider
 
 	// Deferred is a list of operations that must be cleaned up at
 	// the end of execution. Use Release() to invoke all of these.
@@ -117,6 +205,43 @@ type ClientExecutor struct {
 	// Volumes handles saving and restoring volumes after RUN
 	// commands are executed.
 	Volumes *ContainerVolumeTracker
+
+	// BuildID identifies the containers, images, and volumes that are
+	// created during the build, so that they can be found by Prune() if
+	// the build is not able to clean up after itself. It may only contain
+	// lowercase letters and digits, and the build fails if it contains
+	// anything else. A random value is used if it is not set.
+	BuildID string
+
+	// ctx is the context of the operation in progress, if it was started
+	// by one of the methods which accept one.
+	ctx context.Context
+	// originalFrom and resolvedFrom are the name that the stage's base
+	// image was given, and the name that it was loaded as.
+	originalFrom, resolvedFrom string
+	// sshTargets maps the locations where SSH agent sockets are mounted in
+	// the build container to the sockets which forward to the agents.
+	sshTargets map[string]*sshForward
+	// buildContextImports maps the OCI layouts of build contexts, and the
+	// images selected from them, to the IDs they were imported as.
+	buildContextImports map[string]string
+	// stagedContext is the build context that has been uploaded to a volume,
+	// if StageContext is set, which is shared by the stages of a build.
+	stagedContext *stagedContext
+	// contextMounted is true if the staged build context is mounted in the
+	// build container.
+	contextMounted bool
+	// stageReport is the report of the stage that the executor builds, and
+	// stepReport is the report of the step in progress, if Report is set.
+	stageReport *StageReport
+	stepReport  *StepReport
+	// position is the position of the stage that the executor builds, and
+	// fromNode is its FROM instruction, if it is known.
+	position int
+	fromNode *parser.Node
+	// step is one more than the index of the step in progress in the
+	// stage, or 0 if no step is in progress.
+	step int
 }
 
 // NoAuthFn can be used for AuthFn when no authentication is required in Docker.
@@ -149,6 +274,13 @@ func (e *ClientExecutor) WithName(name string, position int) *ClientExecutor {
 	if e.Named == nil {
 		e.Named = make(map[string]*ClientExecutor)
 	}
+	// make sure that every stage uses the same build ID, an invalid one
+	// is reported when the stage names its first resource
+	e.buildID()
+	// and shares the staged build context
+	if e.StageContext {
+		e.stagedContextState()
+	}
 	e.Deferred = append([]func() error{func() error {
 		stage, ok := e.Named[strconv.Itoa(position)]
 		if !ok {
@@ -168,6 +300,11 @@ func (e *ClientExecutor) WithName(name string, position int) *ClientExecutor {
 	copied.Image = nil
 	copied.Volumes = nil
 	copied.Committed = nil
+	copied.stageReport = nil
+	copied.stepReport = nil
+	copied.position = position
+	copied.fromNode = nil
+	copied.step = 0
 
 	child := &copied
 	e.Named[name] = child
@@ -178,22 +315,70 @@ func (e *ClientExecutor) WithName(name string, position int) *ClientExecutor {
 // Stages executes all of the provided stages, starting from the base image. It returns the executor of the last stage
 // or an error if a stage fails.
 func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Stages, from string) (*ClientExecutor, error) {
+	return e.StagesWithContext(e.operationContext(), b, stages, from)
+}
+
+// StagesWithContext is like Stages, but stops executing stages and returns an
+// error when ctx is cancelled.
+func (e *ClientExecutor) StagesWithContext(ctx context.Context, b *imagebuilder.Builder, stages imagebuilder.Stages, from string) (_ *ClientExecutor, err error) {
+	if e.pullPolicy() == PullNever {
+		// report every missing image at once, rather than one at a time
+		images, err := stages.ExternalImages(from)
+		if err != nil {
+			return nil, fmt.Errorf("error: Determining base images: %v", err)
+		}
+		images = e.buildContextImages(images)
+		for i := range images {
+			images[i] = e.lockedReference(images[i])
+		}
+		if err := e.checkImagesPresent(images); err != nil {
+			return nil, err
+		}
+	}
+
+	// report every stage, including those which aren't reached
+	var reports []*StageReport
+	if e.Report != nil {
+		for _, stage := range stages {
+			reports = append(reports, e.Report.addStage(stage.Name, stage.Position, stage.Node))
+		}
+	}
+
 	var stageExecutor *ClientExecutor
+	var stageSpan trace.Span
+	defer func() {
+		if stageSpan != nil {
+			endSpan(stageSpan, err)
+		}
+	}()
 	for i, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		stageExecutor = e.WithName(stage.Name, stage.Position)
+		stageCtx, span := stageExecutor.startSpan(ctx, "stage", stagePositionKey.Int(stage.Position))
+		stageSpan = span
+		if reports != nil {
+			stageExecutor.stageReport = reports[i]
+		}
+		stageExecutor.fromNode = fromInstruction(stage.Node)
 
 		var stageFrom string
 		if i == 0 {
 			stageFrom = from
 		} else {
-			from, err := b.From(stage.Node)
+			// evaluate FROM with the stage's builder, so that it records
+			// the stage's platform
+			from, err := stage.Builder.From(stage.Node)
 			if err != nil {
 				return nil, fmt.Errorf("error: Determining base image: %v", err)
 			}
-			if b.After != "" {
+			if stage.Builder.After != "" {
 				return nil, fmt.Errorf("the --after flag in FROM is not supported by the dockerclient executor")
 			}
-			if prereq := e.Named[from]; prereq != nil {
+			// a build context takes precedence over a stage with the same name
+			_, isBuildContext := e.BuildContexts[from]
+			if prereq := e.Named[from]; prereq != nil && !isBuildContext {
 				b, ok := stages[:i].ByName(from)
 				if !ok {
 					return nil, fmt.Errorf("error: Unable to find stage %s builder", from)
@@ -201,8 +386,11 @@ func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Sta
 				if prereq.Committed == nil {
 					config := b.Builder.Config()
 					if prereq.Container.State.Running {
+						if err := prereq.Volumes.Clean(stageCtx, prereq.Container.ID, e.Client); err != nil {
+							return nil, err
+						}
 						klog.V(4).Infof("Stopping container %s ...", prereq.Container.ID)
-						if err := e.Client.StopContainer(prereq.Container.ID, 0); err != nil {
+						if err := e.Client.StopContainerWithContext(prereq.Container.ID, 0, stageCtx); err != nil {
 							return nil, fmt.Errorf("unable to stop build container: %v", err)
 						}
 						prereq.Container.State.Running = false
@@ -210,19 +398,32 @@ func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Sta
 						// we also set that here
 						config.ArgsEscaped = true
 					}
+					repository, err := e.resourceName(stageImagePrefix)
+					if err != nil {
+						return nil, err
+					}
+					commitCtx, commitSpan := prereq.startSpan(stageCtx, "commit")
 					image, err := e.Client.CommitContainer(docker.CommitContainerOptions{
-						Container: prereq.Container.ID,
-						Run:       config,
+						Container:  prereq.Container.ID,
+						Repository: repository,
+						Run:        config,
+						Context:    commitCtx,
 					})
 					if err != nil {
+						endSpan(commitSpan, err)
 						return nil, fmt.Errorf("unable to commit stage %s container: %v", from, err)
 					}
+					commitSpan.SetAttributes(imageIDKey.String(image.ID))
+					endSpan(commitSpan, nil)
 					klog.V(4).Infof("Committed %s to %s as basis for image %q: %#v", prereq.Container.ID, image.ID, from, config)
 					// deleting this image will fail with an "image has dependent child images" error
-					// if it ends up being an ancestor of the final image, so don't bother returning
-					// errors from this specific removeImage() call
-					prereq.Deferred = append([]func() error{func() error { e.removeImage(image.ID); return nil }}, prereq.Deferred...)
+					// if it ends up being an ancestor of the final image, so remove it by name, which
+					// at least untags it, and don't bother returning errors from this specific
+					// removeImage() call
+					prereq.Deferred = append([]func() error{func() error { e.removeImage(repository); return nil }}, prereq.Deferred...)
 					prereq.Committed = image
+					prereq.reportCommitted(image)
+					prereq.emit(&CommitEvent{ImageID: image.ID})
 				}
 				klog.V(4).Infof("Using image %s based on previous stage %s as image", prereq.Committed.ID, from)
 				from = prereq.Committed.ID
@@ -230,16 +431,21 @@ func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Sta
 			stageFrom = from
 		}
 
-		if err := stageExecutor.Prepare(stage.Builder, stage.Node, stageFrom); err != nil {
+		if err := stageExecutor.PrepareWithContext(stageCtx, stage.Builder, stage.Node, stageFrom); err != nil {
 			return nil, fmt.Errorf("error: preparing stage using %q as base: %v", stageFrom, err)
 		}
-		if err := stageExecutor.Execute(stage.Builder, stage.Node); err != nil {
+		if err := stageExecutor.ExecuteWithContext(stageCtx, stage.Builder, stage.Node); err != nil {
 			return nil, fmt.Errorf("error: running stage: %v", err)
 		}
 
 		// remember the outcome of the stage execution on the container config in case
 		// another stage needs to access incremental state
 		stageExecutor.Container.Config = stage.Builder.Config()
+		if stageExecutor.Image != nil {
+			stageSpan.SetAttributes(baseImageIDKey.String(stageExecutor.Image.ID))
+		}
+		endSpan(stageSpan, nil)
+		stageSpan = nil
 	}
 	return stageExecutor, nil
 }
@@ -261,7 +467,32 @@ func (e *ClientExecutor) Build(b *imagebuilder.Builder, node *parser.Node, from
 	return e.Commit(b)
 }
 
+// Prepare loads the base image and creates, and if the Dockerfile contains
+// RUN instructions, starts the container that the build is performed in.
 func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, from string) error {
+	return e.PrepareWithContext(e.operationContext(), b, node, from)
+}
+
+// PrepareWithContext is like Prepare, but uses ctx for the requests that it
+// makes to the daemon.
+func (e *ClientExecutor) PrepareWithContext(ctx context.Context, b *imagebuilder.Builder, node *parser.Node, from string) error {
+	defer e.withContext(ctx)()
+	e.ensureStageReport(node)
+	fromNode := e.fromNode
+	if fromNode == nil {
+		fromNode = fromInstruction(node)
+	}
+	if fromNode == nil {
+		fromNode = &parser.Node{Value: command.From, Original: "FROM " + from}
+	}
+	finish := e.startStep(0, fromNode)
+	err := e.prepare(e.operationContext(), b, node, from)
+	finish(err)
+	return err
+}
+
+func (e *ClientExecutor) prepare(ctx context.Context, b *imagebuilder.Builder, node *parser.Node, from string) error {
+	defer e.withContext(ctx)()
 	var err error
 
 	// identify the base image
@@ -286,9 +517,23 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 				return fmt.Errorf("unable to create a scratch image for this build: %v", err)
 			}
 			e.Deferred = append([]func() error{func() error { return e.removeImage(from) }}, e.Deferred...)
+			// the scratch image is empty, so it suits any platform
+			e.Image, err = e.loadImage(from, "", PullNever)
+		} else {
+			klog.V(4).Infof("Retrieving image %q", from)
+			platform := b.Platform
+			if len(platform) == 0 {
+				platform = e.Platform
+			}
+			if bc, ok := e.BuildContexts[from]; ok {
+				if from, err = e.buildContextImage(from, bc, platform); err != nil {
+					return err
+				}
+			}
+			e.originalFrom = from
+			from, e.Image, err = e.loadImageCandidates(e.lockedReference(from), platform)
+			e.resolvedFrom = from
 		}
-		klog.V(4).Infof("Retrieving image %q", from)
-		e.Image, err = e.LoadImageWithPlatform(from, b.Platform)
 		if err != nil {
 			return err
 		}
@@ -299,6 +544,11 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 	if err := b.FromImage(e.Image, node); err != nil {
 		return err
 	}
+	if e.DropInheritedLabels {
+		// the daemon adds them back when the image is committed, so
+		// they are also removed then
+		b.RunConfig.Labels = nil
+	}
 
 	b.RunConfig.Image = from
 	if len(e.Name) > 0 {
@@ -327,7 +577,9 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 			HostConfig: &docker.HostConfig{},
 		}
 		if e.HostConfig != nil {
-			opts.HostConfig = e.HostConfig
+			// the binds of each stage are added to a copy
+			hostConfig := *e.HostConfig
+			opts.HostConfig = &hostConfig
 		}
 		originalBinds := opts.HostConfig.Binds
 
@@ -338,7 +590,11 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 				if err != nil {
 					return err
 				}
-				v, err := e.Client.CreateVolume(docker.CreateVolumeOptions{Name: volumeName})
+				labels, err := e.buildLabels()
+				if err != nil {
+					return err
+				}
+				v, err := e.Client.CreateVolume(docker.CreateVolumeOptions{Name: volumeName, Labels: labels, Context: ctx})
 				if err != nil {
 					return fmt.Errorf("unable to create volume to mount secrets: %v", err)
 				}
@@ -374,7 +630,34 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 			opts.HostConfig.Binds = append(originalBinds, binds...)
 		}
 
+		e.sshTargets, e.contextMounted = nil, false
+		if mustStart {
+			var binds []string
+			if e.shouldStageContext(node) {
+				volume, err := e.stageContext(ctx, from)
+				if err != nil {
+					return err
+				}
+				binds = append(binds, volume+":"+contextMountPath+":ro")
+				e.contextMounted = true
+			}
+			sshBinds, err := e.sshBinds(b, node)
+			if err != nil {
+				return err
+			}
+			binds = append(binds, sshBinds...)
+			if len(binds) > 0 {
+				hostConfig := *opts.HostConfig
+				hostConfig.Binds = append(append([]string{}, hostConfig.Binds...), binds...)
+				opts.HostConfig = &hostConfig
+			}
+		}
+
 		klog.V(4).Infof("Creating container with %#v %#v", opts.Config, opts.HostConfig)
+		if opts.Name, err = e.resourceName(containerNamePrefix); err != nil {
+			return err
+		}
+		opts.Context = ctx
 		container, err := e.Client.CreateContainer(opts)
 		if err != nil {
 			return fmt.Errorf("unable to create build container: %v", err)
@@ -385,7 +668,7 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 
 	// TODO: lazy start
 	if mustStart && !e.Container.State.Running {
-		if err := e.Client.StartContainer(e.Container.ID, nil); err != nil {
+		if err := e.Client.StartContainerWithContext(e.Container.ID, nil, ctx); err != nil {
 			return fmt.Errorf("unable to start build container: %v", err)
 		}
 		e.Container.State.Running = true
@@ -397,19 +680,34 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 // Execute performs all of the provided steps against the initialized container. May be
 // invoked multiple times for a given container.
 func (e *ClientExecutor) Execute(b *imagebuilder.Builder, node *parser.Node) error {
+	return e.ExecuteWithContext(e.operationContext(), b, node)
+}
+
+// ExecuteWithContext is like Execute, but stops before the next step, or
+// interrupts a running command, when ctx is cancelled.
+func (e *ClientExecutor) ExecuteWithContext(ctx context.Context, b *imagebuilder.Builder, node *parser.Node) error {
+	defer e.withContext(ctx)()
+	e.ensureStageReport(node)
 	for i, child := range node.Children {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		finish := e.startStep(i+1, child)
 		step := b.Step()
 		if err := step.Resolve(child); err != nil {
+			finish(err)
 			return err
 		}
 		klog.V(4).Infof("step: %s", step.Original)
 		if e.LogFn != nil {
-			// original may have unescaped %, so perform fmt escaping
-			e.LogFn(strings.Replace(step.Original, "%", "%%", -1))
+			// original may contain %, so don't use it as the format
+			e.LogFn("%s", step.Original)
 		}
 		noRunsRemaining := !b.RequiresStart(&parser.Node{Children: node.Children[i+1:]})
 
-		if err := b.Run(step, e, noRunsRemaining); err != nil {
+		err := b.Run(step, e, noRunsRemaining)
+		finish(err)
+		if err != nil {
 			return err
 		}
 	}
@@ -420,11 +718,24 @@ func (e *ClientExecutor) Execute(b *imagebuilder.Builder, node *parser.Node) err
 // Commit saves the completed build as an image with the provided tag. It will
 // stop the container, commit the image, and then remove the container.
 func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
+	return e.CommitWithContext(e.operationContext(), b)
+}
+
+// CommitWithContext is like Commit, but uses ctx for the requests that it
+// makes to the daemon. Cleanup is performed even if ctx is cancelled.
+func (e *ClientExecutor) CommitWithContext(ctx context.Context, b *imagebuilder.Builder) (err error) {
+	ctx, span := e.startSpan(ctx, "commit")
+	defer func() { endSpan(span, err) }()
 	config := b.Config()
+	config.Labels = e.rewrittenBaseImageLabels(config.Labels)
+	e.applyMetadata(config)
 
 	if e.Container.State.Running {
+		if err := e.Volumes.Clean(ctx, e.Container.ID, e.Client); err != nil {
+			return err
+		}
 		klog.V(4).Infof("Stopping container %s ...", e.Container.ID)
-		if err := e.Client.StopContainer(e.Container.ID, 0); err != nil {
+		if err := e.Client.StopContainerWithContext(e.Container.ID, 0, ctx); err != nil {
 			return fmt.Errorf("unable to stop build container: %v", err)
 		}
 		e.Container.State.Running = false
@@ -450,15 +761,22 @@ func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
 	defer func() {
 		for _, err := range e.Release() {
 			e.LogFn("Unable to cleanup: %v", err)
+			e.warning(fmt.Sprintf("Unable to cleanup: %v", err))
 		}
 	}()
 
+	author := b.Author
+	if len(e.Author) > 0 {
+		author = e.Author
+	}
 	image, err := e.Client.CommitContainer(docker.CommitContainerOptions{
-		Author:     b.Author,
+		Author:     author,
+		Message:    e.Comment,
 		Container:  e.Container.ID,
 		Run:        config,
 		Repository: repository,
 		Tag:        tag,
+		Context:    ctx,
 	})
 	if err != nil {
 		return fmt.Errorf("unable to commit build container: %v", err)
@@ -467,20 +785,51 @@ func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
 	e.Committed = image
 	klog.V(4).Infof("Committed %s to %s", e.Container.ID, image.ID)
 
+	var rewriteMetadata func(map[string]json.RawMessage) error
+	if e.DropInheritedLabels || len(e.UnsetLabels) > 0 || len(e.UnsetEnv) > 0 {
+		committed, err := e.Client.InspectImage(image.ID)
+		if err != nil {
+			return fmt.Errorf("unable to inspect the built image: %v", err)
+		}
+		rewriteMetadata = e.metadataRewrite(config, committed.Config)
+	}
+	if e.SourceDateEpoch != nil || rewriteMetadata != nil {
+		committed := image.ID
+		if image, err = e.rewriteImage(ctx, committed, e.Tag, rewriteMetadata); err != nil {
+			if e.SourceDateEpoch != nil {
+				return fmt.Errorf("unable to set the timestamps of the built image: %v", err)
+			}
+			return fmt.Errorf("unable to remove labels and environment variables from the built image: %v", err)
+		}
+		e.Committed = image
+		if e.SourceDateEpoch != nil {
+			klog.V(4).Infof("Rewrote %s as %s with timestamps no later than %s", committed, image.ID, e.SourceDateEpoch.Format(time.RFC3339))
+		} else {
+			klog.V(4).Infof("Rewrote %s as %s without inherited labels and environment variables", committed, image.ID)
+		}
+	}
+	e.reportCommitted(image)
+
+	var tags []string
 	if len(e.Tag) > 0 {
+		tags = append(tags, e.Tag)
 		for _, s := range e.AdditionalTags {
 			repository, tag := docker.ParseRepositoryTag(s)
 			err := e.Client.TagImage(image.ID, docker.TagImageOptions{
-				Repo: repository,
-				Tag:  tag,
+				Repo:    repository,
+				Tag:     tag,
+				Context: ctx,
 			})
 			if err != nil {
 				e.Deferred = append([]func() error{func() error { return e.removeImage(image.ID) }}, e.Deferred...)
 				return fmt.Errorf("unable to tag %q: %v", s, err)
 			}
 			e.LogFn("Tagged as %s", s)
+			tags = append(tags, s)
 		}
 	}
+	e.emit(&CommitEvent{ImageID: image.ID, Tags: tags})
+	span.SetAttributes(imageIDKey.String(image.ID), tagsKey.StringSlice(tags))
 
 	if e.LogFn != nil {
 		e.LogFn("Done")
@@ -489,6 +838,12 @@ func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
 }
 
 func (e *ClientExecutor) PopulateTransientMounts(opts docker.CreateContainerOptions, transientMounts []Mount, sharedMount string) ([]string, error) {
+	name, err := e.resourceName(containerNamePrefix)
+	if err != nil {
+		return nil, err
+	}
+	opts.Name = name
+	opts.Context = e.operationContext()
 	container, err := e.Client.CreateContainer(opts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create transient container: %v", err)
@@ -515,7 +870,27 @@ func (e *ClientExecutor) PopulateTransientMounts(opts docker.CreateContainerOpti
 	return binds, nil
 }
 
-// Release deletes any items started by this executor.
+// operationContext returns the context of the operation in progress, or a
+// background context if there isn't one.
+func (e *ClientExecutor) operationContext() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// withContext sets the context which is used by methods which are called
+// through the imagebuilder.Executor interface, which doesn't pass one, and
+// returns a function which restores the previous context.
+func (e *ClientExecutor) withContext(ctx context.Context) func() {
+	previous := e.ctx
+	e.ctx = ctx
+	return func() { e.ctx = previous }
+}
+
+// Release deletes any items started by this executor. It is not affected by
+// the cancellation of any context, so that it can always be used to clean up
+// after a build that was interrupted.
 func (e *ClientExecutor) Release() []error {
 	errs := e.Volumes.Release()
 	for _, fn := range e.Deferred {
@@ -554,11 +929,10 @@ func (e *ClientExecutor) removeImage(id string) error {
 // CreateScratchImage creates a new, zero byte layer that is identical to "scratch"
 // except that the resulting image will have two layers.
 func (e *ClientExecutor) CreateScratchImage() (string, error) {
-	random, err := randSeq(imageSafeCharacters, 24)
+	name, err := e.resourceName(scratchImagePrefix)
 	if err != nil {
 		return "", err
 	}
-	name := fmt.Sprintf("scratch%s", random)
 
 	buf := &bytes.Buffer{}
 	w := tar.NewWriter(buf)
@@ -568,12 +942,64 @@ func (e *ClientExecutor) CreateScratchImage() (string, error) {
 		Repository:  name,
 		Source:      "-",
 		InputStream: buf,
+		Context:     e.operationContext(),
 	})
 }
 
 // imageSafeCharacters are characters allowed to be part of a Docker image name.
 const imageSafeCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
 
+// buildIDRegexp matches the build IDs which Prune() can find in the names of
+// containers and images.
+var buildIDRegexp = regexp.MustCompile("^[a-z0-9]+$")
+
+// buildID returns the ID of the build, choosing one if it isn't set, or an
+// error if the one which is set is not made of lowercase letters and digits.
+func (e *ClientExecutor) buildID() (string, error) {
+	if len(e.BuildID) == 0 {
+		id, err := randSeq(imageSafeCharacters, 24)
+		if err != nil {
+			// fall back to something that is still unlikely to collide
+			id = strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+		e.BuildID = id
+	}
+	if !buildIDRegexp.MatchString(e.BuildID) {
+		return "", fmt.Errorf("invalid build ID %q, it may only contain lowercase letters and digits", e.BuildID)
+	}
+	return e.BuildID, nil
+}
+
+// resourceName returns a new name, starting with prefix and the build ID, for
+// a container or temporary image that is created by the build. Containers and
+// images are identified by their names rather than by labels, because the
+// daemon copies a container's labels, including those of the image it was
+// created from, into any image that is committed from it.
+func (e *ClientExecutor) resourceName(prefix string) (string, error) {
+	id, err := e.buildID()
+	if err != nil {
+		return "", err
+	}
+	random, err := randSeq(imageSafeCharacters, 12)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s-%s", prefix, id, random), nil
+}
+
+// buildLabels returns the labels which identify a volume that is created by
+// the build.
+func (e *ClientExecutor) buildLabels() (map[string]string, error) {
+	id, err := e.buildID()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		BuildIDLabel: id,
+		CreatedLabel: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
 // randSeq returns a sequence of random characters drawn from source. It returns
 // an error if cryptographic randomness is not available or source is more than 255
 // characters.
@@ -597,28 +1023,77 @@ func (e *ClientExecutor) LoadImage(from string) (*docker.Image, error) {
 	return e.LoadImageWithPlatform(from, "")
 }
 
-// LoadImage checks the client for an image matching from. If not found,
-// attempts to pull the image with specified platform string.
+// LoadImageWithPlatform checks the client for an image matching from, and
+// pulls the image for the specified platform if the pull policy calls for it.
+// If the executor has a lock file, the digest it records for from is used,
+// and if it has a registries configuration, from is rewritten using it.
 func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*docker.Image, error) {
-	image, err := e.Client.InspectImage(from)
-	if err == nil {
-		return image, nil
-	}
-	if err != docker.ErrNoSuchImage {
+	_, image, err := e.loadImageCandidates(e.lockedReference(from), platform)
+	return image, err
+}
+
+func (e *ClientExecutor) loadImage(from string, platform string, policy PullPolicy) (image *docker.Image, err error) {
+	image, err = e.Client.InspectImage(from)
+	if err != nil && err != docker.ErrNoSuchImage {
 		return nil, err
 	}
+	var mismatch error
+	if err == nil {
+		// an image with the right name but for the wrong platform is as
+		// good as missing
+		mismatch = e.checkImageVariant(image, platform)
+	}
 
-	if !e.AllowPull {
-		klog.V(4).Infof("image %s did not exist", from)
-		return nil, docker.ErrNoSuchImage
+	switch policy {
+	case PullNever:
+		if err != nil {
+			klog.V(4).Infof("image %s did not exist", from)
+			return nil, fmt.Errorf("image %s is not present and the pull policy is %q: %w", from, PullNever, err)
+		}
+		if mismatch != nil {
+			return nil, fmt.Errorf("%v, and the pull policy is %q", mismatch, PullNever)
+		}
+		return image, nil
+	case PullIfMissing, "":
+		if err == nil && mismatch == nil {
+			return image, nil
+		}
+	case PullIfNewer:
+		if err == nil && mismatch == nil {
+			current, err := e.isImageCurrent(from, image)
+			if err != nil {
+				klog.V(4).Infof("Unable to compare image %s with its registry, pulling it: %v", from, err)
+			} else if current {
+				return image, nil
+			}
+		}
+	case PullAlways:
+	default:
+		return nil, fmt.Errorf("unrecognized pull policy %q", policy)
 	}
 
 	repository, tag := docker.ParseRepositoryTag(from)
+	if named, err := reference.ParseNormalizedNamed(from); err == nil {
+		if digested, ok := named.(reference.Digested); ok {
+			// ParseRepositoryTag() discards the digest, but the daemon
+			// accepts one in place of the tag
+			tag = digested.Digest().String()
+		}
+	}
 	if len(tag) == 0 {
 		tag = "latest"
 	}
 
 	klog.V(4).Infof("attempting to pull %s with auth from repository %s:%s", from, repository, tag)
+	e.reportStepStatus(StepRan)
+	ctx, span := e.startSpan(e.operationContext(), "pull", imageKey.String(from))
+	defer e.withContext(ctx)()
+	defer func() {
+		if image != nil {
+			span.SetAttributes(imageIDKey.String(image.ID))
+		}
+		endSpan(span, err)
+	}()
 
 	// TODO: we may want to abstract looping over multiple credentials
 	auth, _ := e.AuthFn(repository)
@@ -626,8 +1101,24 @@ func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*d
 		auth = append(auth, dockerregistrytypes.AuthConfig{})
 	}
 
-	if e.LogFn != nil {
-		e.LogFn("Image %s was not found, pulling ...", from)
+	if e.EventFn != nil {
+		switch {
+		case image == nil:
+			e.emit(&PullEvent{Image: from, Message: fmt.Sprintf("Image %s was not found, pulling ...", from)})
+		case mismatch != nil:
+			e.emit(&PullEvent{Image: from, Message: fmt.Sprintf("%v, pulling ...", mismatch)})
+		default:
+			e.emit(&PullEvent{Image: from, Message: fmt.Sprintf("Pulling image %s ...", from)})
+		}
+	} else if e.LogFn != nil {
+		switch {
+		case image == nil:
+			e.LogFn("Image %s was not found, pulling ...", from)
+		case mismatch != nil:
+			e.LogFn("%v, pulling ...", mismatch)
+		default:
+			e.LogFn("Pulling image %s ...", from)
+		}
 	}
 
 	var lastErr error
@@ -639,6 +1130,11 @@ func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*d
 		var pullErr error
 		func() { // A scope for defer
 			pullWriter := imageprogress.NewPullWriter(outputProgress)
+			if e.EventFn != nil {
+				pullWriter = imageprogress.NewPullProgressWriter(func(progress imageprogress.Progress) {
+					e.emit(&PullEvent{Image: from, Progress: &progress})
+				})
+			}
 			defer func() {
 				err := pullWriter.Close()
 				if pullErr == nil {
@@ -652,6 +1148,7 @@ func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*d
 				OutputStream:  pullWriter,
 				Platform:      platform,
 				RawJSONStream: true,
+				Context:       e.operationContext(),
 			}
 			if klog.V(5) {
 				pullImageOptions.OutputStream = os.Stderr
@@ -670,7 +1167,14 @@ func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*d
 		return nil, fmt.Errorf("unable to pull image (from: %s, tag: %s): %v", repository, tag, lastErr)
 	}
 
-	return e.Client.InspectImage(from)
+	image, err = e.Client.InspectImage(from)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkImageVariant(image, platform); err != nil {
+		return nil, fmt.Errorf("after pulling: %v", err)
+	}
+	return image, nil
 }
 
 func (e *ClientExecutor) Preserve(path string) error {
@@ -716,7 +1220,7 @@ func (e *ClientExecutor) createOrReplaceContainerPathWithOwner(path string, uid,
 		opts := docker.UploadToContainerOptions{
 			InputStream: reader,
 			Path:        "/",
-			Context:     context.TODO(),
+			Context:     e.operationContext(),
 		}
 		go func() {
 			defer writer.Close()
@@ -747,6 +1251,7 @@ func (e *ClientExecutor) createOrReplaceContainerPathWithOwner(path string, uid,
 		err := e.Client.DownloadFromContainer(e.Container.ID, docker.DownloadFromContainerOptions{
 			Path:         dest,
 			OutputStream: io.Discard,
+			Context:      e.operationContext(),
 		})
 		return err
 	}
@@ -772,6 +1277,8 @@ func (e *ClientExecutor) createOrReplaceContainerPathWithOwner(path string, uid,
 func (e *ClientExecutor) UnrecognizedInstruction(step *imagebuilder.Step) error {
 	if e.IgnoreUnrecognizedInstructions {
 		e.LogFn("warning: Unknown instruction: %s", strings.ToUpper(step.Command))
+		e.reportStepStatus(StepSkipped)
+		e.warning(fmt.Sprintf("Unknown instruction: %s", strings.ToUpper(step.Command)))
 		return nil
 	}
 	return fmt.Errorf("Unknown instruction: %s", strings.ToUpper(step.Command))
@@ -782,15 +1289,42 @@ func (e *ClientExecutor) UnrecognizedInstruction(step *imagebuilder.Step) error
 // the user command into a shell and perform those operations before. Since RUN
 // requires /bin/sh, we can use both 'cd' and 'export'.
 func (e *ClientExecutor) Run(run imagebuilder.Run, config docker.Config) error {
+	return e.RunWithContext(e.operationContext(), run, config)
+}
+
+// RunWithContext is like Run, but if ctx is cancelled while the command is
+// running, the build container is killed to interrupt it.
+func (e *ClientExecutor) RunWithContext(ctx context.Context, run imagebuilder.Run, config docker.Config) error {
 	if len(run.Files) > 0 {
 		return fmt.Errorf("Heredoc syntax is not supported")
 	}
-	if len(run.Mounts) > 0 {
-		return fmt.Errorf("RUN --mount not supported")
-	}
 	if run.Network != "" {
 		return fmt.Errorf("RUN --network not supported")
 	}
+	var mounts []imagebuilder.RunMount
+	for _, value := range run.Mounts {
+		mount, err := imagebuilder.ParseRunMount(value)
+		if err != nil {
+			return err
+		}
+		switch mount.Type {
+		case imagebuilder.MountTypeSecret:
+			// copied into the container just before the command runs, below
+		case imagebuilder.MountTypeSSH:
+			// checked when the agent is activated, below
+		default:
+			return fmt.Errorf("RUN --mount=type=%s not supported", mount.Type)
+		}
+		mounts = append(mounts, mount)
+	}
+	sshEnv, deactivateSSH, err := e.activateSSH(mounts)
+	if err != nil {
+		return err
+	}
+	defer deactivateSSH()
+	if len(sshEnv) > 0 {
+		config.Env = append(append([]string{}, config.Env...), sshEnv...)
+	}
 
 	args := make([]string, len(run.Args))
 	copy(args, run.Args)
@@ -839,13 +1373,34 @@ func (e *ClientExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 		}
 	}
 
-	if e.StrictVolumeOwnership && !e.Volumes.Empty() {
-		return fmt.Errorf("a RUN command was executed after a VOLUME command, which may result in ownership information being lost")
+	if err := e.Volumes.Save(ctx, e.Container.ID, e.Client); err != nil {
+		return err
+	}
+
+	unmountSecrets, err := e.mountSecrets(ctx, mounts)
+	if err != nil {
+		return err
 	}
-	if err := e.Volumes.Save(e.Container.ID, e.TempDir, e.Client); err != nil {
+	if err := e.runCommand(ctx, run, config, args); err != nil {
+		if unmountErr := unmountSecrets(); unmountErr != nil {
+			klog.Warningf("%v", unmountErr)
+		}
+		return err
+	}
+	if err := unmountSecrets(); err != nil {
 		return err
 	}
 
+	if err := e.Volumes.Restore(ctx, e.Container.ID, e.Client); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// runCommand runs args, the command of run, in the build container, with
+// config.
+func (e *ClientExecutor) runCommand(ctx context.Context, run imagebuilder.Run, config docker.Config, args []string) error {
 	config.Cmd = args
 	klog.V(4).Infof("Running %#v inside of %s as user %s", config.Cmd, e.Container.ID, config.User)
 	exec, err := e.Client.CreateExec(docker.CreateExecOptions{
@@ -854,34 +1409,77 @@ func (e *ClientExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 		AttachStdout: true,
 		AttachStderr: true,
 		User:         config.User,
+		Context:      ctx,
 	})
 	if err != nil {
 		return err
 	}
-	if err := e.Client.StartExec(exec.ID, docker.StartExecOptions{
-		OutputStream: e.Out,
-		ErrorStream:  e.ErrOut,
-	}); err != nil {
+	var stdout, stderr io.Writer = e.Out, e.ErrOut
+	if e.EventFn != nil {
+		stdoutLines, stderrLines := e.outputWriter(OutputStdout), e.outputWriter(OutputStderr)
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+		stdout, stderr = stdoutLines, stderrLines
+	}
+	waiter, err := e.Client.StartExecNonBlocking(exec.ID, docker.StartExecOptions{
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Context:      ctx,
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.waitForExec(ctx, waiter); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("running '%s' was interrupted: %w", strings.Join(run.Args, " "), err)
+		}
 		return err
 	}
 	status, err := e.Client.InspectExec(exec.ID)
 	if err != nil {
 		return err
 	}
+	e.reportExitCode(status.ExitCode)
 	if status.ExitCode != 0 {
 		klog.V(4).Infof("Failed command (code %d): %v", status.ExitCode, args)
 		return fmt.Errorf("running '%s' failed with exit code %d", strings.Join(run.Args, " "), status.ExitCode)
 	}
+	return nil
+}
 
-	if err := e.Volumes.Restore(e.Container.ID, e.Client); err != nil {
+// waitForExec waits for the session of an exec to end. Since the daemon has
+// no way to stop only the process that an exec started, the build container
+// is killed if ctx is cancelled first.
+func (e *ClientExecutor) waitForExec(ctx context.Context, waiter docker.CloseWaiter) error {
+	if waiter == nil {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- waiter.Wait() }()
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		klog.V(4).Infof("Killing container %s to interrupt the running command", e.Container.ID)
+		if err := e.Client.KillContainer(docker.KillContainerOptions{ID: e.Container.ID}); err != nil {
+			klog.V(4).Infof("Unable to kill container %s: %v", e.Container.ID, err)
+		}
+		e.Container.State.Running = false
+		waiter.Close()
+		<-done
+		return ctx.Err()
 	}
-
-	return nil
 }
 
 // Copy implements the executor copy function.
 func (e *ClientExecutor) Copy(excludes []string, copies ...imagebuilder.Copy) error {
+	return e.CopyWithContext(e.operationContext(), excludes, copies...)
+}
+
+// CopyWithContext is like Copy, but uses ctx for the requests that it makes
+// to the daemon.
+func (e *ClientExecutor) CopyWithContext(ctx context.Context, excludes []string, copies ...imagebuilder.Copy) error {
+	defer e.withContext(ctx)()
 	// copying content into a volume invalidates the archived state of any given directory
 	for _, copy := range copies {
 		if copy.Checksum != "" {
@@ -929,7 +1527,7 @@ func (e *ClientExecutor) getUser(userspec string) (int, int, error) {
 		if err := e.Client.DownloadFromContainer(e.Container.ID, docker.DownloadFromContainerOptions{
 			OutputStream: &buffer,
 			Path:         path,
-			Context:      context.TODO(),
+			Context:      e.operationContext(),
 		}); err != nil {
 			return nil, err
 		}
@@ -1088,7 +1686,6 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 				return err
 			}
 		}
-		// TODO: reuse source
 		for _, src := range c.Src {
 			if src == "" {
 				src = "*"
@@ -1096,23 +1693,6 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 			assumeDstIsDirectory := len(c.Src) > 1
 		repeatThisSrc:
 			klog.V(4).Infof("Archiving %s download=%t fromFS=%t from=%s", src, c.Download, c.FromFS, c.From)
-			var r io.Reader
-			var closer io.Closer
-			var err error
-			if len(c.From) > 0 {
-				if !assumeDstIsDirectory {
-					var err error
-					if assumeDstIsDirectory, err = e.isContainerGlobMultiple(e.Client, c.From, src); err != nil {
-						return err
-					}
-				}
-				r, closer, err = e.archiveFromContainer(c.From, src, c.Dest, assumeDstIsDirectory)
-			} else {
-				r, closer, err = e.Archive(c.FromFS, src, c.Dest, c.Download, excludes)
-			}
-			if err != nil {
-				return err
-			}
 			asOwner := ""
 			if c.Chown != "" {
 				asOwner = fmt.Sprintf(" as %d:%d", chownUid, chownGid)
@@ -1133,6 +1713,39 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 						}
 					}
 				}
+			}
+			if e.canCopyFromStagedContext(container, c, src) {
+				owner := ""
+				if c.Chown != "" {
+					owner = fmt.Sprintf("%d:%d", chownUid, chownGid)
+				}
+				if err := e.copyFromStagedContext(container, c, src, excludes, owner); err != nil {
+					return err
+				}
+				continue
+			}
+			var r io.Reader
+			var closer io.Closer
+			var err error
+			if bc, ok := e.BuildContexts[c.From]; ok && len(bc.Directory) > 0 {
+				r, closer, err = e.archiveFromBuildContext(c.From, bc, src, c.Dest)
+			} else if len(c.From) > 0 {
+				// only a pattern can match more than one item, so
+				// avoid downloading the source twice otherwise
+				if !assumeDstIsDirectory && containsWildcards(src) {
+					var err error
+					if assumeDstIsDirectory, err = e.isContainerGlobMultiple(e.Client, c.From, src); err != nil {
+						return err
+					}
+				}
+				r, closer, err = e.archiveFromContainer(c.From, src, c.Dest, assumeDstIsDirectory)
+			} else {
+				r, closer, err = e.Archive(c.FromFS, src, c.Dest, c.Download, excludes)
+			}
+			if err != nil {
+				return err
+			}
+			if c.Chown != "" {
 				filtered, err := transformArchive(r, false, chown)
 				if err != nil {
 					return err
@@ -1146,6 +1759,13 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 				}
 				r = filtered
 			}
+			if e.SourceDateEpoch != nil {
+				filtered, err := transformArchive(r, false, clampTimestamps(*e.SourceDateEpoch))
+				if err != nil {
+					return err
+				}
+				r = filtered
+			}
 			klog.V(5).Infof("Uploading to %s%s at %s", container.ID, asOwner, c.Dest)
 			if klog.V(6) {
 				logArchiveOutput(r, "Archive file for %s")
@@ -1156,14 +1776,19 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 			// indicating that we thought the content would be just
 			// one item, but it actually isn't
 			reader := &readErrorWrapper{Reader: r}
-			r = reader
+			var uploaded int64
+			r = e.uploadReader(&countingReader{Reader: reader, count: &uploaded})
+			ctx, span := e.startSpan(e.operationContext(), "upload", sourceKey.String(src), destinationKey.String(c.Dest))
 			err = e.Client.UploadToContainer(container.ID, docker.UploadToContainerOptions{
 				InputStream: r,
 				Path:        "/",
+				Context:     ctx,
 			})
 			if err := closer.Close(); err != nil {
 				klog.Errorf("Error while closing stream container copy stream %s: %v", container.ID, err)
 			}
+			span.SetAttributes(bytesKey.Int64(uploaded))
+			endSpan(span, err)
 			if err != nil {
 				if errors.Is(reader.err, dstNeedsToBeDirectoryError) && !assumeDstIsDirectory {
 					assumeDstIsDirectory = true
@@ -1203,7 +1828,8 @@ func (c closers) Close() error {
 
 func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, multipleSources bool) (io.Reader, io.Closer, error) {
 	var containerID string
-	if other, ok := e.Named[from]; ok {
+	bc, isBuildContext := e.BuildContexts[from]
+	if other, ok := e.Named[from]; ok && !isBuildContext {
 		if other.Container == nil {
 			return nil, nil, fmt.Errorf("the stage %q has not been built yet", from)
 		}
@@ -1211,14 +1837,28 @@ func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, mult
 		containerID = other.Container.ID
 	} else {
 		klog.V(5).Infof("Creating a container temporarily for image input from %q in %s", from, src)
-		_, err := e.LoadImage(from)
+		if isBuildContext {
+			image, err := e.buildContextImage(from, bc, e.Platform)
+			if err != nil {
+				return nil, nil, err
+			}
+			from = image
+		}
+		from, _, err := e.loadImageCandidates(e.lockedReference(from), e.Platform)
+		if err != nil {
+			return nil, nil, err
+		}
+		name, err := e.resourceName(containerNamePrefix)
 		if err != nil {
 			return nil, nil, err
 		}
 		c, err := e.Client.CreateContainer(docker.CreateContainerOptions{
+			Name: name,
 			Config: &docker.Config{
 				Image: from,
 			},
+			HostConfig: e.siblingHostConfig(nil),
+			Context:    e.operationContext(),
 		})
 		if err != nil {
 			return nil, nil, err
@@ -1235,6 +1875,7 @@ func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, mult
 		err := e.Client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
 			OutputStream: pw,
 			Path:         archiveRoot,
+			Context:      e.operationContext(),
 		})
 		pw.CloseWithError(err)
 	}
@@ -1327,226 +1968,3 @@ func (e *ClientExecutor) Archive(fromFS bool, src, dst string, allowDownload boo
 	klog.V(5).Infof("Archiving %q %q -> %q from disk", e.Directory, src, dst)
 	return archiveFromDisk(e.Directory, src, dst, allowDownload, excludes, check)
 }
-
-// ContainerVolumeTracker manages tracking archives of specific paths inside a container.
-type ContainerVolumeTracker struct {
-	paths map[string]string
-	errs  []error
-}
-
-func NewContainerVolumeTracker() *ContainerVolumeTracker {
-	return &ContainerVolumeTracker{
-		paths: make(map[string]string),
-	}
-}
-
-// Empty returns true if the tracker is not watching any paths
-func (t *ContainerVolumeTracker) Empty() bool {
-	return t == nil || len(t.paths) == 0
-}
-
-// Add tracks path unless it already is being tracked.
-func (t *ContainerVolumeTracker) Add(path string) {
-	if _, ok := t.paths[path]; !ok {
-		t.paths[path] = ""
-	}
-}
-
-// Release removes any stored snapshots
-func (t *ContainerVolumeTracker) Release() []error {
-	if t == nil {
-		return nil
-	}
-	for path := range t.paths {
-		t.ReleasePath(path)
-	}
-	return t.errs
-}
-
-func (t *ContainerVolumeTracker) ReleasePath(path string) {
-	if t == nil {
-		return
-	}
-	if archivePath, ok := t.paths[path]; ok && len(archivePath) > 0 {
-		err := os.Remove(archivePath)
-		if err != nil && !os.IsNotExist(err) {
-			t.errs = append(t.errs, err)
-		}
-		klog.V(5).Infof("Releasing path %s (%v)", path, err)
-		t.paths[path] = ""
-	}
-}
-
-func (t *ContainerVolumeTracker) Invalidate(path string) {
-	if t == nil {
-		return
-	}
-	set := imagebuilder.VolumeSet{}
-	set.Add(path)
-	for path := range t.paths {
-		if set.Covers(path) {
-			t.ReleasePath(path)
-		}
-	}
-}
-
-// Save ensures that all paths tracked underneath this container are archived or
-// returns an error.
-func (t *ContainerVolumeTracker) Save(containerID, tempDir string, client *docker.Client) error {
-	if t == nil {
-		return nil
-	}
-	set := imagebuilder.VolumeSet{}
-	for dest := range t.paths {
-		set.Add(dest)
-	}
-	// remove archive paths that are covered by other paths
-	for dest := range t.paths {
-		if !set.Has(dest) {
-			t.ReleasePath(dest)
-			delete(t.paths, dest)
-		}
-	}
-	for dest, archivePath := range t.paths {
-		if len(archivePath) > 0 {
-			continue
-		}
-		archivePath, err := snapshotPath(dest, containerID, tempDir, client)
-		if err != nil {
-			return err
-		}
-		t.paths[dest] = archivePath
-	}
-	return nil
-}
-
-// filterTarPipe transforms a tar file as it is streamed, calling fn on each header in the file.
-// If fn returns false, the file is skipped. If an error occurs it is returned.
-func filterTarPipe(w *tar.Writer, r *tar.Reader, fn func(*tar.Header) bool) error {
-	for {
-		h, err := r.Next()
-		if err != nil {
-			return err
-		}
-		if fn(h) {
-			if err := w.WriteHeader(h); err != nil {
-				return err
-			}
-			if _, err := io.Copy(w, r); err != nil {
-				return err
-			}
-		} else {
-			if _, err := io.Copy(io.Discard, r); err != nil {
-				return err
-			}
-		}
-	}
-}
-
-// snapshotPath preserves the contents of path in container containerID as a temporary
-// archive, returning either an error or the path of the archived file.
-func snapshotPath(path, containerID, tempDir string, client *docker.Client) (string, error) {
-	f, err := os.CreateTemp(tempDir, "archived-path")
-	if err != nil {
-		return "", err
-	}
-	klog.V(4).Infof("Snapshot %s for later use under %s", path, f.Name())
-
-	r, w := io.Pipe()
-	tr := tar.NewReader(r)
-	tw := tar.NewWriter(f)
-	go func() {
-		err := filterTarPipe(tw, tr, func(h *tar.Header) bool {
-			if i := strings.Index(h.Name, "/"); i != -1 {
-				h.Name = h.Name[i+1:]
-			}
-			return len(h.Name) > 0
-		})
-		if err == nil || errors.Is(err, io.EOF) {
-			tw.Flush()
-			w.Close()
-			klog.V(5).Infof("Snapshot rewritten from %s", path)
-			return
-		}
-		klog.V(5).Infof("Snapshot of %s failed: %v", path, err)
-		w.CloseWithError(err)
-	}()
-
-	if !strings.HasSuffix(path, "/") {
-		path += "/"
-	}
-	err = client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
-		Path:         path,
-		OutputStream: w,
-	})
-	f.Close()
-	if err != nil {
-		os.Remove(f.Name())
-		return "", err
-	}
-	return f.Name(), nil
-}
-
-// Restore ensures the paths managed by t exactly match the container. This requires running
-// exec as a user that can delete contents from the container. It will return an error if
-// any client operation fails.
-func (t *ContainerVolumeTracker) Restore(containerID string, client *docker.Client) error {
-	if t == nil {
-		return nil
-	}
-	for dest, archivePath := range t.paths {
-		if len(archivePath) == 0 {
-			return fmt.Errorf("path %s does not have an archive and cannot be restored", dest)
-		}
-		klog.V(4).Infof("Restoring contents of %s from %s", dest, archivePath)
-		if !strings.HasSuffix(dest, "/") {
-			dest = dest + "/"
-		}
-		exec, err := client.CreateExec(docker.CreateExecOptions{
-			Container: containerID,
-			Cmd:       []string{"/bin/sh", "-c", "rm -rf $@", "", dest + "*"},
-			User:      "0",
-		})
-		if err != nil {
-			return fmt.Errorf("unable to setup clearing preserved path %s: %v", dest, err)
-		}
-		if err := client.StartExec(exec.ID, docker.StartExecOptions{}); err != nil {
-			return fmt.Errorf("unable to clear preserved path %s: %v", dest, err)
-		}
-		var status *docker.ExecInspect
-		for status == nil {
-			status, err = client.InspectExec(exec.ID)
-			if err != nil {
-				break
-			}
-			if !status.Running {
-				break
-			}
-			status = nil
-		}
-		if err != nil {
-			return fmt.Errorf("clearing preserved path %s did not succeed: %v", dest, err)
-		}
-		if status.ExitCode != 0 {
-			return fmt.Errorf("clearing preserved path %s failed with exit code %d", dest, status.ExitCode)
-		}
-		err = func() error {
-			f, err := os.Open(archivePath)
-			if err != nil {
-				return fmt.Errorf("unable to open archive %s for preserved path %s: %v", archivePath, dest, err)
-			}
-			defer f.Close()
-			if err := client.UploadToContainer(containerID, docker.UploadToContainerOptions{
-				InputStream: f,
-				Path:        dest,
-			}); err != nil {
-				return fmt.Errorf("unable to upload preserved contents from %s to %s: %v", archivePath, dest, err)
-			}
-			return nil
-		}()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
@@ -6,7 +6,10 @@ package dockerclient
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	crand "crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -17,8 +20,10 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -26,6 +31,10 @@ import (
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/openshift/imagebuilder/dockerfile/command"
 	"github.com/openshift/imagebuilder/dockerfile/parser"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.podman.io/storage/pkg/archive"
 	"go.podman.io/storage/pkg/fileutils"
 
@@ -251,6 +260,140 @@ func TestMultiStageBase(t *testing.T) {
 	}
 }
 
+func TestMultiStageBaseVolumeSnapshots(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			t.Errorf("%v", err)
+		}
+	}()
+
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = t.TempDir()
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+	defer e.removeImage(e.Tag)
+
+	node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString(`FROM mirror.gcr.io/busybox AS base
+VOLUME /data
+RUN echo base > /data/file
+RUN echo more >> /data/file
+FROM base
+RUN test ! -e /.imagebuilder-volumes
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := e.Stages(b, stages, "")
+	if err != nil {
+		t.Fatalf("unable to build image: %v\n%s", err, out.String())
+	}
+	if err := last.Commit(stages[len(stages)-1].Builder); err != nil {
+		t.Fatalf("unable to commit image: %v\n%s", err, out.String())
+	}
+
+	headers, _, err := imageFSMetadata(c, e.Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range headers {
+		if strings.HasPrefix(strings.TrimPrefix(name, "./"), strings.TrimPrefix(volumeSnapshotDir, "/")) {
+			t.Errorf("the image contains the volume snapshot %s", name)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(c)
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.Directory = tmpDir
+	e.Tag = filepath.Base(tmpDir)
+	result, err := Build(context.Background(), BuildOptions{
+		Executor:    e,
+		Dockerfiles: []string{"testdata/Dockerfile.reusebase"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.removeImage(result.ImageID)
+
+	image, err := c.InspectImage(e.Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.ID != result.ImageID {
+		t.Errorf("expected tag %q to refer to %s, got %s", e.Tag, result.ImageID, image.ID)
+	}
+	if len(result.Stages) != 2 {
+		t.Fatalf("expected 2 stages, got %#v", result.Stages)
+	}
+	for _, stage := range result.Stages {
+		if stage.BaseImageID == "" {
+			t.Errorf("no base image recorded for stage %d", stage.Position)
+		}
+	}
+	if result.Stages[0].ImageID == "" {
+		t.Errorf("expected the first stage to have been committed as a base for the second")
+	}
+	if last := result.Stages[len(result.Stages)-1]; last.ImageID != result.ImageID {
+		t.Errorf("expected the last stage to be committed as %s, got %s", result.ImageID, last.ImageID)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			t.Errorf("%v", err)
+		}
+	}()
+
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM mirror.gcr.io/busybox\nRUN sleep 600\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.PrepareWithContext(ctx, b, node, ""); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = e.ExecuteWithContext(ctx, b, node)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the build to be interrupted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("interrupting the build took %s", elapsed)
+	}
+}
+
 // TestConformance* compares the result of running the direct build against a
 // sequential docker build. A dockerfile and git repo is loaded, then each step
 // in the file is run sequentially, committing after each step. The generated
@@ -440,6 +583,10 @@ func TestConformanceInternal(t *testing.T) {
 			Name:       "volumeexists",
 			Dockerfile: "testdata/Dockerfile.volumeexists",
 		},
+		{
+			Name:       "volumeownership",
+			Dockerfile: "testdata/Dockerfile.volumeownership",
+		},
 		{
 			Name:       "multistage 1",
 			ContextDir: "testdata",
@@ -648,6 +795,223 @@ func TestTransientMount(t *testing.T) {
 	}
 }
 
+// buildWithStagedContext builds the Dockerfile in dockerfile using the
+// context in dir, and returns the tag of the image.
+func buildWithStagedContext(tb testing.TB, c *docker.Client, dir, dockerfile string, stage bool) string {
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			tb.Errorf("%v", err)
+		}
+	}()
+	e.AllowPull = true
+	e.Directory = dir
+	e.StageContext = stage
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+	if err := e.DefaultExcludes(); err != nil {
+		tb.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString(dockerfile))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	last, err := e.Stages(b, stages, "")
+	if err != nil {
+		tb.Fatalf("unable to build image: %v\n%s", err, out.String())
+	}
+	if err := last.Commit(stages[len(stages)-1].Builder); err != nil {
+		tb.Fatalf("unable to commit image: %v\n%s", err, out.String())
+	}
+	return e.Tag
+}
+
+func TestStageContext(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerfile := `FROM mirror.gcr.io/busybox AS base
+RUN mkdir -p /existing && touch /existing/kept
+COPY dir /existing
+COPY --chown=1000:1001 --chmod=0750 copy/ /owned/
+COPY copyblahblub/* /blah/
+COPY Dockerfile.env /renamed
+COPY Dockerfile.env Dockerfile.args /multiple/
+COPY . /everything/
+RUN ls -la /existing
+FROM base
+COPY --from=base /renamed /fromstage
+RUN true
+`
+	upload := buildWithStagedContext(t, c, "testdata", dockerfile, false)
+	defer c.RemoveImage(upload)
+	staged := buildWithStagedContext(t, c, "testdata", dockerfile, true)
+	defer c.RemoveImage(staged)
+
+	differ, differentContent, onlyUpload, onlyStaged, err := compareImageFS(c, upload, staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, headers := range differ {
+		// directories which COPY copies into can have their times changed
+		if headers[0].Typeflag == tar.TypeDir && headers[0].Mode == headers[1].Mode && headers[0].Uid == headers[1].Uid && headers[0].Gid == headers[1].Gid {
+			continue
+		}
+		t.Errorf("%s differs: %#v, %#v", name, headers[0].Header, headers[1].Header)
+	}
+	for name := range differentContent {
+		t.Errorf("%s has different content", name)
+	}
+	for name := range onlyUpload {
+		t.Errorf("%s is only in the image which was built by uploading", name)
+	}
+	for name := range onlyStaged {
+		t.Errorf("%s is only in the image which was built from the staged context", name)
+	}
+}
+
+// BenchmarkStageContext compares copying a large build context by uploading
+// an archive for each COPY source with copying it from the staged context.
+func BenchmarkStageContext(b *testing.B) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir := b.TempDir()
+	data := make([]byte, 1<<20)
+	for i := 0; i < 4; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 64; j++ {
+			if _, err := io.ReadFull(crand.Reader, data); err != nil {
+				b.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("file%d", j)), data, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	dockerfile := "FROM mirror.gcr.io/busybox\nCOPY dir0 /dir0\nCOPY dir1 dir2 /dirs/\nCOPY dir3/file* /dir3/\nCOPY . /all/\nRUN du -s /dir0 /dirs /dir3 /all\n"
+
+	for _, stage := range []bool{false, true} {
+		name := "upload"
+		if stage {
+			name = "staged"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tag := buildWithStagedContext(b, c, dir, dockerfile, stage)
+				b.StopTimer()
+				c.RemoveImage(tag)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestSecretMount(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileSecret := fmt.Sprintf("file-secret-%d", rand.Int63())
+	envSecret := fmt.Sprintf("env-secret-%d", rand.Int63())
+	source := filepath.Join(t.TempDir(), "npmrc")
+	if err := os.WriteFile(source, []byte(fileSecret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("IMAGEBUILDER_TEST_TOKEN", envSecret)
+
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			t.Errorf("%v", err)
+		}
+	}()
+
+	e.AllowPull = true
+	e.Directory = "testdata"
+	e.Secrets = []Secret{
+		{ID: "npmrc", Source: source},
+		{ID: "token", Env: "IMAGEBUILDER_TEST_TOKEN"},
+	}
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+
+	defer e.removeImage(e.Tag)
+
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	var logged []string
+	e.LogFn = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	b := imagebuilder.NewBuilder(nil)
+	node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString(`FROM mirror.gcr.io/busybox
+RUN --mount=type=secret,id=npmrc,target=/root/.npmrc,required=true test -s /root/.npmrc
+RUN --mount=type=secret,id=token,required test "$(wc -c < /run/secrets/token)" -gt 0
+RUN test ! -e /run/secrets/token && test ! -e /root/.npmrc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Build(b, node, ""); err != nil {
+		t.Fatalf("unable to build image: %v\n%s", err, out.String())
+	}
+
+	for _, secret := range []string{fileSecret, envSecret} {
+		if strings.Contains(out.String(), secret) || strings.Contains(strings.Join(logged, "\n"), secret) {
+			t.Errorf("secret %q appeared in the build output:\n%s\n%s", secret, out.String(), strings.Join(logged, "\n"))
+		}
+	}
+
+	image, err := c.InspectImage(e.Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := c.ImageHistory(e.Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, contents, err := imageFSMetadata(c, e.Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range headers {
+		name = strings.Trim(strings.TrimPrefix(name, "./"), "/")
+		switch {
+		case name == "run/secrets/token", name == "run/secrets", name == "root/.npmrc", strings.HasPrefix(name, strings.TrimPrefix(secretStagingDir, "/")):
+			t.Errorf("the image contains %s, which was only needed while secrets were mounted", name)
+		}
+	}
+	for _, secret := range []string{fileSecret, envSecret} {
+		for _, env := range image.Config.Env {
+			if strings.Contains(env, secret) {
+				t.Errorf("secret %q appeared in the image's environment: %s", secret, env)
+			}
+		}
+		for _, entry := range history {
+			if strings.Contains(entry.CreatedBy, secret) || strings.Contains(entry.Comment, secret) {
+				t.Errorf("secret %q appeared in the image's history: %#v", secret, entry)
+			}
+		}
+		for name, data := range contents {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("secret %q appeared in the image's file %s", secret, name)
+			}
+		}
+	}
+}
+
 func testContainerOutput(c *docker.Client, tag string, command []string) (string, error) {
 	container, err := c.CreateContainer(docker.CreateContainerOptions{
 		Name: tag + "-test",
@@ -1346,3 +1710,481 @@ func (h *hardlinkChecker) Check(info os.FileInfo, name string) (string, bool) {
 	}
 	return "", false
 }
+
+// TestSourceDateEpoch builds the same Dockerfile twice, with the files in the
+// context modified in between, and expects the same image each time.
+func TestSourceDateEpoch(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := "FROM mirror.gcr.io/busybox\nCOPY . /app/\nRUN echo $SOURCE_DATE_EPOCH > /app/epoch\n"
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Unix(1700000000, 0).UTC()
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		now := time.Now()
+		if err := os.Chtimes(filepath.Join(dir, "file"), now, now); err != nil {
+			t.Fatal(err)
+		}
+		e := NewClientExecutor(c)
+		out := &bytes.Buffer{}
+		e.Out, e.ErrOut = out, out
+		e.AllowPull = true
+		e.Directory = dir
+		e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+		e.SourceDateEpoch = &epoch
+		result, err := Build(context.Background(), BuildOptions{Executor: e})
+		if err != nil {
+			t.Fatalf("unable to build image: %v\n%s", err, out.String())
+		}
+		defer c.RemoveImage(e.Tag)
+		image, err := c.InspectImage(e.Tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image.ID != result.ImageID {
+			t.Errorf("expected tag %q to refer to %s, got %s", e.Tag, result.ImageID, image.ID)
+		}
+		if !image.Created.Equal(epoch) {
+			t.Errorf("expected image to have been created at %s, got %s", epoch, image.Created)
+		}
+		// the base image's layers are shared with it, not rewritten
+		base, err := c.InspectImage("mirror.gcr.io/busybox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image.RootFS == nil || base.RootFS == nil || len(image.RootFS.Layers) <= len(base.RootFS.Layers) || !reflect.DeepEqual(image.RootFS.Layers[:len(base.RootFS.Layers)], base.RootFS.Layers) {
+			t.Errorf("expected the image to start with the base image's layers %v, got %v", base.RootFS, image.RootFS)
+		}
+		ids = append(ids, image.ID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("expected both builds to produce the same image, got %s and %s", ids[0], ids[1])
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := "FROM mirror.gcr.io/busybox AS build\nARG VERSION\nRUN echo $VERSION > /version\nFROM mirror.gcr.io/busybox\nCOPY --from=build /version /version\n"
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(c)
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = dir
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+	provenance := filepath.Join(t.TempDir(), "provenance.jsonl")
+	result, err := Build(context.Background(), BuildOptions{
+		Executor:        e,
+		Args:            map[string]string{"VERSION": "1.0", "UNUSED": "value"},
+		Provenance:      provenance,
+		LabelProvenance: true,
+	})
+	if err != nil {
+		t.Fatalf("unable to build image: %v\n%s", err, out.String())
+	}
+	defer c.RemoveImage(e.Tag)
+
+	data, err := os.ReadFile(provenance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statement ProvenanceStatement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(statement, *result.Provenance) {
+		t.Errorf("expected the file to hold %#v, got %#v", *result.Provenance, statement)
+	}
+	if len(statement.Subject) != 1 || "sha256:"+statement.Subject[0].Digest["sha256"] != result.ImageID {
+		t.Errorf("expected the subject to be %s, got %#v", result.ImageID, statement.Subject)
+	}
+	def := statement.Predicate.BuildDefinition
+	if !reflect.DeepEqual(def.ExternalParameters.Args, map[string]string{"VERSION": "1.0"}) {
+		t.Errorf("unexpected args %v", def.ExternalParameters.Args)
+	}
+	var names []string
+	for _, dependency := range def.ResolvedDependencies {
+		names = append(names, dependency.Name)
+		if dependency.Name == "stage:build" && (dependency.URI != "docker-image://mirror.gcr.io/busybox" || len(dependency.Digest["sha256"]) == 0) {
+			t.Errorf("unexpected base image %#v", dependency)
+		}
+	}
+	if expected := []string{"dockerfile:Dockerfile", "context", "stage:build", "stage:1"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected dependencies %v, got %v", expected, names)
+	}
+
+	image, err := c.InspectImage(result.ImageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labeled ProvenanceBuildDefinition
+	if err := json.Unmarshal([]byte(image.Config.Labels[ProvenanceLabel]), &labeled); err != nil {
+		t.Fatalf("unable to parse label %q: %v", image.Config.Labels[ProvenanceLabel], err)
+	}
+	if !reflect.DeepEqual(labeled, def) {
+		t.Errorf("expected the label to hold %#v, got %#v", def, labeled)
+	}
+}
+
+func TestSBOM(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from   string
+		format SBOMFormat
+		purl   string
+	}{
+		{from: "mirror.gcr.io/alpine", format: SBOMFormatCycloneDX, purl: "pkg:apk/alpine/musl@"},
+		{from: "mirror.gcr.io/debian", format: SBOMFormatSPDX, purl: "pkg:deb/debian/libc6@"},
+		{from: "registry.fedoraproject.org/fedora-minimal", format: SBOMFormatSPDX, purl: "pkg:rpm/fedora/glibc@"},
+		{from: "mirror.gcr.io/golang:1.25", format: SBOMFormatCycloneDX, purl: "pkg:golang/stdlib@"},
+	} {
+		t.Run(tc.from, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM "+tc.from+"\nLABEL sbom=true\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			e := NewClientExecutor(c)
+			out := &bytes.Buffer{}
+			e.Out, e.ErrOut = out, out
+			e.AllowPull = true
+			e.Directory = dir
+			e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+			sbom := filepath.Join(t.TempDir(), "sbom.json")
+			result, err := Build(context.Background(), BuildOptions{Executor: e, SBOM: sbom, SBOMFormat: tc.format})
+			if err != nil {
+				t.Fatalf("unable to build image: %v\n%s", err, out.String())
+			}
+			defer c.RemoveImage(e.Tag)
+			if result.SBOM != sbom {
+				t.Errorf("expected the SBOM to be written to %s, got %q", sbom, result.SBOM)
+			}
+			data, err := os.ReadFile(sbom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(data, []byte(tc.purl)) {
+				t.Errorf("expected the SBOM to list %s, got:\n%s", tc.purl, data)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := `FROM mirror.gcr.io/busybox AS build
+COPY Dockerfile /src/
+RUN cp /src/Dockerfile /out
+FROM mirror.gcr.io/busybox
+COPY --from=build /out /out
+RUN exit 3
+RUN true
+`
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(c)
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = dir
+	e.Report = &BuildReport{}
+	if _, err := Build(context.Background(), BuildOptions{Executor: e}); err == nil {
+		t.Fatalf("expected the build to fail:\n%s", out.String())
+	}
+	report := e.Report
+	if len(report.Error) == 0 || report.Duration == 0 {
+		t.Errorf("expected the report to record the failed build, got %q after %s", report.Error, report.Duration)
+	}
+	if len(report.Stages) != 2 {
+		t.Fatalf("expected a report for each stage, got %d", len(report.Stages))
+	}
+	build := report.Stages[0]
+	if len(build.ImageID) == 0 || build.ImageSize == 0 {
+		t.Errorf("expected the image committed for the first stage to be reported, got %q of %d bytes", build.ImageID, build.ImageSize)
+	}
+	if copied := build.Steps[1]; copied.Status != StepRan || copied.BytesUploaded == 0 {
+		t.Errorf("expected %q to upload the Dockerfile, got %s with %d bytes", copied.Original, copied.Status, copied.BytesUploaded)
+	}
+	if from := build.Steps[0]; from.Status != StepCached && from.Status != StepRan {
+		t.Errorf("expected %q to be performed, got %s", from.Original, from.Status)
+	}
+	final := report.Stages[1].Steps
+	if run := final[2]; run.Status != StepFailed || run.ExitCode == nil || *run.ExitCode != 3 {
+		t.Errorf("expected %q to fail with exit code 3, got %s with %v", run.Original, run.Status, run.ExitCode)
+	}
+	if skipped := final[3]; skipped.Status != StepSkipped {
+		t.Errorf("expected %q to be skipped, got %s", skipped.Original, skipped.Status)
+	}
+	if len(report.Stages[1].ImageID) != 0 {
+		t.Errorf("expected no image to be reported for the failed stage, got %s", report.Stages[1].ImageID)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := `FROM mirror.gcr.io/busybox
+COPY Dockerfile /
+RUN echo out && echo err 1>&2
+`
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var events []Event
+	e := NewClientExecutor(c)
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = dir
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+	e.EventFn = func(event Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}
+	if _, err := Build(context.Background(), BuildOptions{Executor: e}); err != nil {
+		t.Fatalf("unable to build image: %v\n%s", err, out.String())
+	}
+	defer c.RemoveImage(e.Tag)
+	if out.Len() > 0 {
+		t.Errorf("expected RUN output to be sent as events, got:\n%s", out.String())
+	}
+
+	var started, finished []int
+	var output []string
+	var copied, committed bool
+	for _, event := range events {
+		switch event := event.(type) {
+		case *StepStartedEvent:
+			started = append(started, event.Step)
+		case *StepFinishedEvent:
+			if len(event.Error) > 0 {
+				t.Errorf("unexpected failure of step %d: %s", event.Step, event.Error)
+			}
+			finished = append(finished, event.Step)
+		case *OutputEvent:
+			if event.Step != 2 {
+				t.Errorf("expected output only from step 2, got %q from %d", event.Line, event.Step)
+			}
+			output = append(output, event.Stream+": "+event.Line)
+		case *CopyEvent:
+			copied = copied || (event.Step == 1 && event.Done && event.Bytes > 0)
+		case *CommitEvent:
+			committed = len(event.ImageID) > 0 && reflect.DeepEqual(event.Tags, []string{e.Tag})
+		}
+	}
+	if !reflect.DeepEqual(started, []int{0, 1, 2}) || !reflect.DeepEqual(finished, []int{0, 1, 2}) {
+		t.Errorf("expected each step to start and finish in order, got %v and %v", started, finished)
+	}
+	sort.Strings(output)
+	if !reflect.DeepEqual(output, []string{"stderr: err", "stdout: out"}) {
+		t.Errorf("unexpected output: %v", output)
+	}
+	if !copied {
+		t.Errorf("expected the upload of the COPY to be reported")
+	}
+	if !committed {
+		t.Errorf("expected the commit of %s to be reported", e.Tag)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := `FROM mirror.gcr.io/busybox AS base
+RUN touch /base
+FROM base
+COPY Dockerfile /
+`
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	e := NewClientExecutor(c)
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = dir
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+	e.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	result, err := Build(context.Background(), BuildOptions{Executor: e})
+	if err != nil {
+		t.Fatalf("unable to build image: %v\n%s", err, out.String())
+	}
+	defer c.RemoveImage(e.Tag)
+
+	spans := exporter.GetSpans().Snapshots()
+	byID := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byID[span.SpanContext().SpanID().String()] = span
+	}
+	// describe each span by its name and those of its ancestors
+	var paths []string
+	attrs := make(map[string]map[attribute.Key]attribute.Value)
+	for _, span := range spans {
+		path := span.Name()
+		for parent := span.Parent(); parent.IsValid(); {
+			ancestor, ok := byID[parent.SpanID().String()]
+			if !ok {
+				t.Fatalf("span %s has a parent which wasn't exported", span.Name())
+			}
+			path = ancestor.Name() + "/" + path
+			parent = ancestor.Parent()
+		}
+		if span.Status().Code == codes.Error {
+			t.Errorf("unexpected failure of %s: %s", path, span.Status().Description)
+		}
+		paths = append(paths, path)
+		attrs[path+" "+spanAttributes(span)[instructionKey].AsString()] = spanAttributes(span)
+	}
+	sort.Strings(paths)
+	for _, expected := range []string{"build", "build/stage", "build/stage/instruction", "build/stage/commit", "build/stage/instruction/upload", "build/commit"} {
+		if i := sort.SearchStrings(paths, expected); i == len(paths) || paths[i] != expected {
+			t.Errorf("expected a span at %s, got %v", expected, paths)
+		}
+	}
+	if copied := attrs["build/stage/instruction COPY Dockerfile /"]; copied == nil || copied[startLineKey].AsInt64() != 4 || copied[stageKey].AsString() != "1" {
+		t.Errorf("unexpected attributes of the COPY instruction: %v", copied)
+	}
+	if build := attrs["build "]; build == nil || build[imageIDKey].AsString() != result.ImageID {
+		t.Errorf("expected the build to record the ID of its image, got %v", build)
+	}
+}
+
+func TestHostConfig(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := `FROM mirror.gcr.io/busybox
+RUN grep -q "10.0.0.1.*registry.test" /etc/hosts
+RUN test "$(ulimit -n)" = 512
+RUN grep -q 8.8.4.4 /etc/resolv.conf
+FROM mirror.gcr.io/busybox
+RUN grep -q 8.8.4.4 /etc/resolv.conf
+`
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(c)
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = dir
+	e.TransientMounts = []Mount{{SourcePath: dir, DestinationPath: "/transient"}}
+	e.HostConfig = &docker.HostConfig{}
+	options := HostConfigOptions{
+		Memory:   "256m",
+		Ulimits:  []string{"nofile=512"},
+		AddHosts: []string{"registry.test:10.0.0.1"},
+		DNS:      []string{"8.8.4.4"},
+	}
+	if err := options.Apply(e.HostConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Build(context.Background(), BuildOptions{Executor: e}); err != nil {
+		t.Fatalf("unable to build image: %v\n%s", err, out.String())
+	}
+	if len(e.HostConfig.Binds) != 0 {
+		t.Errorf("expected the binds of the stages not to be added to the executor's host config, got %v", e.HostConfig.Binds)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := `FROM mirror.gcr.io/busybox AS base
+LABEL base=1 kept=1
+ENV DEBUG=1 KEEP=1
+FROM base
+LABEL final=1
+`
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		drop     bool
+		unset    []string
+		expected map[string]string
+	}{
+		{name: "unset", unset: []string{"base"}, expected: map[string]string{"kept": "1", "final": "1", "org.opencontainers.image.revision": "abc123"}},
+		{name: "no-inherit", drop: true, expected: map[string]string{"final": "1", "org.opencontainers.image.revision": "abc123"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := NewClientExecutor(c)
+			out := &bytes.Buffer{}
+			e.Out, e.ErrOut = out, out
+			e.AllowPull = true
+			e.Directory = dir
+			e.Labels = map[string]string{"org.opencontainers.image.revision": "abc123"}
+			e.DropInheritedLabels = test.drop
+			e.UnsetLabels = test.unset
+			e.UnsetEnv = []string{"DEBUG"}
+			e.Author, e.Comment = "ci", "built by ci"
+			result, err := Build(context.Background(), BuildOptions{Executor: e})
+			if err != nil {
+				t.Fatalf("unable to build image: %v\n%s", err, out.String())
+			}
+			defer c.RemoveImage(result.ImageID)
+			image, err := c.InspectImage(result.ImageID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(image.Config.Labels, test.expected) {
+				t.Errorf("expected labels %v, got %v", test.expected, image.Config.Labels)
+			}
+			for _, env := range image.Config.Env {
+				if strings.HasPrefix(env, "DEBUG=") {
+					t.Errorf("expected DEBUG to be unset, got %v", image.Config.Env)
+				}
+			}
+			if !hasEnvVar(image.Config.Env, "KEEP") {
+				t.Errorf("expected KEEP to be inherited, got %v", image.Config.Env)
+			}
+			if image.Author != "ci" || image.Comment != "built by ci" {
+				t.Errorf("expected the author and comment to be recorded, got %q and %q", image.Author, image.Comment)
+			}
+		})
+	}
+
+	e := NewClientExecutor(c)
+	e.Directory = dir
+	e.Annotations = map[string]string{"org.opencontainers.image.revision": "abc123"}
+	if _, err := Build(context.Background(), BuildOptions{Executor: e}); err == nil || !strings.Contains(err.Error(), "OCI layout") {
+		t.Errorf("expected annotations without an OCI layout to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package dockerclient
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+	"github.com/openshift/imagebuilder/imageprogress"
+)
+
+// EventType names a kind of Event.
+type EventType string
+
+const (
+	EventStepStarted  EventType = "step-started"
+	EventStepFinished EventType = "step-finished"
+	EventPull         EventType = "pull"
+	EventCopy         EventType = "copy"
+	EventOutput       EventType = "output"
+	EventWarning      EventType = "warning"
+	EventCommit       EventType = "commit"
+)
+
+// OutputStdout and OutputStderr are the streams of an OutputEvent.
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+// copyProgressInterval is how often CopyEvents are sent while an archive is
+// being uploaded.
+const copyProgressInterval = time.Second
+
+// Event is something that happened during a build, which is passed to the
+// EventFn of the executor. Each kind of event is a different type, and each
+// of them has an EventSource which describes where it happened.
+type Event interface {
+	// Source returns the details that every event has.
+	Source() *EventSource
+	eventType() EventType
+}
+
+// EventSource describes when and where an event happened.
+type EventSource struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Platform is the platform being built, if one was specified.
+	Platform string `json:"platform,omitempty"`
+	// Stage and Position are the name and position of the stage.
+	Stage    string `json:"stage,omitempty"`
+	Position int    `json:"position"`
+	// Step is the index of the instruction in the stage, where its FROM
+	// instruction is 0, or -1 if the event didn't happen during one.
+	Step int `json:"step"`
+}
+
+// Source returns s.
+func (s *EventSource) Source() *EventSource {
+	return s
+}
+
+// StepStartedEvent is sent when an instruction is started.
+type StepStartedEvent struct {
+	EventSource
+	Command   string `json:"command"`
+	Original  string `json:"original"`
+	StartLine int    `json:"startLine,omitempty"`
+}
+
+// StepFinishedEvent is sent when an instruction has finished, whether or not
+// it succeeded.
+type StepFinishedEvent struct {
+	EventSource
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// PullEvent is sent when a base image is about to be pulled, with a Message
+// saying why, and as the pull progresses, with its Progress.
+type PullEvent struct {
+	EventSource
+	Image    string                  `json:"image"`
+	Message  string                  `json:"message,omitempty"`
+	Progress *imageprogress.Progress `json:"progress,omitempty"`
+}
+
+// CopyEvent is sent periodically while an archive is being uploaded to the
+// build container, and when the upload is done.
+type CopyEvent struct {
+	EventSource
+	// Bytes is the number of bytes of the archive which have been
+	// uploaded so far.
+	Bytes int64 `json:"bytes"`
+	Done  bool  `json:"done,omitempty"`
+}
+
+// OutputEvent is sent for each line that a RUN instruction writes.
+type OutputEvent struct {
+	EventSource
+	// Stream is OutputStdout or OutputStderr.
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// WarningEvent is sent for problems which don't stop the build.
+type WarningEvent struct {
+	EventSource
+	Message string `json:"message"`
+}
+
+// CommitEvent is sent when the container of a stage has been committed as
+// an image, with the names it was tagged with, if any.
+type CommitEvent struct {
+	EventSource
+	ImageID string   `json:"imageID"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+func (*StepStartedEvent) eventType() EventType  { return EventStepStarted }
+func (*StepFinishedEvent) eventType() EventType { return EventStepFinished }
+func (*PullEvent) eventType() EventType         { return EventPull }
+func (*CopyEvent) eventType() EventType         { return EventCopy }
+func (*OutputEvent) eventType() EventType       { return EventOutput }
+func (*WarningEvent) eventType() EventType      { return EventWarning }
+func (*CommitEvent) eventType() EventType       { return EventCommit }
+
+// emit fills in the source of event and passes it to the executor's EventFn,
+// if it has one.
+func (e *ClientExecutor) emit(event Event) {
+	if e.EventFn == nil {
+		return
+	}
+	*event.Source() = EventSource{
+		Type:     event.eventType(),
+		Time:     time.Now(),
+		Platform: e.Platform,
+		Stage:    e.Name,
+		Position: e.position,
+		Step:     e.step - 1,
+	}
+	e.EventFn(event)
+}
+
+// warning sends a WarningEvent with message.
+func (e *ClientExecutor) warning(message string) {
+	e.emit(&WarningEvent{Message: message})
+}
+
+// fromInstruction returns the FROM instruction of the stage whose
+// instructions are the children of node, if it still has one.
+func fromInstruction(node *parser.Node) *parser.Node {
+	for _, child := range node.Children {
+		if strings.EqualFold(child.Value, command.From) {
+			return child
+		}
+	}
+	return nil
+}
+
+// startStep records that the instruction node, which is the index'th of the
+// stage, has started, and traces it until the returned function records its
+// outcome.
+func (e *ClientExecutor) startStep(index int, node *parser.Node) func(error) {
+	finishReport := e.beginStep(e.stageReport.stepFor(node))
+	ctx, span := e.startSpan(e.operationContext(), "instruction", instructionAttributes(node)...)
+	restore := e.withContext(ctx)
+	e.step = index + 1
+	e.emit(&StepStartedEvent{Command: node.Value, Original: node.Original, StartLine: node.StartLine})
+	started := time.Now()
+	return func(err error) {
+		finishReport(err)
+		finished := &StepFinishedEvent{Duration: time.Since(started)}
+		if err != nil {
+			finished.Error = err.Error()
+		}
+		e.emit(finished)
+		e.step = 0
+		restore()
+		endSpan(span, err)
+	}
+}
+
+// uploadReader returns a reader which records the number of bytes that are
+// read from r, which is being uploaded to the build container, for the step
+// in progress, and sends CopyEvents for them.
+func (e *ClientExecutor) uploadReader(r io.Reader) io.Reader {
+	r = e.countUploads(r)
+	if e.EventFn == nil {
+		return r
+	}
+	return &copyProgressReader{Reader: r, e: e}
+}
+
+// copyProgressReader sends a CopyEvent when copyProgressInterval has passed
+// since it sent the last one, and when it reaches the end of its Reader.
+type copyProgressReader struct {
+	io.Reader
+	e     *ClientExecutor
+	bytes int64
+	sent  time.Time
+	done  bool
+}
+
+func (r *copyProgressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.bytes += int64(n)
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.e.emit(&CopyEvent{Bytes: r.bytes, Done: true})
+	} else if n > 0 && time.Since(r.sent) >= copyProgressInterval {
+		r.sent = time.Now()
+		r.e.emit(&CopyEvent{Bytes: r.bytes})
+	}
+	return n, err
+}
+
+// outputWriter returns a writer which sends an OutputEvent for each line
+// that is written to it, for stream. Flush it to send the last line, if it
+// didn't end with a newline.
+func (e *ClientExecutor) outputWriter(stream string) *lineWriter {
+	return &lineWriter{fn: func(line string) {
+		e.emit(&OutputEvent{Stream: stream, Line: line})
+	}}
+}
+
+// lineWriter passes each line that is written to it to fn, without its line
+// ending.
+type lineWriter struct {
+	lock sync.Mutex
+	buf  []byte
+	fn   func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush passes anything that was written after the last line ending to fn.
+func (w *lineWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.buf) > 0 {
+		w.fn(string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,103 @@
+package dockerclient
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{fn: func(line string) { lines = append(lines, line) }}
+	for _, s := range []string{"first", " line\r\nsecond line\n", "\nlast"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	w.Flush()
+	expected := []string{"first line", "second line", "", "last"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected lines %q, got %q", expected, lines)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	var events []Event
+	e := &ClientExecutor{
+		Name:     "build",
+		position: 1,
+		Platform: "linux/arm64",
+		EventFn:  func(event Event) { events = append(events, event) },
+	}
+	e.warning("outside of a step")
+	finish := e.startStep(2, &parser.Node{Value: "run", Original: "RUN make", StartLine: 4})
+	out := e.outputWriter(OutputStderr)
+	io.WriteString(out, "make: *** No targets.  Stop.\n")
+	finish(errors.New("running 'make' failed with exit code 2"))
+
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d: %#v", len(events), events)
+	}
+	types := []EventType{EventWarning, EventStepStarted, EventOutput, EventStepFinished}
+	steps := []int{-1, 2, 2, 2}
+	for i, event := range events {
+		source := event.Source()
+		if source.Type != types[i] || source.Step != steps[i] {
+			t.Errorf("expected event %d to be %s during step %d, got %s during %d", i, types[i], steps[i], source.Type, source.Step)
+		}
+		if source.Stage != "build" || source.Position != 1 || source.Platform != "linux/arm64" || source.Time.IsZero() {
+			t.Errorf("expected event %d to be from stage build at 1 for linux/arm64, got %#v", i, source)
+		}
+	}
+	if started := events[1].(*StepStartedEvent); started.Original != "RUN make" || started.StartLine != 4 {
+		t.Errorf("unexpected step: %#v", started)
+	}
+	if output := events[2].(*OutputEvent); output.Stream != OutputStderr || output.Line != "make: *** No targets.  Stop." {
+		t.Errorf("unexpected output: %#v", output)
+	}
+	if finished := events[3].(*StepFinishedEvent); !strings.Contains(finished.Error, "exit code 2") {
+		t.Errorf("expected the step to fail, got %#v", finished)
+	}
+	if e.step != 0 {
+		t.Errorf("expected no step to be in progress")
+	}
+
+	// without an EventFn, nothing is sent or wrapped
+	e = &ClientExecutor{}
+	e.warning("ignored")
+	r := strings.NewReader("context")
+	if e.uploadReader(r) != io.Reader(r) {
+		t.Errorf("expected uploads not to be tracked without an EventFn or a report")
+	}
+}
+
+func TestCopyProgressReader(t *testing.T) {
+	var events []*CopyEvent
+	e := &ClientExecutor{EventFn: func(event Event) { events = append(events, event.(*CopyEvent)) }}
+	r := e.uploadReader(strings.NewReader(strings.Repeat("x", 100)))
+	buf := make([]byte, 10)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Read(buf)
+	// the first read sends an event, and the others are within the
+	// interval, until the end is reached
+	if len(events) != 2 {
+		t.Fatalf("expected two events, got %d", len(events))
+	}
+	if events[0].Bytes != 10 || events[0].Done {
+		t.Errorf("unexpected progress: %#v", events[0])
+	}
+	if events[1].Bytes != 100 || !events[1].Done {
+		t.Errorf("unexpected completion: %#v", events[1])
+	}
+}
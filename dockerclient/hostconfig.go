@@ -0,0 +1,333 @@
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// HostConfigOptions are the resource limits and security options of the
+// containers of a build, in the forms that the flags of "docker build" with
+// the same names accept.
+type HostConfigOptions struct {
+	// Memory is the memory limit, in bytes with an optional unit, such as
+	// 512m.
+	Memory string
+	// MemorySwap is the limit of memory and swap together, in the same
+	// form as Memory, or -1 to allow unlimited swap. It requires Memory.
+	MemorySwap string
+	// CPUShares is the relative weight of the CPU time of the containers.
+	CPUShares int64
+	// CPUSetCPUs is the list of CPUs that the containers can use, such as
+	// 0-3,5.
+	CPUSetCPUs string
+	// PidsLimit is the number of processes that the containers can run,
+	// or -1 for no limit. Zero leaves the daemon's default in place.
+	PidsLimit int64
+	// ShmSize is the size of /dev/shm, in the same form as Memory.
+	ShmSize string
+	// Ulimits are limits in the form NAME=SOFT[:HARD].
+	Ulimits []string
+	// CapAdd and CapDrop are capabilities to add to and remove from the
+	// default set, with or without the CAP_ prefix, or ALL.
+	CapAdd  []string
+	CapDrop []string
+	// SecurityOpt are security options in the form KEY=VALUE, or
+	// no-new-privileges. The value of seccomp is the path of a profile,
+	// which is read, or unconfined.
+	SecurityOpt []string
+	// Devices are host devices to add to the build container, in the form
+	// HOST[:CONTAINER][:PERMISSIONS].
+	Devices []string
+	// AddHosts are entries to add to /etc/hosts of the build container,
+	// in the form HOST:IP.
+	AddHosts []string
+	// DNS are the addresses of the DNS servers of the build container.
+	DNS []string
+	// Isolation is the isolation technology of the containers: default,
+	// process or hyperv.
+	Isolation string
+}
+
+// Apply validates the options and sets them in hostConfig.
+func (o HostConfigOptions) Apply(hostConfig *docker.HostConfig) error {
+	if len(o.Memory) > 0 {
+		memory, err := units.RAMInBytes(o.Memory)
+		if err != nil {
+			return fmt.Errorf("invalid memory limit %q: %v", o.Memory, err)
+		}
+		hostConfig.Memory = memory
+	}
+	if len(o.MemorySwap) > 0 {
+		if hostConfig.Memory == 0 {
+			return fmt.Errorf("a memory limit must be set to limit memory and swap")
+		}
+		swap := int64(-1)
+		if o.MemorySwap != "-1" {
+			var err error
+			if swap, err = units.RAMInBytes(o.MemorySwap); err != nil {
+				return fmt.Errorf("invalid memory and swap limit %q: %v", o.MemorySwap, err)
+			}
+			if swap < hostConfig.Memory {
+				return fmt.Errorf("the memory and swap limit %q must be at least the memory limit %q", o.MemorySwap, o.Memory)
+			}
+		}
+		hostConfig.MemorySwap = swap
+	}
+	if o.CPUShares < 0 {
+		return fmt.Errorf("invalid CPU shares %d", o.CPUShares)
+	}
+	if o.CPUShares > 0 {
+		hostConfig.CPUShares = o.CPUShares
+	}
+	if len(o.CPUSetCPUs) > 0 {
+		if err := validateCPUSet(o.CPUSetCPUs); err != nil {
+			return err
+		}
+		hostConfig.CPUSetCPUs = o.CPUSetCPUs
+	}
+	if o.PidsLimit < -1 {
+		return fmt.Errorf("invalid process limit %d", o.PidsLimit)
+	}
+	if o.PidsLimit != 0 {
+		limit := o.PidsLimit
+		hostConfig.PidsLimit = &limit
+	}
+	if len(o.ShmSize) > 0 {
+		size, err := units.RAMInBytes(o.ShmSize)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid size of /dev/shm %q", o.ShmSize)
+		}
+		hostConfig.ShmSize = size
+	}
+	for _, value := range o.Ulimits {
+		ulimit, err := units.ParseUlimit(value)
+		if err != nil {
+			return err
+		}
+		// a later limit replaces an earlier one with the same name
+		replaced := false
+		for i := range hostConfig.Ulimits {
+			if hostConfig.Ulimits[i].Name == ulimit.Name {
+				hostConfig.Ulimits[i] = docker.ULimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard}
+				replaced = true
+			}
+		}
+		if !replaced {
+			hostConfig.Ulimits = append(hostConfig.Ulimits, docker.ULimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+		}
+	}
+	capAdd, err := normalizeCapabilities(o.CapAdd)
+	if err != nil {
+		return err
+	}
+	hostConfig.CapAdd = append(hostConfig.CapAdd, capAdd...)
+	capDrop, err := normalizeCapabilities(o.CapDrop)
+	if err != nil {
+		return err
+	}
+	hostConfig.CapDrop = append(hostConfig.CapDrop, capDrop...)
+	for _, value := range o.SecurityOpt {
+		opt, err := parseSecurityOpt(value)
+		if err != nil {
+			return err
+		}
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, opt)
+	}
+	for _, value := range o.Devices {
+		device, err := parseDevice(value)
+		if err != nil {
+			return err
+		}
+		hostConfig.Devices = append(hostConfig.Devices, device)
+	}
+	for _, value := range o.AddHosts {
+		host, err := parseExtraHost(value)
+		if err != nil {
+			return err
+		}
+		hostConfig.ExtraHosts = append(hostConfig.ExtraHosts, host)
+	}
+	for _, value := range o.DNS {
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil {
+			return fmt.Errorf("invalid DNS server address %q", value)
+		}
+		hostConfig.DNS = append(hostConfig.DNS, ip.String())
+	}
+	if len(o.Isolation) > 0 {
+		switch isolation := strings.ToLower(o.Isolation); isolation {
+		case "default", "process", "hyperv":
+			hostConfig.Isolation = isolation
+		default:
+			return fmt.Errorf("invalid isolation %q, expected default, process or hyperv", o.Isolation)
+		}
+	}
+	return nil
+}
+
+// validateCPUSet checks that cpus is a comma-separated list of CPU numbers
+// and ranges of them.
+func validateCPUSet(cpus string) error {
+	for _, item := range strings.Split(cpus, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid CPU set %q, expected a list of CPUs such as 0-3,5", cpus)
+		}
+		if isRange {
+			end, err := strconv.ParseUint(last, 10, 16)
+			if err != nil || end < start {
+				return fmt.Errorf("invalid CPU set %q, expected a list of CPUs such as 0-3,5", cpus)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeCapabilities converts capabilities to the upper case names, with
+// the CAP_ prefix, that the daemon uses, leaving ALL as it is.
+func normalizeCapabilities(capabilities []string) ([]string, error) {
+	var normalized []string
+	for _, capability := range capabilities {
+		capability = strings.ToUpper(strings.TrimSpace(capability))
+		if len(capability) == 0 || capability == "CAP_" {
+			return nil, fmt.Errorf("invalid capability %q", capability)
+		}
+		if capability != "ALL" && !strings.HasPrefix(capability, "CAP_") {
+			capability = "CAP_" + capability
+		}
+		normalized = append(normalized, capability)
+	}
+	return normalized, nil
+}
+
+// parseSecurityOpt parses a security option in the form KEY=VALUE, or the
+// older KEY:VALUE, replacing the path of a seccomp profile with its contents.
+func parseSecurityOpt(value string) (string, error) {
+	if value == "no-new-privileges" {
+		return value, nil
+	}
+	key, opt, ok := strings.Cut(value, "=")
+	if !ok {
+		key, opt, ok = strings.Cut(value, ":")
+	}
+	if !ok || len(key) == 0 || len(opt) == 0 {
+		return "", fmt.Errorf("invalid security option %q, expected KEY=VALUE", value)
+	}
+	if key != "seccomp" || opt == "unconfined" {
+		return key + "=" + opt, nil
+	}
+	profile, err := os.ReadFile(opt)
+	if err != nil {
+		return "", fmt.Errorf("unable to read seccomp profile: %v", err)
+	}
+	compacted := &bytes.Buffer{}
+	if err := json.Compact(compacted, profile); err != nil {
+		return "", fmt.Errorf("invalid seccomp profile %s: %v", opt, err)
+	}
+	return "seccomp=" + compacted.String(), nil
+}
+
+// parseDevice parses a device in the form HOST[:CONTAINER][:PERMISSIONS],
+// where the device is at the same path in the container as on the host if
+// CONTAINER is omitted, and PERMISSIONS are some of r, w and m, all of which
+// are the default.
+func parseDevice(value string) (docker.Device, error) {
+	device := docker.Device{CgroupPermissions: "rwm"}
+	parts := strings.Split(value, ":")
+	switch len(parts) {
+	case 3:
+		device.CgroupPermissions = parts[2]
+		device.PathInContainer = parts[1]
+	case 2:
+		if validDevicePermissions(parts[1]) {
+			device.CgroupPermissions = parts[1]
+		} else {
+			device.PathInContainer = parts[1]
+		}
+	case 1:
+	default:
+		return docker.Device{}, fmt.Errorf("invalid device %q, expected HOST[:CONTAINER][:PERMISSIONS]", value)
+	}
+	device.PathOnHost = parts[0]
+	if len(device.PathInContainer) == 0 {
+		device.PathInContainer = device.PathOnHost
+	}
+	if !path.IsAbs(device.PathOnHost) || !path.IsAbs(device.PathInContainer) {
+		return docker.Device{}, fmt.Errorf("invalid device %q, paths must be absolute", value)
+	}
+	if !validDevicePermissions(device.CgroupPermissions) {
+		return docker.Device{}, fmt.Errorf("invalid device %q, permissions must be some of r, w and m", value)
+	}
+	return device, nil
+}
+
+// validDevicePermissions returns true if permissions are some of r, w and m.
+func validDevicePermissions(permissions string) bool {
+	if len(permissions) == 0 || len(permissions) > 3 {
+		return false
+	}
+	for _, c := range permissions {
+		if !strings.ContainsRune("rwm", c) || strings.Count(permissions, string(c)) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseExtraHost parses an entry for /etc/hosts in the form HOST:IP, or
+// HOST=IP, where IP may be host-gateway to have the daemon fill in the
+// address of the host.
+func parseExtraHost(value string) (string, error) {
+	host, ip, ok := strings.Cut(value, "=")
+	if !ok {
+		host, ip, ok = strings.Cut(value, ":")
+	}
+	if !ok || len(host) == 0 {
+		return "", fmt.Errorf("invalid host %q, expected HOST:IP", value)
+	}
+	if ip != "host-gateway" {
+		parsed := net.ParseIP(strings.Trim(ip, "[]"))
+		if parsed == nil {
+			return "", fmt.Errorf("invalid host %q, %q is not an IP address", value, ip)
+		}
+		ip = parsed.String()
+	}
+	return host + ":" + ip, nil
+}
+
+// siblingHostConfig returns hostConfig, or a new one if it is nil, with the
+// resource limits and security options of the build container, so that the
+// containers which the executor creates alongside it are confined in the
+// same way. Devices, hosts and DNS servers are only given to the build
+// container, since only RUN instructions use them.
+func (e *ClientExecutor) siblingHostConfig(hostConfig *docker.HostConfig) *docker.HostConfig {
+	if hostConfig == nil {
+		hostConfig = &docker.HostConfig{}
+	}
+	build := e.HostConfig
+	if build == nil {
+		return hostConfig
+	}
+	hostConfig.Memory = build.Memory
+	hostConfig.MemorySwap = build.MemorySwap
+	hostConfig.CPUShares = build.CPUShares
+	hostConfig.CPUSetCPUs = build.CPUSetCPUs
+	hostConfig.PidsLimit = build.PidsLimit
+	hostConfig.ShmSize = build.ShmSize
+	hostConfig.Ulimits = build.Ulimits
+	hostConfig.CapAdd = build.CapAdd
+	hostConfig.CapDrop = build.CapDrop
+	hostConfig.SecurityOpt = build.SecurityOpt
+	hostConfig.Isolation = build.Isolation
+	return hostConfig
+}
@@ -0,0 +1,152 @@
+package dockerclient
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestHostConfigOptions(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "seccomp.json")
+	if err := os.WriteFile(profile, []byte("{\n  \"defaultAction\": \"SCMP_ACT_ALLOW\"\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := HostConfigOptions{
+		Memory:      "512m",
+		MemorySwap:  "1g",
+		CPUShares:   512,
+		CPUSetCPUs:  "0-3,5",
+		PidsLimit:   100,
+		ShmSize:     "64m",
+		Ulimits:     []string{"nofile=1024:2048", "nproc=10", "nofile=512"},
+		CapAdd:      []string{"net_admin", "CAP_SYS_PTRACE"},
+		CapDrop:     []string{"all"},
+		SecurityOpt: []string{"no-new-privileges", "apparmor:unconfined", "seccomp=" + profile},
+		Devices:     []string{"/dev/fuse", "/dev/sda:/dev/xvda:r", "/dev/kvm:rw"},
+		AddHosts:    []string{"registry.test:10.0.0.1", "gateway=host-gateway", "ipv6.test:::1"},
+		DNS:         []string{"8.8.8.8", "2001:4860:4860::8888"},
+		Isolation:   "HyperV",
+	}
+	hostConfig := &docker.HostConfig{Privileged: true}
+	if err := options.Apply(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	pids := int64(100)
+	expected := &docker.HostConfig{
+		Privileged: true,
+		Memory:     512 * 1024 * 1024,
+		MemorySwap: 1024 * 1024 * 1024,
+		CPUShares:  512,
+		CPUSetCPUs: "0-3,5",
+		PidsLimit:  &pids,
+		ShmSize:    64 * 1024 * 1024,
+		Ulimits: []docker.ULimit{
+			{Name: "nofile", Soft: 512, Hard: 512},
+			{Name: "nproc", Soft: 10, Hard: 10},
+		},
+		CapAdd:      []string{"CAP_NET_ADMIN", "CAP_SYS_PTRACE"},
+		CapDrop:     []string{"ALL"},
+		SecurityOpt: []string{"no-new-privileges", "apparmor=unconfined", `seccomp={"defaultAction":"SCMP_ACT_ALLOW"}`},
+		Devices: []docker.Device{
+			{PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", CgroupPermissions: "rwm"},
+			{PathOnHost: "/dev/sda", PathInContainer: "/dev/xvda", CgroupPermissions: "r"},
+			{PathOnHost: "/dev/kvm", PathInContainer: "/dev/kvm", CgroupPermissions: "rw"},
+		},
+		ExtraHosts: []string{"registry.test:10.0.0.1", "gateway:host-gateway", "ipv6.test:::1"},
+		DNS:        []string{"8.8.8.8", "2001:4860:4860::8888"},
+		Isolation:  "hyperv",
+	}
+	if !reflect.DeepEqual(hostConfig, expected) {
+		t.Errorf("expected:\n%#v\ngot:\n%#v", expected, hostConfig)
+	}
+
+	hostConfig = &docker.HostConfig{}
+	if err := (HostConfigOptions{Memory: "1g", MemorySwap: "-1", PidsLimit: -1}).Apply(hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	if hostConfig.MemorySwap != -1 || hostConfig.PidsLimit == nil || *hostConfig.PidsLimit != -1 {
+		t.Errorf("expected unlimited swap and processes, got %d and %v", hostConfig.MemorySwap, hostConfig.PidsLimit)
+	}
+	hostConfig = &docker.HostConfig{}
+	if err := (HostConfigOptions{}).Apply(hostConfig); err != nil || !reflect.DeepEqual(hostConfig, &docker.HostConfig{}) {
+		t.Errorf("expected no options to leave the host config alone, got %#v: %v", hostConfig, err)
+	}
+}
+
+func TestHostConfigOptionsInvalid(t *testing.T) {
+	for _, options := range []HostConfigOptions{
+		{Memory: "lots"},
+		{MemorySwap: "1g"},
+		{Memory: "1g", MemorySwap: "512m"},
+		{CPUShares: -1},
+		{CPUSetCPUs: "0-"},
+		{CPUSetCPUs: "3-1"},
+		{CPUSetCPUs: "a,b"},
+		{PidsLimit: -2},
+		{ShmSize: "0"},
+		{Ulimits: []string{"nofile"}},
+		{Ulimits: []string{"nofile=2048:1024"}},
+		{CapAdd: []string{""}},
+		{SecurityOpt: []string{"apparmor"}},
+		{SecurityOpt: []string{"seccomp=/nonexistent/profile.json"}},
+		{Devices: []string{"dev/fuse"}},
+		{Devices: []string{"/dev/sda:/dev/xvda:rx"}},
+		{Devices: []string{"/dev/a:/dev/b:r:w"}},
+		{AddHosts: []string{"registry.test"}},
+		{AddHosts: []string{"registry.test:example.com"}},
+		{DNS: []string{"dns.example.com"}},
+		{Isolation: "vm"},
+	} {
+		if err := options.Apply(&docker.HostConfig{}); err == nil {
+			t.Errorf("expected an error for %#v", options)
+		}
+	}
+}
+
+func TestSiblingHostConfig(t *testing.T) {
+	pids := int64(10)
+	e := &ClientExecutor{HostConfig: &docker.HostConfig{
+		Privileged:  true,
+		Binds:       []string{"/src:/src"},
+		Memory:      1024,
+		PidsLimit:   &pids,
+		SecurityOpt: []string{"no-new-privileges"},
+		CapDrop:     []string{"ALL"},
+		ExtraHosts:  []string{"registry.test:10.0.0.1"},
+		DNS:         []string{"8.8.8.8"},
+		Isolation:   "process",
+	}}
+	hostConfig := e.siblingHostConfig(&docker.HostConfig{NetworkMode: "none", Binds: []string{"context:/context"}})
+	expected := &docker.HostConfig{
+		NetworkMode: "none",
+		Binds:       []string{"context:/context"},
+		Memory:      1024,
+		PidsLimit:   &pids,
+		SecurityOpt: []string{"no-new-privileges"},
+		CapDrop:     []string{"ALL"},
+		Isolation:   "process",
+	}
+	if !reflect.DeepEqual(hostConfig, expected) {
+		t.Errorf("expected:\n%#v\ngot:\n%#v", expected, hostConfig)
+	}
+	if hostConfig := (&ClientExecutor{}).siblingHostConfig(nil); hostConfig == nil || !reflect.DeepEqual(hostConfig, &docker.HostConfig{}) {
+		t.Errorf("expected an empty host config without one for the build container, got %#v", hostConfig)
+	}
+}
+
+func TestParseSecurityOptProfile(t *testing.T) {
+	if opt, err := parseSecurityOpt("seccomp=unconfined"); err != nil || opt != "seccomp=unconfined" {
+		t.Errorf("expected an unconfined profile not to be read, got %q: %v", opt, err)
+	}
+	profile := filepath.Join(t.TempDir(), "seccomp.json")
+	if err := os.WriteFile(profile, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSecurityOpt("seccomp=" + profile); err == nil || !strings.Contains(err.Error(), "invalid seccomp profile") {
+		t.Errorf("expected an invalid profile to be rejected, got %v", err)
+	}
+}
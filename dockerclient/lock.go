@@ -0,0 +1,219 @@
+package dockerclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	"k8s.io/klog"
+)
+
+// lockFileVersion is the version of the lock file format which is written.
+const lockFileVersion = 1
+
+// LockFile records the digests that the names of base images resolved to, so
+// that later builds use the same images even if the names have since been
+// pointed at different ones.
+type LockFile struct {
+	Version int `json:"version"`
+	// Images maps fully-qualified image names, including a tag, to the
+	// digest of the manifest or image index that they referred to.
+	Images map[string]digest.Digest `json:"images"`
+}
+
+// ReadLockFile reads a lock file which was written by LockFile.Write().
+func ReadLockFile(path string) (*LockFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock LockFile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("unable to parse lock file %s: %v", path, err)
+	}
+	if lock.Version != lockFileVersion {
+		return nil, fmt.Errorf("lock file %s has unsupported version %d", path, lock.Version)
+	}
+	for name, d := range lock.Images {
+		if err := d.Validate(); err != nil {
+			return nil, fmt.Errorf("lock file %s has an invalid digest for %s: %v", path, name, err)
+		}
+	}
+	return &lock, nil
+}
+
+// Write writes the lock file to path.
+func (l *LockFile) Write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Resolve returns a reference to the digest that name is locked to. Names
+// which refer to a digest or to an image ID are returned unchanged, and
+// ok is false if name is not in the lock file.
+func (l *LockFile) Resolve(name string) (resolved string, ok bool) {
+	if isImageID(name) {
+		return name, true
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return name, false
+	}
+	if _, isDigested := named.(reference.Digested); isDigested {
+		return name, true
+	}
+	d, ok := l.Images[lockKey(named)]
+	if !ok {
+		return name, false
+	}
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), d)
+	if err != nil {
+		return name, false
+	}
+	return reference.FamiliarString(canonical), true
+}
+
+// Missing returns those of names which Resolve() can't resolve.
+func (l *LockFile) Missing(names []string) []string {
+	var missing []string
+	for _, name := range names {
+		if _, ok := l.Resolve(name); !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// lockKey returns the name under which a reference is recorded.
+func lockKey(named reference.Named) string {
+	return reference.TagNameOnly(named).String()
+}
+
+// lockedReference returns the name that should be used to load the image
+// called name, taking the executor's lock file into account.
+func (e *ClientExecutor) lockedReference(name string) string {
+	if e.LockFile == nil {
+		return name
+	}
+	resolved, ok := e.LockFile.Resolve(name)
+	if ok && resolved != name {
+		klog.V(4).Infof("Using %s for %s from the lock file", resolved, name)
+	}
+	return resolved
+}
+
+// Lock resolves the base images of every stage in the Dockerfiles described by
+// opts, and the images that they COPY --from, for each of opts.Platforms, to
+// the digests that their registries currently hold for them, and returns a
+// lock file which records them. Names are looked up in the same places that a
+// build loads them from, so the executor's registries configuration applies,
+// but its lock file, if it has one, is ignored. Build contexts which are
+// images are locked in place of the names that refer to them.
+func Lock(ctx context.Context, opts BuildOptions) (*LockFile, error) {
+	e, err := buildExecutor(opts)
+	if err != nil {
+		return nil, err
+	}
+	daemonPlatform, err := e.daemonPlatform()
+	if err != nil {
+		klog.V(4).Infof("Unable to determine the daemon's platform, assuming it is the same as ours: %v", err)
+	}
+
+	platformList := opts.Platforms
+	if len(platformList) == 0 {
+		platformList = []string{e.Platform}
+	}
+	seen := make(map[string]struct{})
+	var images []string
+	for _, platform := range platformList {
+		platformExecutor := *e
+		platformExecutor.Platform = platform
+		_, stages, _, err := parseStages(&platformExecutor, opts, daemonPlatform)
+		if err != nil {
+			return nil, err
+		}
+		names, err := stages.ExternalImages(opts.From)
+		if err != nil {
+			return nil, fmt.Errorf("error: Determining base images: %v", err)
+		}
+		copied, err := stages.CopyFromImages()
+		if err != nil {
+			return nil, fmt.Errorf("error: Determining the images to copy from: %v", err)
+		}
+		names = e.buildContextImages(append(names, copied...))
+		for _, name := range names {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				images = append(images, name)
+			}
+		}
+	}
+	sort.Strings(images)
+
+	lock := &LockFile{Version: lockFileVersion, Images: make(map[string]digest.Digest)}
+	for _, name := range images {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if isImageID(name) {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image name %q: %v", name, err)
+		}
+		if _, ok := named.(reference.Digested); ok {
+			continue
+		}
+		d, err := e.resolveDigest(name)
+		if err != nil {
+			return nil, err
+		}
+		lock.Images[lockKey(named)] = d
+		e.LogFn("Locked %s to %s", name, d)
+	}
+	return lock, nil
+}
+
+// resolveDigest returns the digest that the registry currently holds for the
+// image called name, looking it up under each of the names that the
+// executor's registries configuration rewrites it to, as loadImageCandidates
+// does, until one is found. The lock file records it under name, which a
+// build rewrites in the same way after replacing its tag with the digest.
+func (e *ClientExecutor) resolveDigest(name string) (digest.Digest, error) {
+	candidates := []string{name}
+	if e.Registries != nil {
+		var err error
+		if candidates, err = e.Registries.Candidates(name); err != nil {
+			return "", err
+		}
+	}
+	var errs []error
+	for _, candidate := range candidates {
+		named, err := reference.ParseNormalizedNamed(candidate)
+		if err != nil {
+			return "", fmt.Errorf("invalid image name %q: %v", candidate, err)
+		}
+		distribution, err := e.inspectDistribution(lockKey(named))
+		if err == nil {
+			if candidate != name {
+				klog.V(4).Infof("Resolved %s as %s", name, candidate)
+			}
+			return distribution.Descriptor.Digest, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return "", fmt.Errorf("unable to resolve %s: %v", name, errs[0])
+	}
+	return "", fmt.Errorf("unable to resolve %s as any of %s: %w", name, strings.Join(candidates, ", "), errors.Join(errs...))
+}
@@ -0,0 +1,157 @@
+package dockerclient
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	dockerregistrytypes "github.com/moby/moby/api/types/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestLockFileResolve(t *testing.T) {
+	locked := digest.Digest("sha256:" + strings.Repeat("a", 64))
+	id := strings.Repeat("0123456789abcdef", 4)
+	lock := &LockFile{Version: lockFileVersion, Images: map[string]digest.Digest{
+		"docker.io/library/golang:1.22":    locked,
+		"docker.io/library/busybox:latest": locked,
+		"example.com/base:v1":              locked,
+	}}
+	for name, expected := range map[string]string{
+		"golang:1.22":                   "golang@" + locked.String(),
+		"docker.io/library/golang:1.22": "golang@" + locked.String(),
+		"busybox":                       "busybox@" + locked.String(),
+		"example.com/base:v1":           "example.com/base@" + locked.String(),
+		"busybox@sha256:" + id:          "busybox@sha256:" + id,
+		id:                              id,
+	} {
+		resolved, ok := lock.Resolve(name)
+		if !ok || resolved != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", name, expected, resolved, ok)
+		}
+	}
+	if resolved, ok := lock.Resolve("golang:1.23"); ok || resolved != "golang:1.23" {
+		t.Errorf("expected golang:1.23 to be missing, got %q", resolved)
+	}
+	if missing := lock.Missing([]string{"golang:1.22", "golang:1.23", "example.com/base"}); !reflect.DeepEqual(missing, []string{"golang:1.23", "example.com/base"}) {
+		t.Errorf("unexpected missing images %v", missing)
+	}
+
+	e := NewClientExecutor(nil)
+	if name := e.lockedReference("golang:1.22"); name != "golang:1.22" {
+		t.Errorf("expected no substitution without a lock file, got %q", name)
+	}
+	e.LockFile = lock
+	if name := e.lockedReference("golang:1.22"); name != "golang@"+locked.String() {
+		t.Errorf("expected substitution with a lock file, got %q", name)
+	}
+
+	path := filepath.Join(t.TempDir(), "imagebuilder.lock")
+	if err := lock.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, lock) {
+		t.Errorf("expected %#v, got %#v", lock, read)
+	}
+	if err := os.WriteFile(path, []byte(`{"version":1,"images":{"busybox":"sha256:1"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLockFile(path); err == nil {
+		t.Errorf("expected an error for an invalid digest")
+	}
+}
+
+func TestLock(t *testing.T) {
+	current := "sha256:" + strings.Repeat("a", 64)
+	server := httptest.NewServer(&fakeImageDaemon{registryDigest: current, username: "locker"})
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dockerfile := `ARG VERSION=1.22
+FROM golang:$VERSION AS builder
+FROM builder
+FROM scratch
+FROM example.com/base@sha256:` + strings.Repeat("b", 64) + `
+FROM busybox
+ARG TOOLS=example.com/tools:1
+COPY --from=builder /go/bin/app /app
+COPY --from=$TOOLS /bin/tool /tool
+`
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	e.Directory = dir
+	e.AuthFn = func(string) ([]dockerregistrytypes.AuthConfig, bool) {
+		return []dockerregistrytypes.AuthConfig{{Username: "locker", Password: "secret"}}, true
+	}
+	lock, err := Lock(context.Background(), BuildOptions{Executor: e, Args: map[string]string{"VERSION": "1.23"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]digest.Digest{
+		"docker.io/library/golang:1.23":    digest.Digest(current),
+		"docker.io/library/busybox:latest": digest.Digest(current),
+		"example.com/tools:1":              digest.Digest(current),
+	}
+	if !reflect.DeepEqual(lock.Images, expected) {
+		t.Errorf("expected %v, got %v", expected, lock.Images)
+	}
+}
+
+func TestLockRegistries(t *testing.T) {
+	mirrored := "sha256:" + strings.Repeat("c", 64)
+	aliased := "sha256:" + strings.Repeat("d", 64)
+	server := httptest.NewServer(&fakeImageDaemon{digests: map[string]string{
+		"mirror.example.com/library/busybox:latest": mirrored,
+		"quay.io/example/tools:1":                   aliased,
+	}})
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM busybox\nCOPY --from=tools:1 /bin/tool /tool\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	e.Directory = dir
+	e.Registries = &RegistriesConfig{Aliases: map[string]string{"tools": "quay.io/example/tools"}}
+	e.Registries.AddMirror("docker.io", "mirror.example.com")
+	lock, err := Lock(context.Background(), BuildOptions{Executor: e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]digest.Digest{
+		"docker.io/library/busybox:latest": digest.Digest(mirrored),
+		"docker.io/library/tools:1":        digest.Digest(aliased),
+	}
+	if !reflect.DeepEqual(lock.Images, expected) {
+		t.Errorf("expected %v, got %v", expected, lock.Images)
+	}
+
+	// a build looks the locked names up in the same places
+	e.LockFile = lock
+	for name, location := range map[string]string{"busybox": "mirror.example.com/library/busybox@" + mirrored, "tools:1": "quay.io/example/tools@" + aliased} {
+		candidates, err := e.Registries.Candidates(e.lockedReference(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(candidates) == 0 || candidates[0] != location {
+			t.Errorf("%s: expected to be loaded as %s, got %v", name, location, candidates)
+		}
+	}
+}
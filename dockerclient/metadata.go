@@ -0,0 +1,123 @@
+package dockerclient
+
+import (
+	"encoding/json"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// applyMetadata changes the config of the image that the executor is about
+// to commit: its UnsetLabels are removed from the labels, its Labels are
+// added, replacing those with the same names, and its UnsetEnv are removed
+// from the environment.
+func (e *ClientExecutor) applyMetadata(config *docker.Config) {
+	if len(e.Labels) > 0 || len(e.UnsetLabels) > 0 {
+		labels := make(map[string]string, len(config.Labels)+len(e.Labels))
+		for k, v := range config.Labels {
+			labels[k] = v
+		}
+		for _, name := range e.UnsetLabels {
+			delete(labels, name)
+		}
+		for k, v := range e.Labels {
+			labels[k] = v
+		}
+		config.Labels = labels
+	}
+	if len(e.UnsetEnv) > 0 {
+		config.Env = unsetEnv(config.Env, e.UnsetEnv)
+	}
+}
+
+// metadataRewrite returns a function which removes, from the run config of
+// the image committed with config, whose own config is committed, the labels
+// and environment variables which the daemon kept from the build container
+// although they were left out of config, or nil if it has none of them. The
+// daemon adds the labels and environment of the container to those of the
+// image that it commits, so those which were inherited from the base image
+// can only be removed by rewriting the image.
+func (e *ClientExecutor) metadataRewrite(config, committed *docker.Config) func(map[string]json.RawMessage) error {
+	if committed == nil {
+		return nil
+	}
+	unsetLabels := make(map[string]struct{}, len(e.UnsetLabels))
+	for _, name := range e.UnsetLabels {
+		unsetLabels[name] = struct{}{}
+	}
+	var labels []string
+	for name := range committed.Labels {
+		if _, ok := config.Labels[name]; ok {
+			continue
+		}
+		if _, ok := unsetLabels[name]; ok || e.DropInheritedLabels {
+			labels = append(labels, name)
+		}
+	}
+	var env []string
+	for _, name := range e.UnsetEnv {
+		if hasEnvVar(committed.Env, name) {
+			env = append(env, name)
+		}
+	}
+	if len(labels) == 0 && len(env) == 0 {
+		return nil
+	}
+	return func(fields map[string]json.RawMessage) error {
+		if len(labels) > 0 {
+			var values map[string]string
+			if err := json.Unmarshal(fields["Labels"], &values); err != nil {
+				return err
+			}
+			for _, name := range labels {
+				delete(values, name)
+			}
+			data, err := json.Marshal(values)
+			if err != nil {
+				return err
+			}
+			fields["Labels"] = data
+		}
+		if len(env) > 0 {
+			var values []string
+			if err := json.Unmarshal(fields["Env"], &values); err != nil {
+				return err
+			}
+			data, err := json.Marshal(unsetEnv(values, env))
+			if err != nil {
+				return err
+			}
+			fields["Env"] = data
+		}
+		return nil
+	}
+}
+
+// unsetEnv returns the variables in env whose names are not in names.
+func unsetEnv(env, names []string) []string {
+	var kept []string
+	for _, v := range env {
+		name, _, _ := strings.Cut(v, "=")
+		unset := false
+		for _, n := range names {
+			if n == name {
+				unset = true
+				break
+			}
+		}
+		if !unset {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// hasEnvVar returns true if env sets the variable name.
+func hasEnvVar(env []string, name string) bool {
+	for _, v := range env {
+		if n, _, _ := strings.Cut(v, "="); n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package dockerclient
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestApplyMetadata(t *testing.T) {
+	labels := map[string]string{"maintainer": "someone", "version": "1", "stage": "build"}
+	config := &docker.Config{
+		Labels: labels,
+		Env:    []string{"PATH=/usr/bin", "DEBUG=1", "HOME=/root"},
+	}
+	e := &ClientExecutor{
+		Labels:      map[string]string{"version": "2", "org.opencontainers.image.revision": "abc123"},
+		UnsetLabels: []string{"maintainer", "version", "missing"},
+		UnsetEnv:    []string{"DEBUG"},
+	}
+	e.applyMetadata(config)
+	expected := map[string]string{"version": "2", "org.opencontainers.image.revision": "abc123", "stage": "build"}
+	if !reflect.DeepEqual(config.Labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, config.Labels)
+	}
+	if len(labels) != 3 {
+		t.Errorf("expected the builder's labels not to be changed, got %v", labels)
+	}
+	if !reflect.DeepEqual(config.Env, []string{"PATH=/usr/bin", "HOME=/root"}) {
+		t.Errorf("unexpected environment %v", config.Env)
+	}
+
+	config = &docker.Config{Env: []string{"PATH=/usr/bin"}}
+	(&ClientExecutor{}).applyMetadata(config)
+	if config.Labels != nil || !reflect.DeepEqual(config.Env, []string{"PATH=/usr/bin"}) {
+		t.Errorf("expected the config to be left alone, got %#v", config)
+	}
+}
+
+func TestMetadataRewrite(t *testing.T) {
+	config := &docker.Config{Labels: map[string]string{"stage": "final"}}
+	committed := &docker.Config{
+		Labels: map[string]string{"stage": "final", "base": "busybox", "vendor": "someone"},
+		Env:    []string{"PATH=/usr/bin", "DEBUG=1"},
+	}
+	fields := func() map[string]json.RawMessage {
+		data, err := json.Marshal(committed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		return fields
+	}
+	rewritten := func(rewrite func(map[string]json.RawMessage) error) *docker.Config {
+		f := fields()
+		if err := rewrite(f); err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config docker.Config
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		return &config
+	}
+
+	e := &ClientExecutor{UnsetLabels: []string{"vendor", "stage"}, UnsetEnv: []string{"DEBUG", "MISSING"}}
+	rewrite := e.metadataRewrite(config, committed)
+	if rewrite == nil {
+		t.Fatalf("expected the image to be rewritten")
+	}
+	result := rewritten(rewrite)
+	// the label which the executor kept out of the config was added back
+	// by the daemon, unlike the ones that config still sets
+	if !reflect.DeepEqual(result.Labels, map[string]string{"stage": "final", "base": "busybox"}) {
+		t.Errorf("unexpected labels %v", result.Labels)
+	}
+	if !reflect.DeepEqual(result.Env, []string{"PATH=/usr/bin"}) {
+		t.Errorf("unexpected environment %v", result.Env)
+	}
+
+	e = &ClientExecutor{DropInheritedLabels: true}
+	result = rewritten(e.metadataRewrite(config, committed))
+	if !reflect.DeepEqual(result.Labels, map[string]string{"stage": "final"}) {
+		t.Errorf("expected only the labels in the config to be kept without inheriting labels, got %v", result.Labels)
+	}
+	if !reflect.DeepEqual(result.Env, committed.Env) {
+		t.Errorf("expected the environment to be kept, got %v", result.Env)
+	}
+
+	e = &ClientExecutor{UnsetLabels: []string{"missing"}, UnsetEnv: []string{"MISSING"}}
+	if e.metadataRewrite(config, committed) != nil {
+		t.Errorf("expected no rewrite when the image has none of the labels and variables")
+	}
+}
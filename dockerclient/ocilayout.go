@@ -0,0 +1,285 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	docker "github.com/fsouza/go-dockerclient"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/klog"
+)
+
+// ExportOCILayout saves images from the daemon and writes them to an OCI image
+// layout in dir, replacing its index. If more than one image is given, they
+// are assumed to be variants of one image for different platforms, and are
+// listed in an image index. The index (or the manifest, for a single image)
+// is added to the layout's index.json, annotated with ref if it is not empty.
+// It returns the descriptor of the index or manifest.
+func ExportOCILayout(ctx context.Context, client *docker.Client, dir, ref string, images []string) (ocispec.Descriptor, error) {
+	return ExportAnnotatedOCILayout(ctx, client, dir, ref, images, nil)
+}
+
+// ExportAnnotatedOCILayout is like ExportOCILayout, but adds annotations to
+// the manifest of each image.
+func ExportAnnotatedOCILayout(ctx context.Context, client *docker.Client, dir, ref string, images []string, annotations map[string]string) (ocispec.Descriptor, error) {
+	if len(images) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("no images to export")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ocispec.ImageBlobsDir, digest.SHA256.String()), 0755); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	var manifests []ocispec.Descriptor
+	for _, image := range images {
+		desc, err := exportImageToLayout(ctx, client, dir, image, annotations)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("unable to export image %s: %v", image, err)
+		}
+		manifests = append(manifests, desc)
+	}
+
+	desc := manifests[0]
+	if len(manifests) > 1 {
+		index := ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: manifests,
+		}
+		var err error
+		if desc, err = writeJSONBlob(dir, ocispec.MediaTypeImageIndex, index); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if len(ref) > 0 {
+		desc.Annotations = map[string]string{ocispec.AnnotationRefName: ref}
+	}
+
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), layout, 0644); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{desc},
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), index, 0644); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// exportImageToLayout saves one image from the daemon, adds its config and
+// layers to the layout in dir, and writes an OCI manifest for it, with
+// annotations. The returned descriptor records the image's platform.
+func exportImageToLayout(ctx context.Context, client *docker.Client, dir, image string, annotations map[string]string) (ocispec.Descriptor, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(client.ExportImage(docker.ExportImageOptions{
+			Name:         image,
+			OutputStream: pw,
+			Context:      ctx,
+		}))
+	}()
+	defer pr.Close()
+	return readDockerArchive(dir, pr, annotations)
+}
+
+// dockerArchiveManifest is an entry in the manifest.json file that is written
+// by "docker save" and read by "docker load".
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string `json:",omitempty"`
+	Layers   []string
+}
+
+// readDockerArchive reads an archive in the format that "docker save" writes,
+// which may or may not also be an OCI layout depending on the version of the
+// daemon, storing each of the files in it as a blob in dir, and writes an OCI
+// manifest, with annotations, for the one image that it describes.
+func readDockerArchive(dir string, r io.Reader, annotations map[string]string) (ocispec.Descriptor, error) {
+	var manifestJSON []byte
+	blobs := make(map[string]ocispec.Descriptor)
+	links := make(map[string]string)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			switch name {
+			case "manifest.json":
+				if manifestJSON, err = io.ReadAll(tr); err != nil {
+					return ocispec.Descriptor{}, err
+				}
+			case ocispec.ImageIndexFile, ocispec.ImageLayoutFile, "repositories":
+				// metadata which we write for ourselves
+			default:
+				desc, err := writeBlob(dir, tr)
+				if err != nil {
+					return ocispec.Descriptor{}, err
+				}
+				blobs[name] = desc
+			}
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		}
+	}
+	if manifestJSON == nil {
+		return ocispec.Descriptor{}, fmt.Errorf("the archive has no manifest.json")
+	}
+	var archiveManifests []dockerArchiveManifest
+	if err := json.Unmarshal(manifestJSON, &archiveManifests); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("unable to parse manifest.json: %v", err)
+	}
+	if len(archiveManifests) != 1 {
+		return ocispec.Descriptor{}, fmt.Errorf("expected the archive to contain one image, found %d", len(archiveManifests))
+	}
+
+	lookup := func(name string) (ocispec.Descriptor, error) {
+		name = path.Clean(name)
+		// follow a bounded number of links
+		for i := 0; i < 10; i++ {
+			if desc, ok := blobs[name]; ok {
+				return desc, nil
+			}
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		return ocispec.Descriptor{}, fmt.Errorf("the archive has no file %s", name)
+	}
+
+	config, err := lookup(archiveManifests[0].Config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	config.MediaType = ocispec.MediaTypeImageConfig
+	configJSON, err := os.ReadFile(blobPath(dir, config.Digest))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var imageConfig ocispec.Image
+	if err := json.Unmarshal(configJSON, &imageConfig); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("unable to parse image config: %v", err)
+	}
+
+	manifest := ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      config,
+		Annotations: annotations,
+	}
+	for _, name := range archiveManifests[0].Layers {
+		layer, err := lookup(name)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if layer.MediaType, err = layerMediaType(blobPath(dir, layer.Digest)); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	desc, err := writeJSONBlob(dir, ocispec.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if len(imageConfig.OS) > 0 && len(imageConfig.Architecture) > 0 {
+		desc.Platform = &ocispec.Platform{
+			OS:           imageConfig.OS,
+			Architecture: imageConfig.Architecture,
+			Variant:      imageConfig.Variant,
+		}
+	}
+	klog.V(4).Infof("Wrote manifest %s with %d layers", desc.Digest, len(manifest.Layers))
+	return desc, nil
+}
+
+// layerMediaType identifies the compression, if any, of the layer at path.
+func layerMediaType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return ocispec.MediaTypeImageLayerGzip, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ocispec.MediaTypeImageLayerZstd, nil
+	default:
+		return ocispec.MediaTypeImageLayer, nil
+	}
+}
+
+// blobPath returns the location of a blob in the layout in dir.
+func blobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, ocispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// writeBlob copies r to a blob in the layout in dir, and returns a
+// descriptor, without a media type, for it.
+func writeBlob(dir string, r io.Reader) (ocispec.Descriptor, error) {
+	f, err := os.CreateTemp(filepath.Join(dir, ocispec.ImageBlobsDir), ".blob")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.Remove(f.Name())
+	digester := digest.SHA256.Digester()
+	size, err := io.Copy(f, io.TeeReader(r, digester.Hash()))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	d := digester.Digest()
+	if err := os.Rename(f.Name(), blobPath(dir, d)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{Digest: d, Size: size}, nil
+}
+
+// writeJSONBlob encodes v and stores it as a blob in the layout in dir.
+func writeJSONBlob(dir, mediaType string, v interface{}) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc, err := writeBlob(dir, bytes.NewReader(data))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc.MediaType = mediaType
+	return desc, nil
+}
@@ -0,0 +1,183 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeSaveDaemon serves archives in the format written by "docker save".
+type fakeSaveDaemon map[string][]byte
+
+func (d fakeSaveDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/get")
+	archive, ok := d[name]
+	if !ok || r.Method != http.MethodGet {
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	w.Write(archive)
+}
+
+// dockerSaveArchive builds an archive like the one that "docker save" writes
+// for an image with one uncompressed and one compressed layer, with the
+// second layer linked in from another directory.
+func dockerSaveArchive(t *testing.T, arch string) []byte {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	content := []byte(arch)
+	tw.WriteHeader(&tar.Header{Name: "arch", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write(content)
+	tw.Close()
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(layer.Bytes())
+	gz.Close()
+	config, _ := json.Marshal(ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: arch}})
+	manifest, _ := json.Marshal([]dockerArchiveManifest{{
+		Config: "config.json",
+		Layers: []string{"1/layer.tar", "2/layer.tar"},
+	}})
+
+	var archive bytes.Buffer
+	tw = tar.NewWriter(&archive)
+	for _, file := range []struct {
+		name    string
+		content []byte
+	}{
+		{"config.json", config},
+		{"1/layer.tar", layer.Bytes()},
+		{"3/layer.tar", compressed.Bytes()},
+		{"repositories", []byte("{}")},
+		{"manifest.json", manifest},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(file.content)
+	}
+	tw.WriteHeader(&tar.Header{Name: "2/layer.tar", Linkname: "../3/layer.tar", Typeflag: tar.TypeSymlink})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func readLayoutJSON(t *testing.T, dir string, desc ocispec.Descriptor, v interface{}) {
+	data, err := os.ReadFile(blobPath(dir, desc.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(data) != desc.Digest || int64(len(data)) != desc.Size {
+		t.Fatalf("blob %s does not match its descriptor", desc.Digest)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportOCILayout(t *testing.T) {
+	server := httptest.NewServer(fakeSaveDaemon{
+		"amd64image": dockerSaveArchive(t, "amd64"),
+		"arm64image": dockerSaveArchive(t, "arm64"),
+	})
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	desc, err := ExportOCILayout(context.Background(), client, dir, "busybox:1", []string{"amd64image", "arm64image"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.MediaType != ocispec.MediaTypeImageIndex || desc.Annotations[ocispec.AnnotationRefName] != "busybox:1" {
+		t.Errorf("unexpected descriptor %#v", desc)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var top ocispec.Index
+	if err := json.Unmarshal(data, &top); err != nil {
+		t.Fatal(err)
+	}
+	if len(top.Manifests) != 1 || top.Manifests[0].Digest != desc.Digest {
+		t.Fatalf("unexpected index.json %s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ocispec.ImageLayoutFile)); err != nil {
+		t.Error(err)
+	}
+
+	var index ocispec.Index
+	readLayoutJSON(t, dir, desc, &index)
+	if len(index.Manifests) != 2 {
+		t.Fatalf("expected 2 manifests, got %d", len(index.Manifests))
+	}
+	for i, arch := range []string{"amd64", "arm64"} {
+		desc := index.Manifests[i]
+		if desc.Platform == nil || desc.Platform.OS != "linux" || desc.Platform.Architecture != arch {
+			t.Errorf("unexpected platform for %s: %#v", arch, desc.Platform)
+		}
+		var manifest ocispec.Manifest
+		readLayoutJSON(t, dir, desc, &manifest)
+		if manifest.Config.MediaType != ocispec.MediaTypeImageConfig {
+			t.Errorf("unexpected config %#v", manifest.Config)
+		}
+		var config ocispec.Image
+		readLayoutJSON(t, dir, manifest.Config, &config)
+		if config.Architecture != arch {
+			t.Errorf("expected config for %s, got %s", arch, config.Architecture)
+		}
+		if len(manifest.Layers) != 2 || manifest.Layers[0].MediaType != ocispec.MediaTypeImageLayer || manifest.Layers[1].MediaType != ocispec.MediaTypeImageLayerGzip {
+			t.Errorf("unexpected layers %#v", manifest.Layers)
+		}
+		for _, layer := range manifest.Layers {
+			if _, err := os.Stat(blobPath(dir, layer.Digest)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	if _, err := ExportOCILayout(context.Background(), client, dir, "", []string{"missing"}); err == nil {
+		t.Errorf("expected an error exporting an image that doesn't exist")
+	}
+}
+
+func TestExportAnnotatedOCILayout(t *testing.T) {
+	server := httptest.NewServer(fakeSaveDaemon{"amd64image": dockerSaveArchive(t, "amd64")})
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	annotations := map[string]string{ocispec.AnnotationRevision: "abc123"}
+	desc, err := ExportAnnotatedOCILayout(context.Background(), client, dir, "busybox:1", []string{"amd64image"}, annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.MediaType != ocispec.MediaTypeImageManifest {
+		t.Fatalf("expected the manifest of a single image, got %#v", desc)
+	}
+	var manifest ocispec.Manifest
+	readLayoutJSON(t, dir, desc, &manifest)
+	if !reflect.DeepEqual(manifest.Annotations, annotations) {
+		t.Errorf("expected the manifest to be annotated with %v, got %v", annotations, manifest.Annotations)
+	}
+}
@@ -0,0 +1,389 @@
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/term"
+
+	"github.com/openshift/imagebuilder/imageprogress"
+)
+
+// ProgressMode is how the events of a build are displayed.
+type ProgressMode string
+
+const (
+	// ProgressAuto uses ProgressTTY if the output is a terminal, and
+	// ProgressPlain otherwise.
+	ProgressAuto ProgressMode = "auto"
+	// ProgressPlain prints each instruction as it starts, and the output of
+	// RUN instructions as it is written.
+	ProgressPlain ProgressMode = "plain"
+	// ProgressTTY shows the last few lines of output of the instruction in
+	// progress, and collapses each instruction to a single line when it
+	// finishes, unless it fails.
+	ProgressTTY ProgressMode = "tty"
+	// ProgressJSON writes each event as a line of JSON.
+	ProgressJSON ProgressMode = "json"
+)
+
+const (
+	// ttyOutputLines is the number of lines of output that the TTY
+	// renderer shows for the instruction in progress, and ttyKeptLines is
+	// the number it keeps, to show if the instruction fails.
+	ttyOutputLines = 6
+	ttyKeptLines   = 1000
+	// ttyRedrawInterval limits how often the TTY renderer redraws the
+	// instruction in progress.
+	ttyRedrawInterval = 100 * time.Millisecond
+	// ttyDefaultWidth is used when the width of the terminal is unknown.
+	ttyDefaultWidth = 80
+)
+
+// ParseProgressMode parses the name of a progress mode.
+func ParseProgressMode(value string) (ProgressMode, error) {
+	switch mode := ProgressMode(strings.ToLower(value)); mode {
+	case ProgressAuto, ProgressPlain, ProgressTTY, ProgressJSON:
+		return mode, nil
+	case "":
+		return ProgressAuto, nil
+	default:
+		return "", fmt.Errorf("unrecognized progress mode %q, expected %q, %q, %q or %q", value, ProgressAuto, ProgressPlain, ProgressTTY, ProgressJSON)
+	}
+}
+
+// ProgressRenderer displays the events of a build. Pass its Event method as
+// an executor's EventFn.
+type ProgressRenderer interface {
+	// Event displays event. It may be called from more than one
+	// goroutine.
+	Event(event Event)
+	// Close displays anything that is still pending, once the build is
+	// over.
+	Close() error
+}
+
+// NewProgressRenderer returns a renderer for mode which writes to out, and
+// writes the standard error of RUN instructions to errOut if mode keeps it
+// apart.
+func NewProgressRenderer(mode ProgressMode, out, errOut io.Writer) (ProgressRenderer, error) {
+	if mode == ProgressAuto || mode == "" {
+		mode = ProgressPlain
+		if _, ok := terminalFd(out); ok {
+			mode = ProgressTTY
+		}
+	}
+	switch mode {
+	case ProgressPlain:
+		return &plainRenderer{out: out, errOut: errOut}, nil
+	case ProgressTTY:
+		width := ttyDefaultWidth
+		if fd, ok := terminalFd(out); ok {
+			if size, err := term.GetWinsize(fd); err == nil && size.Width > 0 {
+				width = int(size.Width)
+			}
+		}
+		return &ttyRenderer{out: out, width: width}, nil
+	case ProgressJSON:
+		return &jsonRenderer{encoder: json.NewEncoder(out)}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized progress mode %q", mode)
+	}
+}
+
+// terminalFd returns the file descriptor of w, if it is a terminal.
+func terminalFd(w io.Writer) (uintptr, bool) {
+	f, ok := w.(*os.File)
+	if !ok || !term.IsTerminal(f.Fd()) {
+		return 0, false
+	}
+	return f.Fd(), true
+}
+
+// eventPrefix identifies the platform that an event is for, if one was
+// specified.
+func eventPrefix(source *EventSource) string {
+	if len(source.Platform) == 0 {
+		return ""
+	}
+	return "[" + source.Platform + "] "
+}
+
+// describePull describes the progress of a pull as imageprogress does.
+func describePull(progress *imageprogress.Progress) []string {
+	if progress.Extracting {
+		return []string{fmt.Sprintf("Pulled %[1]d/%[1]d layers, 100%% complete", progress.Layers), "Extracting"}
+	}
+	return []string{fmt.Sprintf("Pulled %d/%d layers, %.0f%% complete", progress.Complete, progress.Layers, progress.Percent)}
+}
+
+// describeCommit describes a commit.
+func describeCommit(event *CommitEvent) string {
+	if len(event.Tags) == 0 {
+		return "Committed " + event.ImageID
+	}
+	return fmt.Sprintf("Committed %s as %s", event.ImageID, strings.Join(event.Tags, ", "))
+}
+
+// plainRenderer prints messages in the same form as the command line's
+// LogFn, and passes the output of RUN instructions through.
+type plainRenderer struct {
+	lock   sync.Mutex
+	out    io.Writer
+	errOut io.Writer
+}
+
+func (r *plainRenderer) Event(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	prefix := eventPrefix(event.Source())
+	switch event := event.(type) {
+	case *StepStartedEvent:
+		r.printf("%s%s", prefix, event.Original)
+	case *PullEvent:
+		if len(event.Message) > 0 {
+			r.printf("%s%s", prefix, event.Message)
+		}
+		if event.Progress != nil {
+			for _, line := range describePull(event.Progress) {
+				r.printf("%s%s", prefix, line)
+			}
+		}
+	case *OutputEvent:
+		w := r.out
+		if event.Stream == OutputStderr && r.errOut != nil {
+			w = r.errOut
+		}
+		fmt.Fprintln(w, event.Line)
+	case *WarningEvent:
+		r.printf("%sWarning: %s", prefix, event.Message)
+	case *CommitEvent:
+		r.printf("%s%s", prefix, describeCommit(event))
+	}
+}
+
+func (r *plainRenderer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "--> %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *plainRenderer) Close() error {
+	return nil
+}
+
+// jsonRenderer writes each event as a line of JSON.
+type jsonRenderer struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	err     error
+}
+
+func (r *jsonRenderer) Event(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.encoder.Encode(event); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *jsonRenderer) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// ttyRenderer redraws the instruction in progress, with the last few lines of
+// its output, at the bottom of a terminal, and replaces it with a single line
+// when it finishes. The output of an instruction which fails is kept.
+type ttyRenderer struct {
+	lock  sync.Mutex
+	out   io.Writer
+	width int
+	// step is the instruction in progress, if there is one, and drawn is
+	// the number of lines that were drawn for it.
+	step     *ttyStep
+	drawn    int
+	drawTime time.Time
+}
+
+// ttyStep is the state of the instruction in progress.
+type ttyStep struct {
+	title   string
+	started time.Time
+	// status describes the progress of a pull or copy, and output holds
+	// the last lines that the instruction wrote.
+	status string
+	output []string
+}
+
+func (r *ttyRenderer) Event(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	prefix := eventPrefix(event.Source())
+	switch event := event.(type) {
+	case *StepStartedEvent:
+		r.clear()
+		if r.step != nil {
+			r.printf("=> %s", r.step.title)
+		}
+		title := prefix + event.Original
+		if stage := event.Stage; len(stage) > 0 {
+			title = fmt.Sprintf("%s[%s] %s", prefix, stage, event.Original)
+		}
+		r.step = &ttyStep{title: title, started: time.Now()}
+		r.draw()
+	case *StepFinishedEvent:
+		r.clear()
+		if r.step == nil {
+			return
+		}
+		if len(event.Error) == 0 {
+			r.printf("%s", r.stepLine(fmt.Sprintf("DONE %.1fs", event.Duration.Seconds())))
+		} else {
+			r.printf("%s", r.stepLine(fmt.Sprintf("ERROR %.1fs", event.Duration.Seconds())))
+			for _, line := range r.step.output {
+				fmt.Fprintf(r.out, " | %s\n", line)
+			}
+			r.printf("=> %s", event.Error)
+		}
+		r.step = nil
+	case *PullEvent:
+		if r.step == nil {
+			return
+		}
+		if len(event.Message) > 0 {
+			r.step.status = event.Message
+		}
+		if event.Progress != nil {
+			lines := describePull(event.Progress)
+			r.step.status = lines[len(lines)-1]
+		}
+		r.redraw()
+	case *CopyEvent:
+		if r.step == nil {
+			return
+		}
+		r.step.status = fmt.Sprintf("Uploaded %s", formatBytes(event.Bytes))
+		r.redraw()
+	case *OutputEvent:
+		if r.step == nil {
+			fmt.Fprintln(r.out, event.Line)
+			return
+		}
+		r.step.output = append(r.step.output, event.Line)
+		if len(r.step.output) > ttyKeptLines {
+			r.step.output = r.step.output[len(r.step.output)-ttyKeptLines:]
+		}
+		r.redraw()
+	case *WarningEvent:
+		r.clear()
+		r.printf("%sWARNING: %s", prefix, event.Message)
+		r.draw()
+	case *CommitEvent:
+		r.clear()
+		r.printf("=> %s%s", prefix, describeCommit(event))
+		r.draw()
+	}
+}
+
+func (r *ttyRenderer) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.clear()
+	if r.step != nil {
+		r.printf("%s", r.stepLine(fmt.Sprintf("CANCELED %.1fs", time.Since(r.step.started).Seconds())))
+		r.step = nil
+	}
+	return nil
+}
+
+// printf writes a line above the instruction in progress, which must have
+// been cleared.
+func (r *ttyRenderer) printf(format string, args ...interface{}) {
+	fmt.Fprintln(r.out, r.truncate(fmt.Sprintf(format, args...)))
+}
+
+// redraw draws the instruction in progress again, unless it was drawn very
+// recently.
+func (r *ttyRenderer) redraw() {
+	if time.Since(r.drawTime) < ttyRedrawInterval {
+		return
+	}
+	r.clear()
+	r.draw()
+}
+
+// clear erases the lines that were drawn for the instruction in progress.
+func (r *ttyRenderer) clear() {
+	if r.drawn > 0 {
+		fmt.Fprintf(r.out, "\x1b[%dA\x1b[J", r.drawn)
+		r.drawn = 0
+	}
+}
+
+// draw draws the instruction in progress below the last line that was
+// printed.
+func (r *ttyRenderer) draw() {
+	r.drawTime = time.Now()
+	if r.step == nil {
+		return
+	}
+	lines := []string{r.stepLine(fmt.Sprintf("%.1fs", time.Since(r.step.started).Seconds()))}
+	if len(r.step.status) > 0 {
+		lines = append(lines, "   "+r.step.status)
+	}
+	output := r.step.output
+	if len(output) > ttyOutputLines {
+		output = output[len(output)-ttyOutputLines:]
+	}
+	for _, line := range output {
+		lines = append(lines, " | "+line)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(r.out, r.truncate(line))
+	}
+	r.drawn = len(lines)
+}
+
+// stepLine describes the instruction in progress, followed by status,
+// shortening its title so that the status fits on the line.
+func (r *ttyRenderer) stepLine(status string) string {
+	title := []rune(r.step.title)
+	if room := r.width - 1 - len("=> ") - len("  ") - len(status); r.width > 1 && len(title) > room {
+		if room < 0 {
+			room = 0
+		}
+		title = title[:room]
+	}
+	return fmt.Sprintf("=> %s  %s", string(title), status)
+}
+
+// truncate shortens line so that it fits on a line of the terminal, so that
+// the number of lines that were drawn is known.
+func (r *ttyRenderer) truncate(line string) string {
+	line = strings.ReplaceAll(line, "\t", "    ")
+	runes := []rune(line)
+	if r.width <= 1 || len(runes) < r.width {
+		return line
+	}
+	return string(runes[:r.width-1])
+}
+
+// formatBytes describes a number of bytes in the largest unit that it is at
+// least one of.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
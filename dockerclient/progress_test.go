@@ -0,0 +1,192 @@
+package dockerclient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/imagebuilder/imageprogress"
+)
+
+// testEvents are the events of a build of a stage whose RUN instruction
+// fails.
+func testEvents() []Event {
+	source := func(t EventType, step int) EventSource {
+		return EventSource{Type: t, Time: time.Unix(0, 0).UTC(), Stage: "build", Step: step}
+	}
+	return []Event{
+		&StepStartedEvent{EventSource: source(EventStepStarted, 0), Command: "from", Original: "FROM busybox AS build"},
+		&PullEvent{EventSource: source(EventPull, 0), Image: "busybox", Message: "Image busybox was not found, pulling ..."},
+		&PullEvent{EventSource: source(EventPull, 0), Image: "busybox", Progress: &imageprogress.Progress{Layers: 1, Complete: 1, Percent: 100, Extracting: true}},
+		&StepFinishedEvent{EventSource: source(EventStepFinished, 0), Duration: time.Second},
+		&StepStartedEvent{EventSource: source(EventStepStarted, 1), Command: "copy", Original: "COPY . /src"},
+		&CopyEvent{EventSource: source(EventCopy, 1), Bytes: 2048, Done: true},
+		&StepFinishedEvent{EventSource: source(EventStepFinished, 1)},
+		&StepStartedEvent{EventSource: source(EventStepStarted, 2), Command: "run", Original: "RUN make"},
+		&OutputEvent{EventSource: source(EventOutput, 2), Stream: OutputStdout, Line: "building"},
+		&OutputEvent{EventSource: source(EventOutput, 2), Stream: OutputStderr, Line: "make: *** No targets.  Stop."},
+		&StepFinishedEvent{EventSource: source(EventStepFinished, 2), Duration: 2 * time.Second, Error: "running 'make' failed with exit code 2"},
+		&WarningEvent{EventSource: source(EventWarning, -1), Message: "Unable to cleanup: container is gone"},
+		&CommitEvent{EventSource: source(EventCommit, -1), ImageID: "sha256:abcd", Tags: []string{"example:latest"}},
+	}
+}
+
+func TestParseProgressMode(t *testing.T) {
+	for value, expected := range map[string]ProgressMode{
+		"":      ProgressAuto,
+		"auto":  ProgressAuto,
+		"Plain": ProgressPlain,
+		"tty":   ProgressTTY,
+		"json":  ProgressJSON,
+	} {
+		mode, err := ParseProgressMode(value)
+		if err != nil || mode != expected {
+			t.Errorf("%q: expected %s, got %s: %v", value, expected, mode, err)
+		}
+	}
+	if _, err := ParseProgressMode("fancy"); err == nil {
+		t.Errorf("expected an error for an unknown mode")
+	}
+}
+
+func TestPlainRenderer(t *testing.T) {
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	renderer, err := NewProgressRenderer(ProgressAuto, out, errOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range testEvents() {
+		renderer.Event(event)
+	}
+	if err := renderer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := `--> FROM busybox AS build
+--> Image busybox was not found, pulling ...
+--> Pulled 1/1 layers, 100% complete
+--> Extracting
+--> COPY . /src
+--> RUN make
+building
+--> Warning: Unable to cleanup: container is gone
+--> Committed sha256:abcd as example:latest
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	if errOut.String() != "make: *** No targets.  Stop.\n" {
+		t.Errorf("expected standard error to be kept apart, got %q", errOut.String())
+	}
+}
+
+func TestJSONRenderer(t *testing.T) {
+	out := &bytes.Buffer{}
+	renderer, err := NewProgressRenderer(ProgressJSON, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := testEvents()
+	for _, event := range events {
+		renderer.Event(event)
+	}
+	if err := renderer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != len(events) {
+		t.Fatalf("expected a line for each event, got %d", len(lines))
+	}
+	for i, line := range lines {
+		source := events[i].Source()
+		if line["type"] != string(source.Type) || line["stage"] != "build" || line["step"] != float64(source.Step) {
+			t.Errorf("expected line %d to be %s during step %d of build, got %v", i, source.Type, source.Step, line)
+		}
+	}
+	if lines[9]["line"] != "make: *** No targets.  Stop." || lines[9]["stream"] != OutputStderr {
+		t.Errorf("unexpected output event: %v", lines[9])
+	}
+	if progress, ok := lines[2]["progress"].(map[string]interface{}); !ok || progress["layers"] != float64(1) {
+		t.Errorf("unexpected pull event: %v", lines[2])
+	}
+}
+
+func TestTTYRenderer(t *testing.T) {
+	out := &bytes.Buffer{}
+	renderer, err := NewProgressRenderer(ProgressTTY, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range testEvents() {
+		renderer.Event(event)
+	}
+	renderer.Event(&StepStartedEvent{EventSource: EventSource{Stage: "build", Step: 3}, Original: "RUN " + strings.Repeat("x", 200)})
+	if err := renderer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// apply the escape sequences which erase the instruction in progress
+	var screen []string
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		for {
+			i := strings.Index(line, "\x1b[")
+			if i < 0 {
+				break
+			}
+			end := strings.Index(line[i:], "A\x1b[J")
+			var n int
+			for _, c := range line[i+2 : i+end] {
+				n = n*10 + int(c-'0')
+			}
+			screen = screen[:len(screen)-n]
+			line = line[i+end+len("A\x1b[J"):]
+		}
+		if len(line) > 0 {
+			screen = append(screen, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	expected := []string{
+		"=> [build] FROM busybox AS build  DONE 1.0s",
+		"=> [build] COPY . /src  DONE 0.0s",
+		"=> [build] RUN make  ERROR 2.0s",
+		" | building",
+		" | make: *** No targets.  Stop.",
+		"=> running 'make' failed with exit code 2",
+		"WARNING: Unable to cleanup: container is gone",
+		"=> Committed sha256:abcd as example:latest",
+	}
+	if len(screen) != len(expected)+1 {
+		t.Fatalf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(screen, "\n"))
+	}
+	for i := range expected {
+		if screen[i] != expected[i] {
+			t.Errorf("expected line %d to be %q, got %q", i, expected[i], screen[i])
+		}
+	}
+	if canceled := screen[len(expected)]; !strings.Contains(canceled, "CANCELED") || len(canceled) >= ttyDefaultWidth {
+		t.Errorf("expected the unfinished step to be truncated and canceled, got %q", canceled)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		2048:            "2.0 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	} {
+		if actual := formatBytes(n); actual != expected {
+			t.Errorf("%d: expected %q, got %q", n, expected, actual)
+		}
+	}
+}
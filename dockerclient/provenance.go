@@ -0,0 +1,418 @@
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	"go.podman.io/storage/pkg/fileutils"
+
+	"github.com/openshift/imagebuilder"
+)
+
+const (
+	// ProvenanceLabel holds the build definition part of an image's
+	// provenance, as JSON, if it was requested when the image was built.
+	ProvenanceLabel = "io.openshift.imagebuilder.provenance"
+
+	// ProvenanceStatementType is the type of the in-toto statements that
+	// describe built images.
+	ProvenanceStatementType = "https://in-toto.io/Statement/v1"
+	// ProvenancePredicateType is the type of the provenance in those
+	// statements.
+	ProvenancePredicateType = "https://slsa.dev/provenance/v1"
+	// ProvenanceBuildType identifies the format of the build definition
+	// in the provenance.
+	ProvenanceBuildType = "https://github.com/openshift/imagebuilder/provenance/v1"
+	// ProvenanceBuilderID identifies imagebuilder as the builder.
+	ProvenanceBuilderID = "https://github.com/openshift/imagebuilder"
+)
+
+// redactedArg replaces the values of build args which look like secrets.
+const redactedArg = "REDACTED"
+
+// secretArgPattern matches the names of build args whose values should not
+// be recorded.
+var secretArgPattern = regexp.MustCompile(`(?i)(secret|token|passw|pwd|credential|auth|private|key)`)
+
+// ProvenanceStatement is an in-toto statement that records what went into a
+// built image, as SLSA provenance.
+type ProvenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// Provenance describes how an image was built.
+type Provenance struct {
+	BuildDefinition ProvenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      ProvenanceRunDetails      `json:"runDetails"`
+}
+
+// ProvenanceBuildDefinition describes the inputs to a build. Repeating a build
+// with the same definition should produce the same image.
+type ProvenanceBuildDefinition struct {
+	BuildType          string               `json:"buildType"`
+	ExternalParameters ProvenanceParameters `json:"externalParameters"`
+	// ResolvedDependencies lists each of the Dockerfiles, the build
+	// context, and the base image of each stage.
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+// ProvenanceParameters are the settings that a build was started with.
+type ProvenanceParameters struct {
+	Dockerfiles []string `json:"dockerfiles,omitempty"`
+	Target      string   `json:"target,omitempty"`
+	Platform    string   `json:"platform,omitempty"`
+	From        string   `json:"from,omitempty"`
+	// Args are the build args which were used by the Dockerfiles, with
+	// the values of those which look like secrets redacted.
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// ProvenanceRunDetails describes a run of a build.
+type ProvenanceRunDetails struct {
+	Builder  ProvenanceBuilder  `json:"builder"`
+	Metadata ProvenanceMetadata `json:"metadata"`
+	// Byproducts lists the images which were committed for stages other
+	// than the last one.
+	Byproducts []ResourceDescriptor `json:"byproducts,omitempty"`
+}
+
+// ProvenanceBuilder identifies what performed a build.
+type ProvenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+// ProvenanceMetadata identifies a run of a build, and when it ran.
+type ProvenanceMetadata struct {
+	InvocationID string     `json:"invocationId,omitempty"`
+	StartedOn    *time.Time `json:"startedOn,omitempty"`
+	FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+}
+
+// ResourceDescriptor identifies an input to or an output of a build.
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// digestSet returns d in the form that resource descriptors use.
+func digestSet(d digest.Digest) map[string]string {
+	return map[string]string{d.Algorithm().String(): d.Encoded()}
+}
+
+// provenanceBuildDefinition describes the inputs to the build of stages,
+// which have been prepared by the executor, but not yet committed.
+func (e *ClientExecutor) provenanceBuildDefinition(b *imagebuilder.Builder, stages imagebuilder.Stages, opts BuildOptions) (ProvenanceBuildDefinition, error) {
+	def := ProvenanceBuildDefinition{
+		BuildType: ProvenanceBuildType,
+		ExternalParameters: ProvenanceParameters{
+			Target:   opts.Target,
+			Platform: e.Platform,
+			From:     opts.From,
+			Args:     consumedArgs(b, stages),
+		},
+	}
+
+	dockerfiles := opts.Dockerfiles
+	if len(dockerfiles) == 0 {
+		dockerfiles = []string{filepath.Join(e.Directory, "Dockerfile")}
+	}
+	for _, dockerfile := range dockerfiles {
+		d, err := fileDigest(dockerfile)
+		if err != nil {
+			return def, err
+		}
+		name := dockerfile
+		if rel, err := filepath.Rel(e.Directory, dockerfile); err == nil && !strings.HasPrefix(rel, "..") {
+			name = filepath.ToSlash(rel)
+		}
+		def.ExternalParameters.Dockerfiles = append(def.ExternalParameters.Dockerfiles, name)
+		def.ResolvedDependencies = append(def.ResolvedDependencies, ResourceDescriptor{
+			Name:   "dockerfile:" + name,
+			Digest: digestSet(d),
+		})
+	}
+
+	var contextDigested digest.Digest
+	var err error
+	switch {
+	case len(e.ContextArchive) > 0:
+		contextDigested, err = fileDigest(e.ContextArchive)
+	case len(e.Directory) > 0:
+		contextDigested, err = contextDigest(e.Directory, e.Excludes)
+	}
+	if err != nil {
+		return def, fmt.Errorf("unable to compute the digest of the build context: %v", err)
+	}
+	if len(contextDigested) > 0 {
+		def.ResolvedDependencies = append(def.ResolvedDependencies, ResourceDescriptor{
+			Name:   "context",
+			Digest: digestSet(contextDigested),
+		})
+	}
+
+	committed := make(map[string]string)
+	for _, stage := range stages {
+		stageExecutor, ok := e.Named[strconv.Itoa(stage.Position)]
+		if !ok || stageExecutor.Image == nil {
+			continue
+		}
+		dependency := ResourceDescriptor{
+			Name:        "stage:" + stageName(stage.Name, stage.Position),
+			Annotations: map[string]string{},
+		}
+		if from, ok := committed[stageExecutor.Image.ID]; ok {
+			// the image of an earlier stage isn't an input to the
+			// build, and isn't the same from one build to the next
+			dependency.Annotations["stage"] = from
+		} else if len(stageExecutor.resolvedFrom) == 0 {
+			// neither is the image that is created for scratch
+			dependency.Annotations["image"] = imagebuilder.NoBaseImageSpecifier
+		} else {
+			dependency.URI = "docker-image://" + stageExecutor.resolvedFrom
+			dependency.Annotations["imageID"] = stageExecutor.Image.ID
+			if len(stageExecutor.originalFrom) > 0 && stageExecutor.originalFrom != stageExecutor.resolvedFrom {
+				dependency.Annotations["originalName"] = stageExecutor.originalFrom
+			}
+			if d := repoDigest(stageExecutor.Image.RepoDigests, stageExecutor.resolvedFrom); len(d) > 0 {
+				dependency.Digest = digestSet(d)
+			}
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, dependency)
+		if stageExecutor.Committed != nil {
+			committed[stageExecutor.Committed.ID] = stageName(stage.Name, stage.Position)
+		}
+	}
+	return def, nil
+}
+
+// stageName returns the name of a stage, or its position if it doesn't have
+// one.
+func stageName(name string, position int) string {
+	if len(name) > 0 {
+		return name
+	}
+	return strconv.Itoa(position)
+}
+
+// consumedArgs returns the build args which were passed to the build and
+// used by one of its stages, with the values of those which look like
+// secrets, and the passwords in URLs, redacted.
+func consumedArgs(b *imagebuilder.Builder, stages imagebuilder.Stages) map[string]string {
+	used := make(map[string]bool)
+	for _, name := range b.GlobalAllowedArgs {
+		used[name] = true
+	}
+	for name := range b.HeadingArgs {
+		used[name] = true
+	}
+	for _, stage := range stages {
+		for name, allowed := range stage.Builder.AllowedArgs {
+			used[name] = used[name] || allowed
+		}
+	}
+	args := make(map[string]string)
+	for name, value := range b.UserArgs {
+		if !used[name] {
+			continue
+		}
+		switch u, err := url.Parse(value); {
+		case secretArgPattern.MatchString(name):
+			value = redactedArg
+		case err == nil && u.User != nil:
+			value = u.Redacted()
+		}
+		args[name] = value
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// repoDigest returns the digest of the manifest that the image named name was
+// pulled by, or any digest that it is known by, if name doesn't match any of
+// them.
+func repoDigest(repoDigests []string, name string) digest.Digest {
+	var repository string
+	if named, err := reference.ParseNormalizedNamed(name); err == nil {
+		repository = named.Name()
+	}
+	var found digest.Digest
+	for _, repoDigest := range repoDigests {
+		named, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		canonical, ok := named.(reference.Canonical)
+		if !ok {
+			continue
+		}
+		if named.Name() == repository {
+			return canonical.Digest()
+		}
+		if len(found) == 0 {
+			found = canonical.Digest()
+		}
+	}
+	return found
+}
+
+// fileDigest returns the digest of the contents of the file at path.
+func fileDigest(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest.SHA256.FromReader(f)
+}
+
+// contextDigest returns a digest of the names, types, permissions, link
+// targets and contents of the items in directory which aren't excluded, which
+// doesn't change when only their times or owners do.
+func contextDigest(directory string, excludes []string) (digest.Digest, error) {
+	matcher, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return "", err
+	}
+	digester := digest.SHA256.Digester()
+	h := digester.Hash()
+	err = filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(directory, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		excluded, err := matcher.IsMatch(rel)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			if d.IsDir() && !matcher.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var content string
+		switch {
+		case info.Mode().IsRegular():
+			d, err := fileDigest(path)
+			if err != nil {
+				return err
+			}
+			content = d.String()
+		case info.Mode()&fs.ModeSymlink != 0:
+			if content, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(h, "%q %s %q\n", rel, info.Mode().String(), content)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return digester.Digest(), nil
+}
+
+// provenanceStatement returns a statement of the provenance of the image built
+// by a run of a build with the definition def, between started and finished.
+func (e *ClientExecutor) provenanceStatement(result *BuildResult, def ProvenanceBuildDefinition, started, finished time.Time) ProvenanceStatement {
+	subject := ResourceDescriptor{Name: e.Tag, Digest: digestSet(digest.Digest(result.ImageID))}
+	if len(subject.Name) == 0 {
+		subject.Name = result.ImageID
+	}
+	statement := ProvenanceStatement{
+		Type:          ProvenanceStatementType,
+		Subject:       []ResourceDescriptor{subject},
+		PredicateType: ProvenancePredicateType,
+		Predicate: Provenance{
+			BuildDefinition: def,
+			RunDetails: ProvenanceRunDetails{
+				Builder: ProvenanceBuilder{ID: ProvenanceBuilderID},
+				Metadata: ProvenanceMetadata{
+					InvocationID: e.BuildID,
+					StartedOn:    &started,
+					FinishedOn:   &finished,
+				},
+			},
+		},
+	}
+	for _, stage := range result.Stages {
+		if len(stage.ImageID) == 0 || stage.ImageID == result.ImageID {
+			continue
+		}
+		statement.Predicate.RunDetails.Byproducts = append(statement.Predicate.RunDetails.Byproducts, ResourceDescriptor{
+			Name:   "stage:" + stageName(stage.Name, stage.Position),
+			Digest: digestSet(digest.Digest(stage.ImageID)),
+		})
+	}
+	return statement
+}
+
+// WriteProvenance writes statements to w as JSON lines, one statement per
+// line, as in-toto bundles are written.
+func WriteProvenance(w io.Writer, statements []ProvenanceStatement) error {
+	enc := json.NewEncoder(w)
+	for _, statement := range statements {
+		if err := enc.Encode(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeProvenanceFile writes the provenance of the images in result to path.
+func writeProvenanceFile(path string, result *BuildResult) error {
+	var statements []ProvenanceStatement
+	for _, r := range append([]*BuildResult{result}, result.Platforms...) {
+		if r.Provenance != nil {
+			statements = append(statements, *r.Provenance)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteProvenance(f, statements); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// labelProvenance records def in the label of the image that b will commit.
+func labelProvenance(b *imagebuilder.Builder, def ProvenanceBuildDefinition) error {
+	data, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	if b.RunConfig.Labels == nil {
+		b.RunConfig.Labels = make(map[string]string)
+	}
+	b.RunConfig.Labels[ProvenanceLabel] = string(data)
+	return nil
+}
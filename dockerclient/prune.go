@@ -0,0 +1,203 @@
+package dockerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+)
+
+const (
+	// BuildIDLabel is the label which records the ID of the build that
+	// created a volume.
+	BuildIDLabel = "io.openshift.imagebuilder.build-id"
+	// CreatedLabel is the label which records when a volume was created,
+	// in RFC 3339 format.
+	CreatedLabel = "io.openshift.imagebuilder.created"
+
+	// containerNamePrefix starts the name of every container that is
+	// created by a build, and is followed by the build ID.
+	containerNamePrefix = "imagebuilder-"
+	// scratchImagePrefix starts the name of every image that is created by
+	// CreateScratchImage(), and is followed by the build ID.
+	scratchImagePrefix = "imagebuilder-scratch-"
+	// stageImagePrefix starts the name of every image that is committed so
+	// that a stage can be used as the base of a later one, and is followed
+	// by the build ID.
+	stageImagePrefix = "imagebuilder-stage-"
+)
+
+var (
+	containerNameRegexp = regexp.MustCompile("^/?" + regexp.QuoteMeta(containerNamePrefix) + "([a-z0-9]+)-[a-z0-9]+$")
+	imageNameRegexp     = regexp.MustCompile("^(?:" + regexp.QuoteMeta(scratchImagePrefix) + "|" + regexp.QuoteMeta(stageImagePrefix) + ")([a-z0-9]+)-[a-z0-9]+:latest$")
+)
+
+// PruneOptions controls which resources Prune() removes.
+type PruneOptions struct {
+	// OlderThan limits pruning to resources which were created at least
+	// this long ago, so that resources which belong to builds which are
+	// still running are left alone.
+	OlderThan time.Duration
+	// DryRun, if set, causes the resources which would be removed to be
+	// returned without removing them.
+	DryRun bool
+}
+
+// PrunedResource describes a container, image, or volume that was left behind
+// by a build.
+type PrunedResource struct {
+	// Type is one of "container", "image", or "volume".
+	Type    string
+	ID      string
+	BuildID string
+	Created time.Time
+}
+
+// String returns a description of the resource.
+func (r PrunedResource) String() string {
+	return fmt.Sprintf("%s %s (build %s, created %s)", r.Type, r.ID, r.BuildID, r.Created.Format(time.RFC3339))
+}
+
+// Prune finds the containers, images, and volumes which were created by
+// builds and not removed, and removes those which are older than
+// opts.OlderThan. It returns the resources that it removed, or would have
+// removed if opts.DryRun is set. Images which are still in use are skipped.
+// Failures to remove individual resources do not stop it from removing the
+// rest, and are returned together.
+func Prune(ctx context.Context, client *docker.Client, opts PruneOptions) ([]PrunedResource, error) {
+	cutoff := time.Now().Add(-opts.OlderThan)
+	var candidates []PrunedResource
+
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true, Context: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list containers: %v", err)
+	}
+	for _, container := range containers {
+		for _, name := range container.Names {
+			if m := containerNameRegexp.FindStringSubmatch(name); m != nil {
+				candidates = append(candidates, PrunedResource{
+					Type:    "container",
+					ID:      container.ID,
+					BuildID: m[1],
+					Created: time.Unix(container.Created, 0),
+				})
+				break
+			}
+		}
+	}
+
+	images, err := client.ListImages(docker.ListImagesOptions{All: true, Context: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list images: %v", err)
+	}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if m := imageNameRegexp.FindStringSubmatch(tag); m != nil {
+				// remove the tag rather than the image ID, since the image
+				// may have become the base of an image that was built
+				candidates = append(candidates, PrunedResource{
+					Type:    "image",
+					ID:      tag,
+					BuildID: m[1],
+					Created: time.Unix(image.Created, 0),
+				})
+			}
+		}
+	}
+
+	volumes, err := client.ListVolumes(docker.ListVolumesOptions{
+		Filters: map[string][]string{"label": {BuildIDLabel}},
+		Context: ctx,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list volumes: %v", err)
+	}
+	for _, volume := range volumes {
+		candidates = append(candidates, PrunedResource{
+			Type:    "volume",
+			ID:      volume.Name,
+			BuildID: volume.Labels[BuildIDLabel],
+			Created: labeledCreationTime(volume.Labels, volume.CreatedAt),
+		})
+	}
+
+	var pruned []PrunedResource
+	var errs []error
+	// candidates are in the order that they need to be removed in:
+	// containers hold references to images and volumes
+	for _, resource := range candidates {
+		if resource.Created.After(cutoff) {
+			continue
+		}
+		if opts.DryRun {
+			pruned = append(pruned, resource)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		klog.V(4).Infof("Pruning %s", resource)
+		if err := removeResource(ctx, client, resource); err != nil {
+			var dockerErr *docker.Error
+			if errors.As(err, &dockerErr) && dockerErr.Status == http.StatusConflict {
+				// an image which is in use by a container that we
+				// didn't create can't be removed yet
+				klog.V(4).Infof("Not pruning %s: %v", resource, err)
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+		pruned = append(pruned, resource)
+	}
+	return pruned, errors.Join(errs...)
+}
+
+// removeResource removes a single resource found by Prune().
+func removeResource(ctx context.Context, client *docker.Client, resource PrunedResource) error {
+	var err error
+	switch resource.Type {
+	case "container":
+		err = client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:            resource.ID,
+			RemoveVolumes: true,
+			Force:         true,
+			Context:       ctx,
+		})
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			err = nil
+		}
+	case "image":
+		err = client.RemoveImageExtended(resource.ID, docker.RemoveImageOptions{Context: ctx})
+		if errors.Is(err, docker.ErrNoSuchImage) {
+			err = nil
+		}
+	case "volume":
+		err = client.RemoveVolumeWithOptions(docker.RemoveVolumeOptions{Name: resource.ID, Context: ctx})
+		if errors.Is(err, docker.ErrNoSuchVolume) {
+			err = nil
+		}
+	default:
+		err = fmt.Errorf("unknown resource type %q", resource.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to remove %s %s: %w", resource.Type, strings.TrimPrefix(resource.ID, "sha256:"), err)
+	}
+	return nil
+}
+
+// labeledCreationTime returns the time recorded in the CreatedLabel label, or
+// fallback if the label is missing or can't be parsed.
+func labeledCreationTime(labels map[string]string, fallback time.Time) time.Time {
+	if created, err := time.Parse(time.RFC3339, labels[CreatedLabel]); err == nil {
+		return created
+	}
+	return fallback
+}
@@ -0,0 +1,146 @@
+package dockerclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakePruneDaemon serves just enough of the Docker API for Prune().
+type fakePruneDaemon struct {
+	containers []docker.APIContainers
+	images     []docker.APIImages
+	volumes    []docker.Volume
+
+	lock    sync.Mutex
+	removed []string
+}
+
+func (d *fakePruneDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/containers/json":
+		json.NewEncoder(w).Encode(d.containers)
+	case r.Method == http.MethodGet && r.URL.Path == "/images/json":
+		json.NewEncoder(w).Encode(d.images)
+	case r.Method == http.MethodGet && r.URL.Path == "/volumes":
+		json.NewEncoder(w).Encode(map[string]interface{}{"Volumes": d.volumes})
+	case r.Method == http.MethodDelete:
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		d.removed = append(d.removed, strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	daemon := &fakePruneDaemon{
+		containers: []docker.APIContainers{
+			{ID: "c1", Names: []string{"/imagebuilder-abc123-x1y2"}, Created: old.Unix()},
+			{ID: "c2", Names: []string{"/imagebuilder-def456-x1y2"}, Created: recent.Unix()},
+			{ID: "c3", Names: []string{"/unrelated"}, Created: old.Unix()},
+		},
+		images: []docker.APIImages{
+			{ID: "sha256:i1", Created: old.Unix(), RepoTags: []string{"imagebuilder-stage-abc123-p8:latest"}},
+			{ID: "sha256:i2", Created: old.Unix(), RepoTags: []string{"example.com/imagebuilder-stage-abc123-p8:latest"}},
+			{ID: "sha256:i3", Created: old.Unix(), RepoTags: []string{"imagebuilder-scratch-abc123-q9:latest"}},
+			{ID: "sha256:i4", Created: recent.Unix(), RepoTags: []string{"imagebuilder-scratch-def456-q9:latest"}},
+		},
+		volumes: []docker.Volume{
+			{Name: "v1", CreatedAt: old, Labels: map[string]string{BuildIDLabel: "abc123"}},
+			{Name: "v2", CreatedAt: old, Labels: map[string]string{BuildIDLabel: "def456", CreatedLabel: recent.UTC().Format(time.RFC3339)}},
+		},
+	}
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(resources []PrunedResource) []string {
+		var ids []string
+		for _, resource := range resources {
+			ids = append(ids, resource.Type+"/"+resource.ID)
+		}
+		return ids
+	}
+	expected := []string{"container/c1", "image/imagebuilder-stage-abc123-p8:latest", "image/imagebuilder-scratch-abc123-q9:latest", "volume/v1"}
+
+	pruned, err := Prune(context.Background(), client, PruneOptions{OlderThan: time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(pruned), expected) {
+		t.Errorf("unexpected dry run result: %v", ids(pruned))
+	}
+	if len(daemon.removed) != 0 {
+		t.Errorf("dry run removed %v", daemon.removed)
+	}
+	for _, resource := range pruned {
+		if resource.BuildID != "abc123" {
+			t.Errorf("unexpected build ID for %s", resource)
+		}
+	}
+
+	pruned, err = Prune(context.Background(), client, PruneOptions{OlderThan: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(pruned), expected) {
+		t.Errorf("unexpected result: %v", ids(pruned))
+	}
+	removed := append([]string{}, daemon.removed...)
+	sort.Strings(removed)
+	if !reflect.DeepEqual(removed, []string{"containers/c1", "images/imagebuilder-scratch-abc123-q9:latest", "images/imagebuilder-stage-abc123-p8:latest", "volumes/v1"}) {
+		t.Errorf("unexpected removals: %v", removed)
+	}
+}
+
+func TestBuildLabels(t *testing.T) {
+	e := NewClientExecutor(nil)
+	labels, err := e.buildLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.BuildID) == 0 || labels[BuildIDLabel] != e.BuildID {
+		t.Errorf("expected build ID %q in %v", e.BuildID, labels)
+	}
+	if _, err := time.Parse(time.RFC3339, labels[CreatedLabel]); err != nil {
+		t.Errorf("unexpected creation time: %v", err)
+	}
+	name, err := e.resourceName(containerNamePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := containerNameRegexp.FindStringSubmatch(name); m == nil || m[1] != e.BuildID {
+		t.Errorf("container name %q does not match %v", name, containerNameRegexp)
+	}
+	child := e.WithName("stage", 0)
+	if child.BuildID != e.BuildID {
+		t.Errorf("expected stage to use build ID %q, got %q", e.BuildID, child.BuildID)
+	}
+
+	for _, id := range []string{"Build1", "build-1", "build_1", "../build"} {
+		e := NewClientExecutor(nil)
+		e.BuildID = id
+		if _, err := e.resourceName(containerNamePrefix); err == nil || !strings.Contains(err.Error(), "invalid build ID") {
+			t.Errorf("%s: expected the build ID to be rejected, got %v", id, err)
+		}
+		if _, err := e.buildLabels(); err == nil {
+			t.Errorf("%s: expected the build ID to be rejected", id)
+		}
+	}
+}
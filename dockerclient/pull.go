@@ -0,0 +1,272 @@
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	docker "github.com/fsouza/go-dockerclient"
+	dockerregistrytypes "github.com/moby/moby/api/types/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/klog"
+)
+
+var imageIDRegexp = regexp.MustCompile("^(sha256:)?[a-f0-9]{64}$")
+
+// PullPolicy controls when images are pulled from registries.
+type PullPolicy string
+
+const (
+	// PullAlways pulls images even if they are already present.
+	PullAlways PullPolicy = "always"
+	// PullIfMissing pulls images only if they are not present.
+	PullIfMissing PullPolicy = "missing"
+	// PullNever never pulls images, and fails the build if an image is
+	// not present.
+	PullNever PullPolicy = "never"
+	// PullIfNewer pulls images which are not present, or whose digest in
+	// the registry doesn't match the local copy.
+	PullIfNewer PullPolicy = "newer"
+)
+
+// ParsePullPolicy parses the name of a pull policy.
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	switch policy := PullPolicy(strings.ToLower(s)); policy {
+	case PullAlways, PullIfMissing, PullNever, PullIfNewer:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unrecognized pull policy %q, must be one of %q, %q, %q, or %q", s, PullAlways, PullIfMissing, PullNever, PullIfNewer)
+}
+
+// pullPolicy returns the pull policy to use, taking AllowPull into account if
+// PullPolicy isn't set.
+func (e *ClientExecutor) pullPolicy() PullPolicy {
+	switch {
+	case len(e.PullPolicy) > 0:
+		return e.PullPolicy
+	case e.AllowPull:
+		return PullIfMissing
+	default:
+		return PullNever
+	}
+}
+
+// isImageID returns true if name refers to an image by its ID, which can't be
+// pulled.
+func isImageID(name string) bool {
+	return imageIDRegexp.MatchString(name)
+}
+
+// isImageCurrent returns true if image, which was found locally by looking
+// up name, has the same digest as the image that name refers to in its
+// registry.
+func (e *ClientExecutor) isImageCurrent(name string, image *docker.Image) (bool, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := named.(reference.Canonical); ok {
+		// the content of an image that is referenced by digest can't change
+		return true, nil
+	}
+	distribution, err := e.inspectDistribution(reference.TagNameOnly(named).String())
+	if err != nil {
+		return false, err
+	}
+	for _, repoDigest := range image.RepoDigests {
+		local, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := local.(reference.Canonical); ok && local.Name() == named.Name() && canonical.Digest() == distribution.Descriptor.Digest {
+			return true, nil
+		}
+	}
+	klog.V(4).Infof("Image %s does not match registry digest %s", name, distribution.Descriptor.Digest)
+	return false, nil
+}
+
+// checkImagePlatform returns an error if image, whose architecture has the
+// variant variant, was not built for platform. The variants are only compared
+// if platform names one. Images which don't record an OS, architecture or
+// variant are assumed to match in that respect.
+func checkImagePlatform(image *docker.Image, variant, platform string) error {
+	if len(platform) == 0 || (len(image.OS) == 0 && len(image.Architecture) == 0) {
+		return nil
+	}
+	requested, err := platforms.Parse(platform)
+	if err != nil {
+		return fmt.Errorf("invalid platform %q: %v", platform, err)
+	}
+	requested = platforms.Normalize(requested)
+	local := ocispec.Platform{OS: image.OS, Architecture: image.Architecture, Variant: variant}
+	if len(local.OS) == 0 {
+		local.OS = requested.OS
+	}
+	if len(local.Architecture) == 0 {
+		local.Architecture = requested.Architecture
+	}
+	if len(local.Variant) == 0 {
+		local.Variant = requested.Variant
+	}
+	local = platforms.Normalize(local)
+	if local.OS != requested.OS || local.Architecture != requested.Architecture ||
+		(len(requested.Variant) > 0 && local.Variant != requested.Variant) {
+		return fmt.Errorf("image %s is for %s, not %s", image.ID, platforms.Format(local), platforms.Format(requested))
+	}
+	return nil
+}
+
+// checkImageVariant is like checkImagePlatform, but looks up the variant of
+// image's architecture first, if platform names one.
+func (e *ClientExecutor) checkImageVariant(image *docker.Image, platform string) error {
+	var variant string
+	if len(platform) > 0 {
+		requested, err := platforms.Parse(platform)
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %v", platform, err)
+		}
+		if len(platforms.Normalize(requested).Variant) > 0 {
+			if variant, err = imageVariant(e.Client, image.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return checkImagePlatform(image, variant, platform)
+}
+
+// imageVariant returns the variant of the architecture of the image id. The
+// daemon reports it, but the client's Image type leaves it out, so it is read
+// from the response to the client's own inspection request.
+func imageVariant(client *docker.Client, id string) (string, error) {
+	var body []byte
+	client = withTransport(client, func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusOK || !strings.HasSuffix(req.URL.Path, "/images/"+id+"/json") {
+			return resp, err
+		}
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	})
+	if _, err := client.InspectImage(id); err != nil {
+		return "", fmt.Errorf("unable to inspect image %s: %v", id, err)
+	}
+	var image struct {
+		Variant string
+	}
+	if err := json.Unmarshal(body, &image); err != nil {
+		return "", fmt.Errorf("unable to inspect image %s: %v", id, err)
+	}
+	return image.Variant, nil
+}
+
+// inspectDistribution asks the daemon for the digest of the image name in its
+// registry, with each of the credentials that AuthFn returns for it in turn,
+// so that images in private registries can be looked up.
+func (e *ClientExecutor) inspectDistribution(name string) (*dockerregistrytypes.DistributionInspect, error) {
+	var auths []dockerregistrytypes.AuthConfig
+	if e.AuthFn != nil {
+		auths, _ = e.AuthFn(name)
+	}
+	if len(auths) == 0 {
+		return e.Client.InspectDistribution(name)
+	}
+	var lastErr error
+	for _, auth := range auths {
+		data, err := json.Marshal(auth)
+		if err != nil {
+			return nil, err
+		}
+		header := base64.URLEncoding.EncodeToString(data)
+		client := withTransport(e.Client, func(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set(dockerregistrytypes.AuthHeader, header)
+			return next.RoundTrip(req)
+		})
+		distribution, err := client.InspectDistribution(name)
+		if err == nil {
+			return distribution, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// roundTripperFunc is an http.RoundTripper which calls a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// withTransport returns a copy of client which passes each of its requests to
+// wrap, along with the transport that would otherwise have sent it. The copy's
+// methods still build the requests, with the client's API version and
+// endpoint, so wrap can add to them or read parts of the responses that the
+// methods don't return.
+func withTransport(client *docker.Client, wrap func(req *http.Request, next http.RoundTripper) (*http.Response, error)) *docker.Client {
+	httpClient := &http.Client{}
+	if client.HTTPClient != nil {
+		*httpClient = *client.HTTPClient
+	}
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return wrap(req, next)
+	})
+	copied := *client
+	copied.HTTPClient = httpClient
+	return &copied
+}
+
+// checkImagesPresent returns an error which lists every one of images that is
+// not present, under any of the names that the executor's registries
+// configuration rewrites it to, for use when images can't be pulled.
+func (e *ClientExecutor) checkImagesPresent(images []string) error {
+	var missing []string
+	for _, image := range images {
+		candidates := []string{image}
+		if e.Registries != nil {
+			var err error
+			if candidates, err = e.Registries.Candidates(image); err != nil {
+				return err
+			}
+		}
+		present := false
+		for _, candidate := range candidates {
+			if _, err := e.Client.InspectImage(candidate); err != nil {
+				if err != docker.ErrNoSuchImage {
+					return err
+				}
+				continue
+			}
+			present = true
+			break
+		}
+		if !present {
+			missing = append(missing, image)
+		}
+	}
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("image %s is not present and the pull policy is %q", missing[0], PullNever)
+	default:
+		return fmt.Errorf("images %s are not present and the pull policy is %q", strings.Join(missing, ", "), PullNever)
+	}
+}
@@ -0,0 +1,266 @@
+package dockerclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	dockerregistrytypes "github.com/moby/moby/api/types/registry"
+)
+
+func TestParsePullPolicy(t *testing.T) {
+	for _, s := range []string{"always", "missing", "never", "newer", "Always"} {
+		policy, err := ParsePullPolicy(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+		if string(policy) != strings.ToLower(s) {
+			t.Errorf("%s: got %q", s, policy)
+		}
+	}
+	if _, err := ParsePullPolicy("sometimes"); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+}
+
+func TestPullPolicyDefault(t *testing.T) {
+	e := NewClientExecutor(nil)
+	if policy := e.pullPolicy(); policy != PullNever {
+		t.Errorf("expected %q without AllowPull, got %q", PullNever, policy)
+	}
+	e.AllowPull = true
+	if policy := e.pullPolicy(); policy != PullIfMissing {
+		t.Errorf("expected %q with AllowPull, got %q", PullIfMissing, policy)
+	}
+	e.PullPolicy = PullAlways
+	if policy := e.pullPolicy(); policy != PullAlways {
+		t.Errorf("expected %q, got %q", PullAlways, policy)
+	}
+}
+
+func TestIsImageID(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	for name, expected := range map[string]bool{
+		id:                        true,
+		"sha256:" + id:            true,
+		"busybox":                 false,
+		"busybox@sha256:" + id:    false,
+		"sha256:" + id[:12]:       false,
+		strings.ToUpper(id):       false,
+		"docker.io/library/" + id: false,
+	} {
+		if isImageID(name) != expected {
+			t.Errorf("%s: expected %v", name, expected)
+		}
+	}
+}
+
+// fakeImageDaemon serves image and distribution inspection requests.
+type fakeImageDaemon struct {
+	images map[string]*docker.Image
+	// variants are the variants of the architectures of images, which
+	// docker.Image can't hold
+	variants       map[string]string
+	registryDigest string
+	// digests, if set, are the only images that the registries hold, in
+	// place of registryDigest
+	digests map[string]string
+	// username, if set, is the user whose credentials the registries
+	// require
+	username string
+}
+
+func (d *fakeImageDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/images/") && strings.HasSuffix(r.URL.Path, "/json"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		image, ok := d.images[name]
+		if !ok {
+			http.Error(w, "no such image", http.StatusNotFound)
+			return
+		}
+		if variant, ok := d.variants[name]; ok {
+			json.NewEncoder(w).Encode(struct {
+				*docker.Image
+				Variant string
+			}{image, variant})
+			return
+		}
+		json.NewEncoder(w).Encode(image)
+	case strings.HasPrefix(r.URL.Path, "/distribution/"):
+		if len(d.username) > 0 {
+			var auth dockerregistrytypes.AuthConfig
+			data, _ := base64.URLEncoding.DecodeString(r.Header.Get(dockerregistrytypes.AuthHeader))
+			if err := json.Unmarshal(data, &auth); err != nil || auth.Username != d.username {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		registryDigest := d.registryDigest
+		if d.digests != nil {
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/distribution/"), "/json")
+			var ok bool
+			if registryDigest, ok = d.digests[name]; !ok {
+				http.Error(w, "manifest unknown", http.StatusNotFound)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Descriptor": map[string]interface{}{
+				"mediaType": "application/vnd.oci.image.index.v1+json",
+				"digest":    registryDigest,
+				"size":      1,
+			},
+		})
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+func TestCheckImagesPresent(t *testing.T) {
+	daemon := &fakeImageDaemon{images: map[string]*docker.Image{"present": {ID: "sha256:1"}}}
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	if err := e.checkImagesPresent([]string{"present"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = e.checkImagesPresent([]string{"missing1", "present", "missing2"})
+	if err == nil || !strings.Contains(err.Error(), "missing1, missing2") {
+		t.Errorf("expected both missing images to be listed, got %v", err)
+	}
+}
+
+func TestIsImageCurrent(t *testing.T) {
+	current := "sha256:" + strings.Repeat("a", 64)
+	stale := "sha256:" + strings.Repeat("b", 64)
+	daemon := &fakeImageDaemon{registryDigest: current}
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+
+	for _, tc := range []struct {
+		name        string
+		repoDigests []string
+		expected    bool
+	}{
+		{name: "busybox", repoDigests: []string{"busybox@" + current}, expected: true},
+		{name: "docker.io/library/busybox:latest", repoDigests: []string{"busybox@" + current}, expected: true},
+		{name: "busybox", repoDigests: []string{"busybox@" + stale}, expected: false},
+		{name: "busybox", repoDigests: []string{"example.com/busybox@" + current}, expected: false},
+		{name: "busybox", expected: false},
+		{name: "busybox@" + stale, expected: true},
+	} {
+		ok, err := e.isImageCurrent(tc.name, &docker.Image{RepoDigests: tc.repoDigests})
+		if err != nil {
+			t.Errorf("%s %v: %v", tc.name, tc.repoDigests, err)
+			continue
+		}
+		if ok != tc.expected {
+			t.Errorf("%s %v: expected %v", tc.name, tc.repoDigests, tc.expected)
+		}
+	}
+}
+
+func TestInspectDistributionCredentials(t *testing.T) {
+	current := "sha256:" + strings.Repeat("a", 64)
+	server := httptest.NewServer(&fakeImageDaemon{registryDigest: current, username: "private"})
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	if _, err := e.inspectDistribution("example.com/private/app:latest"); err == nil {
+		t.Fatal("expected the lookup to fail without credentials")
+	}
+	var requested []string
+	e.AuthFn = func(name string) ([]dockerregistrytypes.AuthConfig, bool) {
+		requested = append(requested, name)
+		return []dockerregistrytypes.AuthConfig{{Username: "other"}, {Username: "private", Password: "secret"}}, true
+	}
+	ok, err := e.isImageCurrent("example.com/private/app", &docker.Image{RepoDigests: []string{"example.com/private/app@" + current}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("expected the image to be current")
+	}
+	if expected := []string{"example.com/private/app:latest"}; !reflect.DeepEqual(requested, expected) {
+		t.Errorf("expected credentials to be requested for %v, got %v", expected, requested)
+	}
+}
+
+func TestCheckImagePlatform(t *testing.T) {
+	for _, tc := range []struct {
+		os, arch, variant, platform string
+		match                       bool
+	}{
+		{os: "linux", arch: "amd64", platform: "", match: true},
+		{os: "linux", arch: "amd64", platform: "linux/amd64", match: true},
+		{os: "linux", arch: "arm64", platform: "linux/arm64/v8", match: true},
+		{os: "linux", arch: "aarch64", platform: "linux/arm64", match: true},
+		{os: "linux", arch: "x86_64", platform: "linux/amd64", match: true},
+		{os: "", arch: "", platform: "linux/arm64", match: true},
+		{os: "", arch: "arm64", platform: "linux/arm64", match: true},
+		{os: "linux", arch: "amd64", platform: "linux/arm64", match: false},
+		{os: "windows", arch: "amd64", platform: "linux/amd64", match: false},
+		{os: "linux", arch: "arm", platform: "linux/arm64", match: false},
+		{os: "linux", arch: "arm", variant: "v7", platform: "linux/arm/v7", match: true},
+		{os: "linux", arch: "arm", variant: "7", platform: "linux/arm", match: true},
+		{os: "linux", arch: "arm", platform: "linux/arm/v6", match: true},
+		{os: "linux", arch: "arm64", variant: "v8", platform: "linux/arm64", match: true},
+		{os: "linux", arch: "amd64", variant: "v3", platform: "linux/amd64", match: true},
+		{os: "linux", arch: "arm", variant: "v6", platform: "linux/arm/v7", match: false},
+		{os: "linux", arch: "arm", variant: "v7", platform: "linux/arm", match: true},
+		{os: "linux", arch: "arm", variant: "v6", platform: "linux/arm", match: false},
+		{os: "linux", arch: "arm64", variant: "v8", platform: "linux/arm64/v9", match: false},
+	} {
+		err := checkImagePlatform(&docker.Image{ID: "sha256:1", OS: tc.os, Architecture: tc.arch}, tc.variant, tc.platform)
+		if (err == nil) != tc.match {
+			t.Errorf("%s/%s/%s for %q: expected match=%v, got %v", tc.os, tc.arch, tc.variant, tc.platform, tc.match, err)
+		}
+	}
+	if err := checkImagePlatform(&docker.Image{OS: "linux", Architecture: "amd64"}, "", "linux/amd64/v2/extra"); err == nil {
+		t.Errorf("expected an error for an invalid platform")
+	}
+}
+
+func TestCheckImageVariant(t *testing.T) {
+	daemon := &fakeImageDaemon{
+		images: map[string]*docker.Image{
+			"sha256:1": {ID: "sha256:1", OS: "linux", Architecture: "arm"},
+		},
+		variants: map[string]string{"sha256:1": "v6"},
+	}
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	image := daemon.images["sha256:1"]
+	if err := e.checkImageVariant(image, "linux/arm/v6"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := e.checkImageVariant(image, "linux/arm/v7"); err == nil || !strings.Contains(err.Error(), "linux/arm/v6") {
+		t.Errorf("expected the variants not to match, got %v", err)
+	}
+	if err := e.checkImageVariant(&docker.Image{ID: "sha256:2", OS: "linux", Architecture: "arm"}, "linux/arm/v7"); err == nil {
+		t.Errorf("expected an error for an image that can't be inspected")
+	}
+}
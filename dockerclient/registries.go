@@ -0,0 +1,236 @@
+package dockerclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/distribution/reference"
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+)
+
+const (
+	// OriginalBaseImageLabel records the name that a Dockerfile used for
+	// its base image when that name was rewritten by the executor's
+	// registries configuration.
+	OriginalBaseImageLabel = "io.openshift.imagebuilder.base-image.original-name"
+	// ResolvedBaseImageLabel records the name that a base image was
+	// actually loaded as when its name was rewritten.
+	ResolvedBaseImageLabel = "io.openshift.imagebuilder.base-image.resolved-name"
+)
+
+// RegistriesConfig controls where images are pulled from. Its format is a
+// subset of the containers-registries.conf(5) format: short names are
+// resolved using aliases, or else by trying each of a list of registries, and
+// the names of images in a registry can be rewritten to use a different
+// location, with mirrors which are tried first.
+type RegistriesConfig struct {
+	// UnqualifiedSearchRegistries are tried, in order, for names which
+	// don't include a registry and don't have an alias. If it is empty,
+	// such names refer to docker.io.
+	UnqualifiedSearchRegistries []string `toml:"unqualified-search-registries"`
+	// Registries describe how to pull images whose names begin with a
+	// prefix. The longest matching prefix is used.
+	Registries []RegistryConfig `toml:"registry"`
+	// Aliases map short names to the fully-qualified names they refer to.
+	Aliases map[string]string `toml:"aliases"`
+}
+
+// RegistryConfig describes how to pull images whose names begin with Prefix.
+type RegistryConfig struct {
+	// Prefix is a registry, optionally followed by a repository path.
+	Prefix string `toml:"prefix"`
+	// Location, if set, replaces Prefix in the names of images which are
+	// pulled from this registry.
+	Location string `toml:"location"`
+	// Mirrors are tried, in order, before Location.
+	Mirrors []MirrorConfig `toml:"mirror"`
+}
+
+// MirrorConfig is an alternate location for the images in a registry.
+type MirrorConfig struct {
+	Location string `toml:"location"`
+}
+
+// ReadRegistriesConfig reads a registries configuration file.
+func ReadRegistriesConfig(path string) (*RegistriesConfig, error) {
+	var config RegistriesConfig
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return nil, fmt.Errorf("unable to read registries configuration %s: %v", path, err)
+	}
+	for _, registry := range config.Registries {
+		if len(registry.Prefix) == 0 && len(registry.Location) == 0 {
+			return nil, fmt.Errorf("registries configuration %s has a registry with neither a prefix nor a location", path)
+		}
+	}
+	return &config, nil
+}
+
+// AddMirror adds location as a mirror for the images whose names begin with
+// prefix, to be tried after any mirrors which were already added.
+func (c *RegistriesConfig) AddMirror(prefix, location string) {
+	for i := range c.Registries {
+		if c.Registries[i].prefix() == prefix {
+			c.Registries[i].Mirrors = append(c.Registries[i].Mirrors, MirrorConfig{Location: location})
+			return
+		}
+	}
+	c.Registries = append(c.Registries, RegistryConfig{Prefix: prefix, Mirrors: []MirrorConfig{{Location: location}}})
+}
+
+// prefix returns the prefix that the registry applies to, which defaults to
+// its location.
+func (r RegistryConfig) prefix() string {
+	if len(r.Prefix) > 0 {
+		return r.Prefix
+	}
+	return r.Location
+}
+
+// Candidates returns the names that the image called name should be loaded
+// as, in the order that they should be tried.
+func (c *RegistriesConfig) Candidates(name string) ([]string, error) {
+	if isImageID(name) {
+		return []string{name}, nil
+	}
+	qualified, err := c.qualify(name)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	seen := make(map[string]struct{})
+	for _, named := range qualified {
+		for _, candidate := range c.locations(named) {
+			if _, ok := seen[candidate]; !ok {
+				seen[candidate] = struct{}{}
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// qualify returns the fully-qualified names that name could refer to.
+func (c *RegistriesConfig) qualify(name string) ([]reference.Named, error) {
+	repository, suffix := splitReferenceSuffix(name)
+	if alias, ok := c.Aliases[repository]; ok {
+		repository = alias
+	} else if !hasRegistry(repository) && len(c.UnqualifiedSearchRegistries) > 0 {
+		var qualified []reference.Named
+		for _, registry := range c.UnqualifiedSearchRegistries {
+			named, err := reference.ParseNormalizedNamed(registry + "/" + repository + suffix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid image name %q: %v", name, err)
+			}
+			qualified = append(qualified, named)
+		}
+		return qualified, nil
+	}
+	named, err := reference.ParseNormalizedNamed(repository + suffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %q: %v", name, err)
+	}
+	return []reference.Named{named}, nil
+}
+
+// locations returns the names to try for a fully-qualified name: its mirrors,
+// and then its rewritten location.
+func (c *RegistriesConfig) locations(named reference.Named) []string {
+	_, suffix := splitReferenceSuffix(reference.TagNameOnly(named).String())
+	repository := named.Name()
+	var registry *RegistryConfig
+	for i := range c.Registries {
+		prefix := c.Registries[i].prefix()
+		if repository != prefix && !strings.HasPrefix(repository, prefix+"/") {
+			continue
+		}
+		if registry == nil || len(prefix) > len(registry.prefix()) {
+			registry = &c.Registries[i]
+		}
+	}
+	if registry == nil {
+		return []string{reference.FamiliarString(named)}
+	}
+	rest := strings.TrimPrefix(repository, registry.prefix())
+	var locations []string
+	for _, mirror := range registry.Mirrors {
+		locations = append(locations, mirror.Location+rest+suffix)
+	}
+	location := registry.Location
+	if len(location) == 0 {
+		location = registry.prefix()
+	}
+	return append(locations, location+rest+suffix)
+}
+
+// splitReferenceSuffix splits name into its repository and its tag and
+// digest, which begins with ":" or "@".
+func splitReferenceSuffix(name string) (string, string) {
+	repository := name
+	var suffix string
+	if i := strings.Index(repository, "@"); i >= 0 {
+		repository, suffix = repository[:i], repository[i:]
+	}
+	if i := strings.LastIndex(repository, ":"); i >= 0 && !strings.Contains(repository[i:], "/") {
+		repository, suffix = repository[:i], repository[i:]+suffix
+	}
+	return repository, suffix
+}
+
+// hasRegistry returns true if the repository name begins with a registry.
+func hasRegistry(repository string) bool {
+	first, _, ok := strings.Cut(repository, "/")
+	return ok && (strings.ContainsAny(first, ".:") || first == "localhost")
+}
+
+// loadImageCandidates loads the image called from, or the first of the
+// names that the executor's registries configuration rewrites it to which
+// can be loaded, and returns the name that it was loaded as.
+func (e *ClientExecutor) loadImageCandidates(from string, platform string) (string, *docker.Image, error) {
+	policy := e.pullPolicy()
+	if isImageID(from) {
+		policy = PullNever
+	}
+	if e.Registries == nil {
+		image, err := e.loadImage(from, platform, policy)
+		return from, image, err
+	}
+	candidates, err := e.Registries.Candidates(from)
+	if err != nil {
+		return "", nil, err
+	}
+	var errs []error
+	for _, candidate := range candidates {
+		image, err := e.loadImage(candidate, platform, policy)
+		if err == nil {
+			if candidate != from {
+				klog.V(4).Infof("Loaded %s as %s", from, candidate)
+			}
+			return candidate, image, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return "", nil, errs[0]
+	}
+	return "", nil, fmt.Errorf("unable to load %s as any of %s: %w", from, strings.Join(candidates, ", "), errors.Join(errs...))
+}
+
+// rewrittenBaseImageLabels returns the labels which record that the stage's
+// base image was loaded using a different name than the one it was given,
+// because the registries configuration rewrote it. Pinning the name to a
+// digest from the lock file doesn't count as rewriting it.
+func (e *ClientExecutor) rewrittenBaseImageLabels(labels map[string]string) map[string]string {
+	if len(e.originalFrom) == 0 || e.resolvedFrom == e.lockedReference(e.originalFrom) {
+		return labels
+	}
+	merged := make(map[string]string, len(labels)+2)
+	for k, v := range labels {
+		merged[k] = v
+	}
+	merged[OriginalBaseImageLabel] = e.originalFrom
+	merged[ResolvedBaseImageLabel] = e.resolvedFrom
+	return merged
+}
@@ -0,0 +1,118 @@
+package dockerclient
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestReadRegistriesConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registries.conf")
+	if err := os.WriteFile(path, []byte(`unqualified-search-registries = ["registry.internal", "docker.io"]
+
+[[registry]]
+prefix = "docker.io"
+[[registry.mirror]]
+location = "mirror.internal/dockerhub"
+[[registry.mirror]]
+location = "backup.internal/dockerhub"
+
+[[registry]]
+prefix = "quay.io/team"
+location = "quay.internal/team"
+
+[aliases]
+"golang" = "docker.io/library/golang"
+"tools" = "quay.io/team/tools"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ReadRegistriesConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddMirror("quay.io", "mirror.internal/quay")
+
+	for name, expected := range map[string][]string{
+		"golang:1.22": {"mirror.internal/dockerhub/library/golang:1.22", "backup.internal/dockerhub/library/golang:1.22", "docker.io/library/golang:1.22"},
+		"tools":       {"quay.internal/team/tools:latest"},
+		"busybox":     {"registry.internal/busybox", "mirror.internal/dockerhub/library/busybox:latest", "backup.internal/dockerhub/library/busybox:latest", "docker.io/library/busybox:latest"},
+		"quay.io/other/tools@sha256:" + strings.Repeat("a", 64): {"mirror.internal/quay/other/tools@sha256:" + strings.Repeat("a", 64), "quay.io/other/tools@sha256:" + strings.Repeat("a", 64)},
+		"example.com:5000/app:v1":                               {"example.com:5000/app:v1"},
+		strings.Repeat("0123456789abcdef", 4):                   {strings.Repeat("0123456789abcdef", 4)},
+	} {
+		candidates, err := config.Candidates(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(candidates, expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, candidates)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("[[registry]]\ninsecure = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRegistriesConfig(path); err == nil {
+		t.Errorf("expected an error for a registry without a prefix or location")
+	}
+}
+
+func TestLoadImageCandidates(t *testing.T) {
+	daemon := &fakeImageDaemon{images: map[string]*docker.Image{
+		"backup.internal/dockerhub/library/golang:1.22": {ID: "sha256:1"},
+	}}
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewClientExecutor(client)
+	e.PullPolicy = PullNever
+	e.Registries = &RegistriesConfig{}
+	e.Registries.AddMirror("docker.io", "mirror.internal/dockerhub")
+	e.Registries.AddMirror("docker.io", "backup.internal/dockerhub")
+
+	name, image, err := e.loadImageCandidates("golang:1.22", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "backup.internal/dockerhub/library/golang:1.22" || image.ID != "sha256:1" {
+		t.Errorf("unexpected image %s %s", name, image.ID)
+	}
+	if _, _, err := e.loadImageCandidates("busybox", ""); err == nil || !strings.Contains(err.Error(), "mirror.internal/dockerhub/library/busybox:latest") {
+		t.Errorf("expected an error listing the candidates, got %v", err)
+	}
+	if err := e.checkImagesPresent([]string{"golang:1.22"}); err != nil {
+		t.Errorf("expected golang:1.22 to be present under a mirror's name: %v", err)
+	}
+
+	e.originalFrom, e.resolvedFrom = "golang:1.22", name
+	labels := e.rewrittenBaseImageLabels(map[string]string{"a": "b"})
+	expected := map[string]string{"a": "b", OriginalBaseImageLabel: "golang:1.22", ResolvedBaseImageLabel: name}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+	e.resolvedFrom = e.originalFrom
+	if labels := e.rewrittenBaseImageLabels(nil); labels != nil {
+		t.Errorf("expected no labels for an image that wasn't rewritten, got %v", labels)
+	}
+	e.LockFile = &LockFile{Version: lockFileVersion, Images: map[string]digest.Digest{
+		"docker.io/library/golang:1.22": digest.Digest("sha256:" + strings.Repeat("a", 64)),
+	}}
+	e.resolvedFrom = e.lockedReference(e.originalFrom)
+	if e.resolvedFrom == e.originalFrom {
+		t.Fatalf("expected %s to be locked", e.originalFrom)
+	}
+	if labels := e.rewrittenBaseImageLabels(nil); labels != nil {
+		t.Errorf("expected no labels for an image that was only locked, got %v", labels)
+	}
+}
@@ -0,0 +1,238 @@
+package dockerclient
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// StepStatus is the outcome of a step of a build.
+type StepStatus string
+
+const (
+	// StepRan is the status of steps which were performed. A FROM step
+	// ran if its base image was pulled.
+	StepRan StepStatus = "ran"
+	// StepCached is the status of FROM steps whose base image was already
+	// present, so that it wasn't pulled. The executor doesn't otherwise
+	// cache steps.
+	StepCached StepStatus = "cached"
+	// StepSkipped is the status of steps which were not performed, because
+	// an earlier step failed, or because they were unrecognized and
+	// ignored.
+	StepSkipped StepStatus = "skipped"
+	// StepFailed is the status of a step which failed.
+	StepFailed StepStatus = "failed"
+)
+
+// BuildReport records what happened during a build, for each of its stages,
+// and for each of the instructions in those stages. Set an executor's Report
+// to have it filled in. Durations are in nanoseconds.
+type BuildReport struct {
+	// Platform is the platform that was built, if one was specified.
+	Platform string        `json:"platform,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	// ImageID and ImageSize describe the built image.
+	ImageID   string `json:"imageID,omitempty"`
+	ImageSize int64  `json:"imageSize,omitempty"`
+	// Error is the reason the build failed, if it did.
+	Error  string         `json:"error,omitempty"`
+	Stages []*StageReport `json:"stages,omitempty"`
+	// Platforms are the reports for each platform, if more than one
+	// platform was built.
+	Platforms []*BuildReport `json:"platforms,omitempty"`
+}
+
+// StageReport records what happened during a stage of a build.
+type StageReport struct {
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+	// ImageID and ImageSize describe the image that the stage was
+	// committed as, if it was.
+	ImageID   string        `json:"imageID,omitempty"`
+	ImageSize int64         `json:"imageSize,omitempty"`
+	Steps     []*StepReport `json:"steps"`
+
+	// steps maps the instructions of the stage to their reports.
+	steps map[*parser.Node]*StepReport
+}
+
+// StepReport records what happened during an instruction of a build.
+type StepReport struct {
+	Command   string        `json:"command"`
+	Original  string        `json:"original"`
+	StartLine int           `json:"startLine"`
+	Status    StepStatus    `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	// BytesUploaded is the size of the archives that were uploaded to the
+	// build container by a COPY or ADD instruction, or to stage the build
+	// context by a FROM instruction.
+	BytesUploaded int64 `json:"bytesUploaded,omitempty"`
+	// ExitCode is the exit code of the command of a RUN instruction.
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// WriteReport writes report to the file at path, as JSON.
+func WriteReport(path string, report *BuildReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// addStage adds a report for the stage whose instructions are the children of
+// node, in which each of them is skipped until it is performed.
+func (r *BuildReport) addStage(name string, position int, node *parser.Node) *StageReport {
+	stage := &StageReport{
+		Name:     name,
+		Position: position,
+		Steps:    []*StepReport{},
+		steps:    make(map[*parser.Node]*StepReport),
+	}
+	for _, child := range node.Children {
+		step := &StepReport{
+			Command:   child.Value,
+			Original:  child.Original,
+			StartLine: child.StartLine,
+			Status:    StepSkipped,
+		}
+		stage.Steps = append(stage.Steps, step)
+		stage.steps[child] = step
+	}
+	r.Stages = append(r.Stages, stage)
+	return stage
+}
+
+// forPlatform adds a report for the build for platform.
+func (r *BuildReport) forPlatform(platform string) *BuildReport {
+	if r == nil {
+		return nil
+	}
+	report := &BuildReport{Platform: platform}
+	r.Platforms = append(r.Platforms, report)
+	return report
+}
+
+// start records when the build started.
+func (r *BuildReport) start() {
+	if r != nil {
+		r.Started = time.Now()
+	}
+}
+
+// finish records how long the build took, and the reason it failed, if it
+// did.
+func (r *BuildReport) finish(err error) {
+	if r == nil {
+		return
+	}
+	r.Duration = time.Since(r.Started)
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// ensureStageReport adds a report for the stage that the executor builds,
+// whose instructions are the children of node, if it is reporting and hasn't
+// done so already.
+func (e *ClientExecutor) ensureStageReport(node *parser.Node) {
+	if e.Report == nil || e.stageReport != nil {
+		return
+	}
+	e.stageReport = e.Report.addStage(e.Name, len(e.Report.Stages), node)
+}
+
+// stepFor returns the report of the step for node, if there is one.
+func (s *StageReport) stepFor(node *parser.Node) *StepReport {
+	if s == nil {
+		return nil
+	}
+	return s.steps[node]
+}
+
+// beginStep starts recording step, if it is not nil, and returns a function
+// that records its outcome.
+func (e *ClientExecutor) beginStep(step *StepReport) func(error) {
+	if step == nil {
+		return func(error) {}
+	}
+	step.Status = StepRan
+	if strings.EqualFold(step.Command, command.From) {
+		// until the base image is pulled
+		step.Status = StepCached
+	}
+	e.stepReport = step
+	started := time.Now()
+	return func(err error) {
+		step.Duration = time.Since(started)
+		if err != nil {
+			step.Status = StepFailed
+			step.Error = err.Error()
+		}
+		e.stepReport = nil
+	}
+}
+
+// reportStepStatus records status for the step in progress, if the executor
+// is reporting.
+func (e *ClientExecutor) reportStepStatus(status StepStatus) {
+	if e.stepReport != nil {
+		e.stepReport.Status = status
+	}
+}
+
+// reportExitCode records the exit code of the command that the step in
+// progress ran, if the executor is reporting.
+func (e *ClientExecutor) reportExitCode(code int) {
+	if e.stepReport != nil {
+		e.stepReport.ExitCode = &code
+	}
+}
+
+// countUploads returns a reader which records the number of bytes read from r
+// for the step in progress, if the executor is reporting.
+func (e *ClientExecutor) countUploads(r io.Reader) io.Reader {
+	if e.stepReport == nil {
+		return r
+	}
+	return &countingReader{Reader: r, count: &e.stepReport.BytesUploaded}
+}
+
+// countingReader adds the number of bytes that are read from it to count.
+type countingReader struct {
+	io.Reader
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	*r.count += int64(n)
+	return n, err
+}
+
+// reportCommitted records image as the image that the stage was committed as,
+// if the executor is reporting.
+func (e *ClientExecutor) reportCommitted(image *docker.Image) {
+	if e.stageReport == nil {
+		return
+	}
+	e.stageReport.ImageID = image.ID
+	// the daemon only returns the ID of a committed image
+	inspected, err := e.Client.InspectImage(image.ID)
+	if err != nil {
+		klog.V(4).Infof("Unable to determine the size of image %s: %v", image.ID, err)
+		return
+	}
+	e.stageReport.ImageSize = inspected.Size
+}
@@ -0,0 +1,142 @@
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestBuildReport(t *testing.T) {
+	dockerfile := `FROM busybox AS build
+COPY . /src
+RUN make
+FROM busybox
+COPY --from=build /src/out /out
+HEALTHCHECK NONE
+`
+	node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &BuildReport{}
+	for _, stage := range stages {
+		report.addStage(stage.Name, stage.Position, stage.Node)
+	}
+	if len(report.Stages) != 2 {
+		t.Fatalf("expected a report for each stage, got %d", len(report.Stages))
+	}
+	for _, stage := range report.Stages {
+		for _, step := range stage.Steps {
+			if step.Status != StepSkipped {
+				t.Errorf("expected %q to be skipped until it is performed, got %s", step.Original, step.Status)
+			}
+		}
+	}
+
+	// the first stage pulls its base image, uploads the context and runs a
+	// command which fails
+	first := stages[0].Node.Children
+	e := &ClientExecutor{Report: report, stageReport: report.Stages[0]}
+	finish := e.beginStep(e.stageReport.stepFor(first[0]))
+	e.reportStepStatus(StepRan)
+	finish(nil)
+	finish = e.beginStep(e.stageReport.stepFor(first[1]))
+	if _, err := io.Copy(io.Discard, e.countUploads(strings.NewReader("context"))); err != nil {
+		t.Fatal(err)
+	}
+	finish(nil)
+	finish = e.beginStep(e.stageReport.stepFor(first[2]))
+	e.reportExitCode(2)
+	finish(errors.New("running 'make' failed with exit code 2"))
+
+	// the second stage's base image is present, and its unrecognized
+	// instruction is ignored
+	second := stages[1].Node.Children
+	e.stageReport = report.Stages[1]
+	e.beginStep(e.stageReport.stepFor(second[0]))(nil)
+	e.beginStep(e.stageReport.stepFor(second[1]))(nil)
+	finish = e.beginStep(e.stageReport.stepFor(second[2]))
+	e.reportStepStatus(StepSkipped)
+	finish(nil)
+	if e.stepReport != nil {
+		t.Errorf("expected no step to be in progress, got %q", e.stepReport.Original)
+	}
+	if n, err := io.Copy(io.Discard, e.countUploads(strings.NewReader("outside"))); err != nil || n != 7 {
+		t.Errorf("expected uploads outside of a step to be passed through, got %d, %v", n, err)
+	}
+
+	expected := [][]StepStatus{
+		{StepRan, StepRan, StepFailed},
+		{StepCached, StepRan, StepSkipped},
+	}
+	for i, stage := range report.Stages {
+		for j, step := range stage.Steps {
+			if step.Status != expected[i][j] {
+				t.Errorf("expected %q to be %s, got %s", step.Original, expected[i][j], step.Status)
+			}
+		}
+	}
+	if copied := report.Stages[0].Steps[1]; copied.BytesUploaded != int64(len("context")) {
+		t.Errorf("expected %q to upload %d bytes, got %d", copied.Original, len("context"), copied.BytesUploaded)
+	}
+	run := report.Stages[0].Steps[2]
+	if run.ExitCode == nil || *run.ExitCode != 2 || len(run.Error) == 0 {
+		t.Errorf("expected %q to fail with exit code 2, got %v, %q", run.Original, run.ExitCode, run.Error)
+	}
+	if run.StartLine != 3 {
+		t.Errorf("expected %q to start on line 3, got %d", run.Original, run.StartLine)
+	}
+
+	path := filepath.Join(t.TempDir(), "build.json")
+	if err := WriteReport(path, report); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written BuildReport
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written.Stages) != 2 || len(written.Stages[1].Steps) != 3 || written.Stages[1].Steps[2].Original != "HEALTHCHECK NONE" {
+		t.Errorf("unexpected report written:\n%s", data)
+	}
+}
+
+func TestBuildReportForPlatform(t *testing.T) {
+	var none *BuildReport
+	if none.forPlatform("linux/arm64") != nil {
+		t.Errorf("expected no report for a platform of a build without one")
+	}
+	none.start()
+	none.finish(errors.New("failed"))
+
+	report := &BuildReport{}
+	report.start()
+	platform := report.forPlatform("linux/arm64")
+	platform.start()
+	platform.finish(errors.New("failed"))
+	report.finish(nil)
+	if len(report.Platforms) != 1 || report.Platforms[0] != platform || platform.Platform != "linux/arm64" {
+		t.Fatalf("expected the platform's report to be added to the build's, got %#v", report.Platforms)
+	}
+	if platform.Error != "failed" || len(report.Error) != 0 {
+		t.Errorf("expected only the platform's report to record the failure, got %q and %q", platform.Error, report.Error)
+	}
+	if report.Started.IsZero() || report.Duration < platform.Duration {
+		t.Errorf("expected the build to be timed, got %s for %s", report.Duration, report.Started)
+	}
+}
@@ -0,0 +1,722 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+)
+
+// SBOMFormat is a format that a software bill of materials can be written in.
+type SBOMFormat string
+
+const (
+	// SBOMFormatSPDX is the JSON form of SPDX 2.3.
+	SBOMFormatSPDX SBOMFormat = "spdx"
+	// SBOMFormatCycloneDX is the JSON form of CycloneDX 1.5.
+	SBOMFormatCycloneDX SBOMFormat = "cyclonedx"
+)
+
+// ParseSBOMFormat parses the name of an SBOM format.
+func ParseSBOMFormat(value string) (SBOMFormat, error) {
+	switch format := SBOMFormat(strings.ToLower(value)); format {
+	case SBOMFormatSPDX, SBOMFormatCycloneDX:
+		return format, nil
+	case "":
+		return SBOMFormatSPDX, nil
+	default:
+		return "", fmt.Errorf("unrecognized SBOM format %q, expected %q or %q", value, SBOMFormatSPDX, SBOMFormatCycloneDX)
+	}
+}
+
+const (
+	dpkgStatusPath    = "var/lib/dpkg/status"
+	dpkgStatusDirPath = "var/lib/dpkg/status.d"
+	apkInstalledPath  = "lib/apk/db/installed"
+)
+
+// rpmDatabasePaths are the files which hold the rpm database, in each of the
+// formats and locations that distributions use.
+var rpmDatabasePaths = []string{
+	"var/lib/rpm/Packages",
+	"var/lib/rpm/Packages.db",
+	"var/lib/rpm/rpmdb.sqlite",
+	"usr/lib/sysimage/rpm/Packages",
+	"usr/lib/sysimage/rpm/Packages.db",
+	"usr/lib/sysimage/rpm/rpmdb.sqlite",
+}
+
+// rpmQueryFormat is the format in which rpm is asked to list packages.
+const rpmQueryFormat = `%{NAME}\t%{EPOCH}\t%{VERSION}\t%{RELEASE}\t%{ARCH}\t%{LICENSE}\n`
+
+// sbomPackage is a package that was found in an image.
+type sbomPackage struct {
+	// Type is the package URL type of the package: deb, apk, rpm, or
+	// golang.
+	Type    string
+	Name    string
+	Version string
+	Arch    string
+	License string
+	// PURL is the package URL which identifies the package.
+	PURL string
+	// Location is the file that the package was found in.
+	Location string
+}
+
+// sbomInventory is what a scan of an image's filesystem found.
+type sbomInventory struct {
+	// Distro and DistroVersion are the ID and VERSION_ID in os-release.
+	Distro, DistroVersion string
+	Packages              []sbomPackage
+	// HasRPMDatabase is true if the image has an rpm database, which can
+	// only be read with rpm.
+	HasRPMDatabase bool
+}
+
+// scanImageFilesystem reads an archive of an image's filesystem, and returns
+// the packages that its dpkg and apk databases list, and the modules that its
+// Go binaries were built from. Binaries are copied to tempDir to be read.
+func scanImageFilesystem(r io.Reader, tempDir string) (*sbomInventory, error) {
+	inventory := &sbomInventory{}
+	var osRelease, libOSRelease []byte
+	var dpkg, apk []sbomPackage
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+h.Name), "/")
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch {
+		case name == "etc/os-release":
+			if osRelease, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		case name == "usr/lib/os-release":
+			if libOSRelease, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		case name == dpkgStatusPath,
+			path.Dir(name) == dpkgStatusDirPath && !strings.HasSuffix(name, ".md5sums"):
+			packages, err := parseDpkgStatus(tr, "/"+name)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read /%s: %v", name, err)
+			}
+			dpkg = append(dpkg, packages...)
+		case name == apkInstalledPath:
+			packages, err := parseApkInstalled(tr, "/"+name)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read /%s: %v", name, err)
+			}
+			apk = append(apk, packages...)
+		case isRPMDatabase(name):
+			inventory.HasRPMDatabase = true
+		case h.Mode&0111 != 0 && h.Size > 4:
+			packages, err := goBinaryPackages(tr, "/"+name, tempDir)
+			if err != nil {
+				return nil, err
+			}
+			inventory.Packages = append(inventory.Packages, packages...)
+		}
+	}
+	if len(osRelease) == 0 {
+		osRelease = libOSRelease
+	}
+	inventory.Distro, inventory.DistroVersion = parseOSRelease(osRelease)
+	for _, pkg := range dpkg {
+		pkg.PURL = packageURL("deb", inventory.Distro, pkg.Name, pkg.Version, "arch", pkg.Arch, "distro", distroQualifier(inventory))
+		inventory.Packages = append(inventory.Packages, pkg)
+	}
+	for _, pkg := range apk {
+		pkg.PURL = packageURL("apk", inventory.Distro, pkg.Name, pkg.Version, "arch", pkg.Arch, "distro", distroQualifier(inventory))
+		inventory.Packages = append(inventory.Packages, pkg)
+	}
+	return inventory, nil
+}
+
+func isRPMDatabase(name string) bool {
+	for _, p := range rpmDatabasePaths {
+		if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// distroQualifier returns the value of the distro qualifier of the package URLs
+// of packages from the image's distribution.
+func distroQualifier(inventory *sbomInventory) string {
+	if len(inventory.Distro) == 0 || len(inventory.DistroVersion) == 0 {
+		return ""
+	}
+	return inventory.Distro + "-" + inventory.DistroVersion
+}
+
+// parseOSRelease returns the ID and VERSION_ID in an os-release file.
+func parseOSRelease(data []byte) (id, versionID string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			id = value
+		case "VERSION_ID":
+			versionID = value
+		}
+	}
+	return id, versionID
+}
+
+// parseDpkgStatus returns the installed packages in a dpkg status file, which
+// was read from location.
+func parseDpkgStatus(r io.Reader, location string) ([]sbomPackage, error) {
+	var packages []sbomPackage
+	fields := make(map[string]string)
+	flush := func() {
+		if len(fields["Package"]) > 0 && (len(fields["Status"]) == 0 || strings.HasSuffix(fields["Status"], " installed")) {
+			packages = append(packages, sbomPackage{
+				Type:     "deb",
+				Name:     fields["Package"],
+				Version:  fields["Version"],
+				Arch:     fields["Architecture"],
+				Location: location,
+			})
+		}
+		fields = make(map[string]string)
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case len(strings.TrimSpace(line)) == 0:
+			flush()
+		case line[0] == ' ' || line[0] == '\t':
+			// a continuation of the previous field, which none of the
+			// fields we use have
+		default:
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return packages, nil
+}
+
+// parseApkInstalled returns the packages in an apk installed database, which
+// was read from location.
+func parseApkInstalled(r io.Reader, location string) ([]sbomPackage, error) {
+	var packages []sbomPackage
+	var pkg sbomPackage
+	flush := func() {
+		if len(pkg.Name) > 0 {
+			packages = append(packages, pkg)
+		}
+		pkg = sbomPackage{Type: "apk", Location: location}
+	}
+	flush()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "P":
+			pkg.Name = value
+		case "V":
+			pkg.Version = value
+		case "A":
+			pkg.Arch = value
+		case "L":
+			pkg.License = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return packages, nil
+}
+
+// parseRPMQuery returns the packages which rpm listed in rpmQueryFormat.
+func parseRPMQuery(output []byte, inventory *sbomInventory) []sbomPackage {
+	var packages []sbomPackage
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 6 {
+			continue
+		}
+		name, epoch, version, release, arch, license := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5]
+		// the keys that packages are signed with are listed as packages
+		if name == "gpg-pubkey" || arch == "(none)" {
+			continue
+		}
+		if epoch == "(none)" {
+			epoch = ""
+		}
+		if license == "(none)" {
+			license = ""
+		}
+		pkg := sbomPackage{
+			Type:     "rpm",
+			Name:     name,
+			Version:  version + "-" + release,
+			Arch:     arch,
+			License:  license,
+			Location: "rpmdb",
+		}
+		if len(epoch) > 0 {
+			pkg.Version = epoch + ":" + pkg.Version
+		}
+		pkg.PURL = packageURL("rpm", inventory.Distro, name, version+"-"+release, "arch", arch, "epoch", epoch, "distro", distroQualifier(inventory))
+		packages = append(packages, pkg)
+	}
+	return packages
+}
+
+// goBinaryPackages returns the modules that the file at location, whose
+// contents r holds, was built from, if it is a Go binary.
+func goBinaryPackages(r io.Reader, location, tempDir string) ([]sbomPackage, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, nil
+	}
+	// ELF, PE, and the Mach-O formats
+	switch {
+	case bytes.Equal(magic, []byte("\x7fELF")),
+		bytes.HasPrefix(magic, []byte("MZ")),
+		bytes.Equal(magic, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.Equal(magic, []byte{0xce, 0xfa, 0xed, 0xfe}),
+		bytes.Equal(magic, []byte{0xfe, 0xed, 0xfa, 0xcf}), bytes.Equal(magic, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+	default:
+		return nil, nil
+	}
+	f, err := os.CreateTemp(tempDir, "imagebuilder-sbom-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, br); err != nil {
+		return nil, err
+	}
+	info, err := buildinfo.Read(f)
+	if err != nil {
+		// not a Go binary
+		return nil, nil
+	}
+	packages := []sbomPackage{{
+		Type:     "golang",
+		Name:     "stdlib",
+		Version:  info.GoVersion,
+		PURL:     packageURL("golang", "", "stdlib", info.GoVersion),
+		Location: location,
+	}}
+	modules := append([]*debug.Module{&info.Main}, info.Deps...)
+	for _, module := range modules {
+		if module.Replace != nil {
+			module = module.Replace
+		}
+		if len(module.Path) == 0 {
+			continue
+		}
+		version := module.Version
+		if version == "(devel)" {
+			version = ""
+		}
+		namespace, name := path.Split(module.Path)
+		packages = append(packages, sbomPackage{
+			Type:     "golang",
+			Name:     module.Path,
+			Version:  version,
+			PURL:     packageURL("golang", strings.TrimSuffix(namespace, "/"), name, version),
+			Location: location,
+		})
+	}
+	return packages, nil
+}
+
+// packageURL returns a package URL, leaving out qualifiers which are given as
+// pairs of names and values, whose values are empty.
+func packageURL(typ, namespace, name, version string, qualifiers ...string) string {
+	var b strings.Builder
+	b.WriteString("pkg:" + typ + "/")
+	if len(namespace) > 0 {
+		for _, segment := range strings.Split(namespace, "/") {
+			b.WriteString(purlEscape(segment) + "/")
+		}
+	}
+	b.WriteString(purlEscape(name))
+	if len(version) > 0 {
+		b.WriteString("@" + purlEscape(version))
+	}
+	separator := "?"
+	for i := 0; i+1 < len(qualifiers); i += 2 {
+		if len(qualifiers[i+1]) == 0 {
+			continue
+		}
+		b.WriteString(separator + qualifiers[i] + "=" + purlEscape(qualifiers[i+1]))
+		separator = "&"
+	}
+	return b.String()
+}
+
+// purlEscape percent-encodes the characters in s which are not unreserved.
+func purlEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '-', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sortedPackages returns packages in a stable order, without duplicates.
+func sortedPackages(packages []sbomPackage) []sbomPackage {
+	sorted := append([]sbomPackage{}, packages...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].PURL != sorted[j].PURL {
+			return sorted[i].PURL < sorted[j].PURL
+		}
+		return sorted[i].Location < sorted[j].Location
+	})
+	var unique []sbomPackage
+	for i, pkg := range sorted {
+		if i > 0 && pkg.PURL == sorted[i-1].PURL {
+			continue
+		}
+		unique = append(unique, pkg)
+	}
+	return unique
+}
+
+// writeSBOM writes a bill of the packages in the image imageID, named name, to
+// w in format, as of created. If the bill is known to be incomplete, omissions
+// describe the packages which are missing from it, and are recorded in it.
+func writeSBOM(w io.Writer, format SBOMFormat, name, imageID string, packages []sbomPackage, omissions []string, created time.Time) error {
+	var document interface{}
+	switch format {
+	case SBOMFormatSPDX, "":
+		document = spdxDocument(name, imageID, packages, omissions, created)
+	case SBOMFormatCycloneDX:
+		document = cycloneDXDocument(name, imageID, packages, omissions, created)
+	default:
+		return fmt.Errorf("unrecognized SBOM format %q", format)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(document)
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+func spdxDocument(name, imageID string, packages []sbomPackage, omissions []string, created time.Time) interface{} {
+	const noAssertion = "NOASSERTION"
+	image := spdxPackage{
+		Name:             name,
+		SPDXID:           "SPDXRef-Image",
+		VersionInfo:      imageID,
+		DownloadLocation: noAssertion,
+		LicenseConcluded: noAssertion,
+		LicenseDeclared:  noAssertion,
+		PrimaryPurpose:   "CONTAINER",
+	}
+	spdxPackages := []spdxPackage{image}
+	relationships := []spdxRelationship{{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: image.SPDXID}}
+	for i, pkg := range packages {
+		p := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d", i+1),
+			VersionInfo:      pkg.Version,
+			DownloadLocation: noAssertion,
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  noAssertion,
+			SourceInfo:       "found in " + pkg.Location,
+			ExternalRefs:     []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: pkg.PURL}},
+		}
+		// package databases don't use SPDX license expressions
+		if len(pkg.License) > 0 {
+			p.Comment = "license: " + pkg.License
+		}
+		spdxPackages = append(spdxPackages, p)
+		relationships = append(relationships, spdxRelationship{SPDXElementID: image.SPDXID, RelationshipType: "CONTAINS", RelatedSPDXElement: p.SPDXID})
+	}
+	document := map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              name,
+		"documentNamespace": ProvenanceBuilderID + "/spdx/" + strings.TrimPrefix(imageID, "sha256:"),
+		"creationInfo": map[string]interface{}{
+			"created":  created.UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: imagebuilder"},
+		},
+		"packages":      spdxPackages,
+		"relationships": relationships,
+	}
+	if len(omissions) > 0 {
+		document["comment"] = "This document is incomplete: " + strings.Join(omissions, "; ")
+	}
+	return document
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+func cycloneDXDocument(name, imageID string, packages []sbomPackage, omissions []string, created time.Time) interface{} {
+	var components []cycloneDXComponent
+	for _, pkg := range packages {
+		component := cycloneDXComponent{
+			Type:       "library",
+			BOMRef:     pkg.PURL,
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			PURL:       pkg.PURL,
+			Properties: []cycloneDXProperty{{Name: "imagebuilder:location", Value: pkg.Location}},
+		}
+		if len(pkg.License) > 0 {
+			var license cycloneDXLicense
+			license.License.Name = pkg.License
+			component.Licenses = []cycloneDXLicense{license}
+		}
+		components = append(components, component)
+	}
+	// derive the serial number from the image, so that it is the same for
+	// reproducible builds
+	sum := sha256.Sum256([]byte(imageID))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	metadata := map[string]interface{}{
+		"timestamp": created.UTC().Format(time.RFC3339),
+		"tools": map[string]interface{}{
+			"components": []cycloneDXComponent{{Type: "application", Name: "imagebuilder"}},
+		},
+		"component": cycloneDXComponent{Type: "container", BOMRef: imageID, Name: name, Version: imageID},
+	}
+	document := map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16]),
+		"version":      1,
+		"metadata":     metadata,
+		"components":   components,
+	}
+	if len(omissions) > 0 {
+		var properties []cycloneDXProperty
+		for _, omission := range omissions {
+			properties = append(properties, cycloneDXProperty{Name: "imagebuilder:omission", Value: omission})
+		}
+		metadata["properties"] = properties
+		document["compositions"] = []map[string]interface{}{{"aggregate": "incomplete", "assemblies": []string{imageID}}}
+	}
+	return document
+}
+
+// writeImageSBOM writes a bill of the packages in the image imageID to path,
+// in format, and returns any warnings about packages which couldn't be listed.
+// The image's filesystem is exported from a container created from it, which
+// is never started, and its rpm database is read by running rpm in another.
+// Packages which couldn't be listed are also recorded in the bill, which says
+// that it is incomplete.
+func (e *ClientExecutor) writeImageSBOM(ctx context.Context, imageID, path string, format SBOMFormat) ([]string, error) {
+	name, err := e.resourceName(containerNamePrefix)
+	if err != nil {
+		return nil, err
+	}
+	container, err := e.Client.CreateContainer(docker.CreateContainerOptions{
+		Name: name,
+		Config: &docker.Config{
+			Image:      imageID,
+			Entrypoint: []string{"/bin/sh", "-c", "#(imagebuilder)"},
+		},
+		HostConfig: e.siblingHostConfig(nil),
+		Context:    ctx,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create container to read the built image: %v", err)
+	}
+	defer e.removeContainer(container.ID)
+
+	klog.V(4).Infof("Scanning the filesystem of %s for packages", imageID)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(e.Client.ExportContainer(docker.ExportContainerOptions{
+			ID:           container.ID,
+			OutputStream: pw,
+			Context:      ctx,
+		}))
+	}()
+	inventory, err := scanImageFilesystem(pr, e.TempDir)
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the filesystem of the built image: %v", err)
+	}
+
+	var warnings []string
+	if inventory.HasRPMDatabase {
+		output, err := e.queryRPMDatabase(ctx, imageID)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("unable to list the rpm packages in the image, which are missing from the SBOM: %v", err))
+		} else {
+			inventory.Packages = append(inventory.Packages, parseRPMQuery(output, inventory)...)
+		}
+	}
+
+	created := time.Now()
+	if e.SourceDateEpoch != nil {
+		created = *e.SourceDateEpoch
+	}
+	documentName := e.Tag
+	if len(documentName) == 0 {
+		documentName = imageID
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSBOM(f, format, documentName, imageID, sortedPackages(inventory.Packages), warnings, created); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return warnings, f.Close()
+}
+
+// queryRPMDatabase runs the image's rpm to list the packages in its database,
+// in rpmQueryFormat.
+func (e *ClientExecutor) queryRPMDatabase(ctx context.Context, imageID string) ([]byte, error) {
+	name, err := e.resourceName(containerNamePrefix)
+	if err != nil {
+		return nil, err
+	}
+	container, err := e.Client.CreateContainer(docker.CreateContainerOptions{
+		Name: name,
+		Config: &docker.Config{
+			Image:      imageID,
+			User:       "0",
+			Entrypoint: []string{"rpm"},
+			Cmd:        []string{"-qa", "--qf", rpmQueryFormat},
+		},
+		HostConfig: e.siblingHostConfig(&docker.HostConfig{NetworkMode: "none"}),
+		Context:    ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer e.removeContainer(container.ID)
+	if err := e.Client.StartContainerWithContext(container.ID, nil, ctx); err != nil {
+		return nil, err
+	}
+	code, err := e.Client.WaitContainerWithContext(container.ID, ctx)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	if err := e.Client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    container.ID,
+		OutputStream: &stdout,
+		ErrorStream:  &stderr,
+		Stdout:       true,
+		Stderr:       true,
+	}); err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("rpm exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// platformFile inserts the platform into the name of the file at path, before
+// its extension, so that the files that are written for each platform can be
+// told apart.
+func platformFile(path, platform string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + strings.ReplaceAll(platform, "/", "-") + ext
+}
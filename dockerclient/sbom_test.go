@@ -0,0 +1,287 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dpkgStatus = `Package: base-files
+Status: install ok installed
+Priority: required
+Architecture: amd64
+Version: 12.4+deb12u5
+Description: Debian base system miscellaneous files
+ This package contains the basic filesystem hierarchy.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: libc6
+Status: install ok installed
+Architecture: amd64
+Source: glibc
+Version: 2.36-9+deb12u4
+`
+
+const apkInstalled = `C:Q1abc=
+P:musl
+V:1.2.4-r2
+A:x86_64
+L:MIT
+o:musl
+
+C:Q1def=
+P:busybox
+V:1.36.1-r15
+A:x86_64
+L:GPL-2.0-only
+`
+
+func TestParseDpkgStatus(t *testing.T) {
+	packages, err := parseDpkgStatus(strings.NewReader(dpkgStatus), "/var/lib/dpkg/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sbomPackage{
+		{Type: "deb", Name: "base-files", Version: "12.4+deb12u5", Arch: "amd64", Location: "/var/lib/dpkg/status"},
+		{Type: "deb", Name: "libc6", Version: "2.36-9+deb12u4", Arch: "amd64", Location: "/var/lib/dpkg/status"},
+	}
+	if !reflect.DeepEqual(packages, expected) {
+		t.Errorf("expected %#v, got %#v", expected, packages)
+	}
+}
+
+func TestParseApkInstalled(t *testing.T) {
+	packages, err := parseApkInstalled(strings.NewReader(apkInstalled), "/lib/apk/db/installed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sbomPackage{
+		{Type: "apk", Name: "musl", Version: "1.2.4-r2", Arch: "x86_64", License: "MIT", Location: "/lib/apk/db/installed"},
+		{Type: "apk", Name: "busybox", Version: "1.36.1-r15", Arch: "x86_64", License: "GPL-2.0-only", Location: "/lib/apk/db/installed"},
+	}
+	if !reflect.DeepEqual(packages, expected) {
+		t.Errorf("expected %#v, got %#v", expected, packages)
+	}
+}
+
+func TestParseRPMQuery(t *testing.T) {
+	output := "bash\t(none)\t5.2.26\t3.fc40\tx86_64\tGPL-3.0-or-later\n" +
+		"shadow-utils\t2\t4.15.1\t2.fc40\tx86_64\tBSD-3-Clause\n" +
+		"gpg-pubkey\t(none)\ta15b79cc\t63d04c2c\t(none)\tpubkey\n"
+	packages := parseRPMQuery([]byte(output), &sbomInventory{Distro: "fedora", DistroVersion: "40"})
+	expected := []sbomPackage{
+		{Type: "rpm", Name: "bash", Version: "5.2.26-3.fc40", Arch: "x86_64", License: "GPL-3.0-or-later", Location: "rpmdb",
+			PURL: "pkg:rpm/fedora/bash@5.2.26-3.fc40?arch=x86_64&distro=fedora-40"},
+		{Type: "rpm", Name: "shadow-utils", Version: "2:4.15.1-2.fc40", Arch: "x86_64", License: "BSD-3-Clause", Location: "rpmdb",
+			PURL: "pkg:rpm/fedora/shadow-utils@4.15.1-2.fc40?arch=x86_64&epoch=2&distro=fedora-40"},
+	}
+	if !reflect.DeepEqual(packages, expected) {
+		t.Errorf("expected %#v, got %#v", expected, packages)
+	}
+}
+
+func TestPackageURL(t *testing.T) {
+	for expected, actual := range map[string]string{
+		"pkg:deb/debian/libc6@2.36-9%2Bdeb12u4?arch=amd64":            packageURL("deb", "debian", "libc6", "2.36-9+deb12u4", "arch", "amd64", "distro", ""),
+		"pkg:golang/github.com/openshift/imagebuilder@v1.2.3":         packageURL("golang", "github.com/openshift", "imagebuilder", "v1.2.3"),
+		"pkg:golang/stdlib@go1.22.1":                                  packageURL("golang", "", "stdlib", "go1.22.1"),
+		"pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64&distro=alpine-3.19": packageURL("apk", "alpine", "musl", "1.2.4-r2", "arch", "x86_64", "distro", "alpine-3.19"),
+	} {
+		if actual != expected {
+			t.Errorf("expected %s, got %s", expected, actual)
+		}
+	}
+}
+
+func TestScanImageFilesystem(t *testing.T) {
+	// the test binary is a Go binary
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := os.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range []struct {
+		name    string
+		mode    int64
+		content []byte
+	}{
+		{"usr/lib/os-release", 0644, []byte("NAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID=\"12\"\n")},
+		{"var/lib/dpkg/status", 0644, []byte(dpkgStatus)},
+		{"var/lib/dpkg/status.d/tzdata", 0644, []byte("Package: tzdata\nVersion: 2024a-0+deb12u1\nArchitecture: all\n")},
+		{"var/lib/dpkg/status.d/tzdata.md5sums", 0644, []byte("abc  usr/share/zoneinfo/UTC\n")},
+		{"var/lib/rpm/rpmdb.sqlite", 0644, []byte("SQLite format 3")},
+		{"usr/bin/script", 0755, []byte("#!/bin/sh\necho hello\n")},
+		{"usr/local/bin/app", 0755, binary},
+	} {
+		tw.WriteHeader(&tar.Header{Name: file.name, Mode: file.mode, Size: int64(len(file.content)), Typeflag: tar.TypeReg})
+		tw.Write(file.content)
+	}
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Linkname: "../usr/lib/os-release", Typeflag: tar.TypeSymlink})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	inventory, err := scanImageFilesystem(&buf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Distro != "debian" || inventory.DistroVersion != "12" || !inventory.HasRPMDatabase {
+		t.Errorf("unexpected inventory %#v", inventory)
+	}
+	found := make(map[string]sbomPackage)
+	for _, pkg := range inventory.Packages {
+		found[pkg.PURL] = pkg
+	}
+	for _, purl := range []string{
+		"pkg:deb/debian/base-files@12.4%2Bdeb12u5?arch=amd64&distro=debian-12",
+		"pkg:deb/debian/libc6@2.36-9%2Bdeb12u4?arch=amd64&distro=debian-12",
+		"pkg:deb/debian/tzdata@2024a-0%2Bdeb12u1?arch=all&distro=debian-12",
+	} {
+		if _, ok := found[purl]; !ok {
+			t.Errorf("expected to find %s", purl)
+		}
+	}
+	goPackages := 0
+	for _, pkg := range inventory.Packages {
+		if pkg.Type == "golang" {
+			goPackages++
+			if pkg.Location != "/usr/local/bin/app" {
+				t.Errorf("unexpected location of %s: %s", pkg.PURL, pkg.Location)
+			}
+		}
+	}
+	if goPackages == 0 {
+		t.Errorf("expected to find the modules of the Go binary, got %#v", inventory.Packages)
+	}
+	if len(inventory.Packages) != 3+goPackages {
+		t.Errorf("expected only the Go binary and dpkg packages, got %#v", inventory.Packages)
+	}
+}
+
+func TestWriteSBOM(t *testing.T) {
+	packages := sortedPackages([]sbomPackage{
+		{Type: "apk", Name: "musl", Version: "1.2.4-r2", License: "MIT", PURL: "pkg:apk/alpine/musl@1.2.4-r2", Location: "/lib/apk/db/installed"},
+		{Type: "golang", Name: "stdlib", Version: "go1.22.1", PURL: "pkg:golang/stdlib@go1.22.1", Location: "/bin/a"},
+		{Type: "golang", Name: "stdlib", Version: "go1.22.1", PURL: "pkg:golang/stdlib@go1.22.1", Location: "/bin/b"},
+	})
+	if len(packages) != 2 || packages[1].Location != "/bin/a" {
+		t.Fatalf("expected duplicates to be removed, got %#v", packages)
+	}
+	created := time.Unix(1700000000, 0)
+	imageID := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	var spdx bytes.Buffer
+	if err := writeSBOM(&spdx, SBOMFormatSPDX, "release:latest", imageID, packages, nil, created); err != nil {
+		t.Fatal(err)
+	}
+	var spdxDoc struct {
+		SPDXVersion       string `json:"spdxVersion"`
+		DocumentNamespace string `json:"documentNamespace"`
+		CreationInfo      struct {
+			Created string `json:"created"`
+		} `json:"creationInfo"`
+		Packages      []spdxPackage      `json:"packages"`
+		Relationships []spdxRelationship `json:"relationships"`
+	}
+	if err := json.Unmarshal(spdx.Bytes(), &spdxDoc); err != nil {
+		t.Fatal(err)
+	}
+	if spdxDoc.SPDXVersion != "SPDX-2.3" || spdxDoc.CreationInfo.Created != "2023-11-14T22:13:20Z" || !strings.HasSuffix(spdxDoc.DocumentNamespace, "/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef") {
+		t.Errorf("unexpected document %s", spdx.String())
+	}
+	if len(spdxDoc.Packages) != 3 || spdxDoc.Packages[1].ExternalRefs[0].ReferenceLocator != packages[0].PURL || spdxDoc.Packages[1].Comment != "license: MIT" {
+		t.Errorf("unexpected packages %#v", spdxDoc.Packages)
+	}
+	if len(spdxDoc.Relationships) != 3 || spdxDoc.Relationships[0].RelationshipType != "DESCRIBES" || spdxDoc.Relationships[2].RelatedSPDXElement != "SPDXRef-Package-2" {
+		t.Errorf("unexpected relationships %#v", spdxDoc.Relationships)
+	}
+
+	var cyclonedx bytes.Buffer
+	if err := writeSBOM(&cyclonedx, SBOMFormatCycloneDX, "release:latest", imageID, packages, nil, created); err != nil {
+		t.Fatal(err)
+	}
+	var cyclonedxDoc struct {
+		BOMFormat    string               `json:"bomFormat"`
+		SerialNumber string               `json:"serialNumber"`
+		Components   []cycloneDXComponent `json:"components"`
+	}
+	if err := json.Unmarshal(cyclonedx.Bytes(), &cyclonedxDoc); err != nil {
+		t.Fatal(err)
+	}
+	if cyclonedxDoc.BOMFormat != "CycloneDX" || len(cyclonedxDoc.SerialNumber) != len("urn:uuid:")+36 {
+		t.Errorf("unexpected document %s", cyclonedx.String())
+	}
+	if len(cyclonedxDoc.Components) != 2 || cyclonedxDoc.Components[0].PURL != packages[0].PURL || cyclonedxDoc.Components[0].Licenses[0].License.Name != "MIT" {
+		t.Errorf("unexpected components %#v", cyclonedxDoc.Components)
+	}
+	if strings.Contains(spdx.String(), "incomplete") || strings.Contains(cyclonedx.String(), "incomplete") {
+		t.Errorf("expected complete documents not to be marked incomplete")
+	}
+}
+
+func TestWriteSBOMOmissions(t *testing.T) {
+	omissions := []string{"unable to list the rpm packages in the image, which are missing from the SBOM: rpm not found"}
+	imageID := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	var spdx bytes.Buffer
+	if err := writeSBOM(&spdx, SBOMFormatSPDX, "release:latest", imageID, nil, omissions, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	var spdxDoc struct {
+		Comment string `json:"comment"`
+	}
+	if err := json.Unmarshal(spdx.Bytes(), &spdxDoc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(spdxDoc.Comment, "incomplete") || !strings.Contains(spdxDoc.Comment, omissions[0]) {
+		t.Errorf("expected the omission to be recorded, got %q", spdxDoc.Comment)
+	}
+
+	var cyclonedx bytes.Buffer
+	if err := writeSBOM(&cyclonedx, SBOMFormatCycloneDX, "release:latest", imageID, nil, omissions, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	var cyclonedxDoc struct {
+		Metadata struct {
+			Properties []cycloneDXProperty `json:"properties"`
+		} `json:"metadata"`
+		Compositions []struct {
+			Aggregate  string   `json:"aggregate"`
+			Assemblies []string `json:"assemblies"`
+		} `json:"compositions"`
+	}
+	if err := json.Unmarshal(cyclonedx.Bytes(), &cyclonedxDoc); err != nil {
+		t.Fatal(err)
+	}
+	if len(cyclonedxDoc.Metadata.Properties) != 1 || cyclonedxDoc.Metadata.Properties[0].Value != omissions[0] {
+		t.Errorf("expected the omission to be recorded, got %#v", cyclonedxDoc.Metadata.Properties)
+	}
+	if len(cyclonedxDoc.Compositions) != 1 || cyclonedxDoc.Compositions[0].Aggregate != "incomplete" || cyclonedxDoc.Compositions[0].Assemblies[0] != imageID {
+		t.Errorf("expected the image to be marked incomplete, got %#v", cyclonedxDoc.Compositions)
+	}
+}
+
+func TestParseSBOMFormat(t *testing.T) {
+	for value, expected := range map[string]SBOMFormat{"": SBOMFormatSPDX, "spdx": SBOMFormatSPDX, "CycloneDX": SBOMFormatCycloneDX} {
+		if format, err := ParseSBOMFormat(value); err != nil || format != expected {
+			t.Errorf("%q: expected %q, got %q: %v", value, expected, format, err)
+		}
+	}
+	if _, err := ParseSBOMFormat("syft"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,358 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+)
+
+// Secret is a value which RUN instructions can read by mounting it with
+// --mount=type=secret. A secret is copied into the build container only while
+// a RUN instruction which mounts it is running, and is removed afterwards, so
+// other instructions can't read it, and it is not part of the committed image.
+// It is not mounted from a tmpfs: while the instruction runs, the value is
+// written to the container's writable layer, on the daemon's host.
+type Secret struct {
+	// ID is the name that RUN --mount=type=secret,id=ID refers to.
+	ID string
+	// Source is the path of a file which holds the secret.
+	Source string
+	// Env is the name of an environment variable which holds the secret.
+	// It is only used if Source is not set.
+	Env string
+}
+
+// ParseSecret parses a secret in the form that the --secret flag of
+// "docker build" accepts: a comma-separated list of key=value options, where
+// id names the secret, and src (or source) is a file, or env is an
+// environment variable, that holds it. If neither src nor env is given, the
+// environment variable with the same name as the secret is used.
+func ParseSecret(value string) (Secret, error) {
+	r := csv.NewReader(strings.NewReader(value))
+	fields, err := r.Read()
+	if err != nil {
+		return Secret{}, fmt.Errorf("invalid secret %q: %v", value, err)
+	}
+	var secret Secret
+	var secretType string
+	for _, field := range fields {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return Secret{}, fmt.Errorf("invalid secret option %q, expected KEY=VALUE", field)
+		}
+		switch strings.ToLower(key) {
+		case "id":
+			secret.ID = val
+		case "src", "source":
+			secret.Source = val
+		case "env":
+			secret.Env = val
+		case "type":
+			secretType = strings.ToLower(val)
+			if secretType != "file" && secretType != "env" {
+				return Secret{}, fmt.Errorf("unknown secret type %q", val)
+			}
+		default:
+			return Secret{}, fmt.Errorf("unknown secret option %q", key)
+		}
+	}
+	if secretType == "env" && len(secret.Source) > 0 && len(secret.Env) == 0 {
+		secret.Env, secret.Source = secret.Source, ""
+	}
+	if len(secret.ID) == 0 {
+		switch {
+		case len(secret.Source) > 0:
+			secret.ID = filepath.Base(secret.Source)
+		case len(secret.Env) > 0:
+			secret.ID = secret.Env
+		default:
+			return Secret{}, fmt.Errorf("secret %q has no id", value)
+		}
+	}
+	if len(secret.Source) == 0 && len(secret.Env) == 0 {
+		if secretType == "file" {
+			secret.Source = secret.ID
+		} else {
+			secret.Env = secret.ID
+		}
+	}
+	return secret, nil
+}
+
+// read returns the value of the secret.
+func (s Secret) read() ([]byte, error) {
+	if len(s.Source) > 0 {
+		data, err := os.ReadFile(s.Source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read secret %q: %v", s.ID, err)
+		}
+		return data, nil
+	}
+	value, ok := os.LookupEnv(s.Env)
+	if !ok {
+		return nil, fmt.Errorf("unable to read secret %q: environment variable %s is not set", s.ID, s.Env)
+	}
+	return []byte(value), nil
+}
+
+// secret returns the executor's secret with the given ID.
+func (e *ClientExecutor) secret(id string) (Secret, bool) {
+	for _, secret := range e.Secrets {
+		if secret.ID == id {
+			return secret, true
+		}
+	}
+	return Secret{}, false
+}
+
+// secretStagingDir is the directory in the build container which secrets
+// are uploaded to before they are moved to their targets. It only exists
+// while a RUN instruction which mounts secrets is running.
+const secretStagingDir = "/.imagebuilder-secrets"
+
+// mountSecretsScript moves each secret, named by its index, from the staging
+// directory $1 to its target, which is given after its index. The targets'
+// missing parent directories, which are given before the secrets, separated
+// from them by "--", are created, and recorded so that they can be removed,
+// files that were already at a target are set aside to be put back, and each
+// secret which was moved is marked so that only those are removed.
+const mountSecretsScript = `set -e; s=$1; shift; : > "$s/created"; ` +
+	`while [ "$1" != "--" ]; do if [ ! -d "$1" ]; then mkdir -m 0755 -- "$1"; echo "$1" >> "$s/created"; fi; shift; done; shift; ` +
+	`while [ $# -gt 0 ]; do if [ -e "$2" ] || [ -L "$2" ]; then mv -f -- "$2" "$s/original-$1"; fi; mv -f -- "$s/$1" "$2"; : > "$s/mounted-$1"; shift 2; done`
+
+// unmountSecretsScript removes the secrets which mountSecretsScript moved to
+// their targets, puts back the files that were set aside, removes the
+// directories it created, in reverse order, and removes the staging
+// directory $1.
+const unmountSecretsScript = `s=$1; shift; ` +
+	`while [ $# -gt 0 ]; do if [ -e "$s/mounted-$1" ]; then rm -f -- "$2"; fi; if [ -e "$s/original-$1" ] || [ -L "$s/original-$1" ]; then mv -f -- "$s/original-$1" "$2"; fi; shift 2; done; ` +
+	`if [ -f "$s/created" ]; then while read -r d; do set -- "$d" "$@"; done < "$s/created"; for d; do rmdir -- "$d"; done; fi; ` +
+	`rm -rf -- "$s"`
+
+// secretUnmountTimeout limits how long removing secrets from the build
+// container can take.
+const secretUnmountTimeout = time.Minute
+
+// mountSecrets copies the secrets which a RUN instruction mounts into the
+// build container, at their targets, and returns a function which removes
+// them once the instruction has finished, so that they can't be read by other
+// instructions and aren't committed. The secrets are uploaded to the container
+// through the daemon, which doesn't need to be running on the same host, and
+// are only written to the container's filesystem. Mounting secrets needs
+// /bin/sh, mkdir, mv and rm in the build container.
+func (e *ClientExecutor) mountSecrets(ctx context.Context, mounts []imagebuilder.RunMount) (unmount func() error, err error) {
+	secrets, values, err := e.secretMounts(mounts)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return func() error { return nil }, nil
+	}
+
+	if err := runContainerScript(ctx, e.Client, e.Container.ID, `rm -rf -- "$1" && mkdir -m 0700 -- "$1"`, secretStagingDir); err != nil {
+		return nil, fmt.Errorf("unable to create a directory for secrets in the build container, which needs /bin/sh and mkdir: %v", err)
+	}
+	dirs, moves := secretScriptArgs(secrets)
+	unmount = func() error {
+		// the secrets have to be removed even if the build was
+		// cancelled, so the instruction's context isn't used
+		ctx, cancel := context.WithTimeout(context.Background(), secretUnmountTimeout)
+		defer cancel()
+		if err := runContainerScript(ctx, e.Client, e.Container.ID, unmountSecretsScript, append([]string{secretStagingDir}, moves...)...); err != nil {
+			return fmt.Errorf("unable to remove secrets from the build container: %v", err)
+		}
+		return nil
+	}
+
+	if err := e.uploadSecrets(ctx, secrets, values); err != nil {
+		return nil, errors.Join(err, unmount())
+	}
+	args := append(append(append([]string{secretStagingDir}, dirs...), "--"), moves...)
+	if err := runContainerScript(ctx, e.Client, e.Container.ID, mountSecretsScript, args...); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to mount secrets in the build container: %v", err), unmount())
+	}
+	return unmount, nil
+}
+
+// secretMounts returns the secret mounts among mounts, with clean targets,
+// leaving out those of optional secrets which were not provided, and the
+// values of the secrets.
+func (e *ClientExecutor) secretMounts(mounts []imagebuilder.RunMount) ([]imagebuilder.RunMount, [][]byte, error) {
+	targets := make(map[string]string)
+	var secrets []imagebuilder.RunMount
+	var values [][]byte
+	for _, mount := range mounts {
+		if mount.Type != imagebuilder.MountTypeSecret {
+			continue
+		}
+		if !path.IsAbs(mount.Target) {
+			return nil, nil, fmt.Errorf("secret %q must be mounted at an absolute path, not %q", mount.ID, mount.Target)
+		}
+		mount.Target = path.Clean(mount.Target)
+		if id, ok := targets[mount.Target]; ok {
+			if id != mount.ID {
+				return nil, nil, fmt.Errorf("secrets %q and %q can't both be mounted at %s", id, mount.ID, mount.Target)
+			}
+			continue
+		}
+		secret, ok := e.secret(mount.ID)
+		if !ok {
+			if mount.Required {
+				return nil, nil, fmt.Errorf("secret %q is required but was not provided", mount.ID)
+			}
+			klog.V(4).Infof("Secret %q was not provided, so it will not be mounted at %s", mount.ID, mount.Target)
+			continue
+		}
+		data, err := secret.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		targets[mount.Target] = mount.ID
+		secrets = append(secrets, mount)
+		values = append(values, data)
+	}
+	return secrets, values, nil
+}
+
+// secretScriptArgs returns the arguments of mountSecretsScript and
+// unmountSecretsScript for mounts: the parent directories of their targets,
+// each after its own parent, and the indexes of the mounts, each followed by
+// its target.
+func secretScriptArgs(mounts []imagebuilder.RunMount) (dirs, moves []string) {
+	seen := make(map[string]struct{})
+	for i, mount := range mounts {
+		var parents []string
+		for dir := path.Dir(mount.Target); dir != "/"; dir = path.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if _, ok := seen[dir]; !ok {
+				seen[dir] = struct{}{}
+				dirs = append(dirs, dir)
+			}
+		}
+		moves = append(moves, strconv.Itoa(i), mount.Target)
+	}
+	return dirs, moves
+}
+
+// uploadSecrets uploads values, the values of the secrets mounts, to the
+// staging directory in the build container, with the owners and modes that
+// the mounts give them, named by their indexes.
+func (e *ClientExecutor) uploadSecrets(ctx context.Context, mounts []imagebuilder.RunMount, values [][]byte) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i, mount := range mounts {
+		hdr := &tar.Header{
+			Name:     strconv.Itoa(i),
+			Typeflag: tar.TypeReg,
+			Mode:     0400,
+			Size:     int64(len(values[i])),
+			ModTime:  time.Now(),
+		}
+		if mount.Mode != nil {
+			hdr.Mode = int64(*mount.Mode)
+		}
+		if mount.UID != nil {
+			hdr.Uid = *mount.UID
+		}
+		if mount.GID != nil {
+			hdr.Gid = *mount.GID
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(values[i]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := e.Client.UploadToContainer(e.Container.ID, docker.UploadToContainerOptions{
+		InputStream: &buf,
+		Path:        secretStagingDir,
+		Context:     ctx,
+	}); err != nil {
+		return fmt.Errorf("unable to copy secrets into the build container: %v", err)
+	}
+	return nil
+}
+
+// runContainerScript runs script with /bin/sh as root in the running container
+// containerID, with args as its positional parameters, and waits for it to
+// finish. Its output is included in the error if it fails.
+func runContainerScript(ctx context.Context, client *docker.Client, containerID, script string, args ...string) error {
+	_, err := containerScriptOutput(ctx, client, containerID, script, args...)
+	return err
+}
+
+// containerScriptOutput is like runContainerScript, but also returns the
+// output of script.
+func containerScriptOutput(ctx context.Context, client *docker.Client, containerID, script string, args ...string) (string, error) {
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    containerID,
+		Cmd:          append([]string{"/bin/sh", "-c", script, ""}, args...),
+		User:         "0",
+		AttachStdout: true,
+		AttachStderr: true,
+		Context:      ctx,
+	})
+	if err != nil {
+		return "", err
+	}
+	var output bytes.Buffer
+	waiter, err := client.StartExecNonBlocking(exec.ID, docker.StartExecOptions{
+		OutputStream: &output,
+		ErrorStream:  &output,
+		Context:      ctx,
+	})
+	if err != nil {
+		return "", err
+	}
+	if waiter != nil {
+		if err := waiter.Wait(); err != nil {
+			return "", err
+		}
+	}
+	// the daemon can report that the exec is running for a moment after
+	// its output has ended
+	delay := 10 * time.Millisecond
+	for {
+		status, err := client.InspectExec(exec.ID)
+		if err != nil {
+			return "", err
+		}
+		if !status.Running {
+			if status.ExitCode != 0 {
+				if message := strings.TrimSpace(output.String()); len(message) > 0 {
+					return "", fmt.Errorf("exit code %d: %s", status.ExitCode, message)
+				}
+				return "", fmt.Errorf("exit code %d", status.ExitCode)
+			}
+			return output.String(), nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
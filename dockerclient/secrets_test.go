@@ -0,0 +1,157 @@
+package dockerclient
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestParseSecret(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected Secret
+		err      bool
+	}{
+		{value: "id=npmrc,src=/home/user/.npmrc", expected: Secret{ID: "npmrc", Source: "/home/user/.npmrc"}},
+		{value: "id=npmrc,source=.npmrc,type=file", expected: Secret{ID: "npmrc", Source: ".npmrc"}},
+		{value: "id=token,env=TOKEN", expected: Secret{ID: "token", Env: "TOKEN"}},
+		{value: "id=token,type=env,src=TOKEN", expected: Secret{ID: "token", Env: "TOKEN"}},
+		{value: "id=TOKEN", expected: Secret{ID: "TOKEN", Env: "TOKEN"}},
+		{value: "id=token,type=file", expected: Secret{ID: "token", Source: "token"}},
+		{value: "src=/run/credentials.json", expected: Secret{ID: "credentials.json", Source: "/run/credentials.json"}},
+		{value: "env=TOKEN", expected: Secret{ID: "TOKEN", Env: "TOKEN"}},
+		{value: "type=env", err: true},
+		{value: "id=token,type=ssh", err: true},
+		{value: "id=token,color=blue", err: true},
+		{value: "token", err: true},
+	} {
+		secret, err := ParseSecret(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", tc.value, secret)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.value, err)
+			continue
+		}
+		if secret != tc.expected {
+			t.Errorf("%s: expected %#v, got %#v", tc.value, tc.expected, secret)
+		}
+	}
+}
+
+func TestSecretMounts(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "npmrc")
+	if err := os.WriteFile(source, []byte("//registry/:_authToken=abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SECRET_TOKEN", "s3cret")
+
+	parse := func(values ...string) []imagebuilder.RunMount {
+		var mounts []imagebuilder.RunMount
+		for _, value := range values {
+			mount, err := imagebuilder.ParseRunMount(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mounts = append(mounts, mount)
+		}
+		return mounts
+	}
+
+	e := NewClientExecutor(nil)
+	e.Secrets = []Secret{{ID: "npmrc", Source: source}, {ID: "token", Env: "TEST_SECRET_TOKEN"}}
+	mounts, values, err := e.secretMounts(parse(
+		"type=secret,id=npmrc,target=/root/./.npmrc,required=true",
+		"type=ssh",
+		"type=secret,id=token,mode=0444",
+		"type=secret,id=npmrc,target=/root/.npmrc",
+		"type=secret,id=optional",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, mount := range mounts {
+		targets = append(targets, mount.Target)
+	}
+	if !reflect.DeepEqual(targets, []string{"/root/.npmrc", "/run/secrets/token"}) {
+		t.Errorf("unexpected targets %v", targets)
+	}
+	if len(values) != 2 || string(values[0]) != "//registry/:_authToken=abc\n" || string(values[1]) != "s3cret" {
+		t.Errorf("unexpected values %q", values)
+	}
+	if mounts[1].Mode == nil || *mounts[1].Mode != 0444 {
+		t.Errorf("expected the mode of the mount to be kept, got %v", mounts[1].Mode)
+	}
+
+	for _, tc := range []struct {
+		mounts []string
+		err    string
+	}{
+		{mounts: []string{"type=secret,id=optional,required"}, err: `secret "optional" is required`},
+		{mounts: []string{"type=secret,id=npmrc,target=/token", "type=secret,id=token,target=/token"}, err: "can't both be mounted"},
+	} {
+		if _, _, err := e.secretMounts(parse(tc.mounts...)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected an error containing %q, got %v", tc.mounts, tc.err, err)
+		}
+	}
+}
+
+func TestSecretScripts(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	root := t.TempDir()
+	staging := filepath.Join(root, "staging")
+	if err := os.Mkdir(staging, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "root", ".npmrc"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounts := []imagebuilder.RunMount{
+		{Type: imagebuilder.MountTypeSecret, ID: "npmrc", Target: filepath.Join(root, "root", ".npmrc")},
+		{Type: imagebuilder.MountTypeSecret, ID: "token", Target: filepath.Join(root, "run", "secrets", "token")},
+	}
+	for i, contents := range []string{"npmrc", "token"} {
+		if err := os.WriteFile(filepath.Join(staging, strconv.Itoa(i)), []byte(contents), 0400); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs, moves := secretScriptArgs(mounts)
+	run := func(script string, args ...string) {
+		t.Helper()
+		if output, err := exec.Command("/bin/sh", append([]string{"-c", script, ""}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, output)
+		}
+	}
+
+	run(mountSecretsScript, append(append(append([]string{staging}, dirs...), "--"), moves...)...)
+	for target, contents := range map[string]string{"root/.npmrc": "npmrc", "run/secrets/token": "token"} {
+		if data, err := os.ReadFile(filepath.Join(root, target)); err != nil || string(data) != contents {
+			t.Errorf("expected %s to hold the secret %q, got %q: %v", target, contents, data, err)
+		}
+	}
+
+	run(unmountSecretsScript, append([]string{staging}, moves...)...)
+	if data, err := os.ReadFile(filepath.Join(root, "root", ".npmrc")); err != nil || string(data) != "original" {
+		t.Errorf("expected the original file to be put back, got %q: %v", data, err)
+	}
+	for _, name := range []string{"run", "staging"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+}
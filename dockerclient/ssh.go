@@ -0,0 +1,295 @@
+package dockerclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// SSHAgent is an SSH agent which RUN instructions can use by mounting it with
+// --mount=type=ssh. The agent is proxied into the build container through a
+// socket which only accepts connections while a RUN instruction which mounts
+// it is running, and SSH_AUTH_SOCK is set for those instructions.
+type SSHAgent struct {
+	// ID is the name that RUN --mount=type=ssh,id=ID refers to. RUN
+	// instructions which don't give an ID use the one called "default".
+	ID string
+	// Paths is either the socket of a running agent, or a list of
+	// private key files, which must not be encrypted, to load into an
+	// agent that the executor runs. If it is empty, the agent that
+	// $SSH_AUTH_SOCK refers to is used.
+	Paths []string
+}
+
+// ParseSSHAgent parses an SSH agent in the form that the --ssh flag of
+// "docker build" accepts: an ID, optionally followed by "=" and a
+// comma-separated list of paths.
+func ParseSSHAgent(value string) (SSHAgent, error) {
+	id, paths, hasPaths := strings.Cut(value, "=")
+	if len(id) == 0 {
+		return SSHAgent{}, fmt.Errorf("invalid SSH agent %q, expected ID[=SOCKET|KEY[,KEY...]]", value)
+	}
+	agent := SSHAgent{ID: id}
+	if hasPaths {
+		for _, path := range strings.Split(paths, ",") {
+			if len(path) == 0 {
+				return SSHAgent{}, fmt.Errorf("invalid SSH agent %q, expected ID[=SOCKET|KEY[,KEY...]]", value)
+			}
+			agent.Paths = append(agent.Paths, path)
+		}
+	}
+	return agent, nil
+}
+
+// sshForward is a socket that forwards connections to an SSH agent while it
+// is active.
+type sshForward struct {
+	id       string
+	listener net.Listener
+	// socket is the agent's socket, if it is not run by the executor
+	socket  string
+	keyring agent.Agent
+	active  atomic.Int32
+}
+
+// newSSHForward starts forwarding connections to the socket at path to the
+// SSH agent a.
+func newSSHForward(a SSHAgent, path string) (*sshForward, error) {
+	f := &sshForward{id: a.ID}
+	paths := a.Paths
+	if len(paths) == 0 {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if len(socket) == 0 {
+			return nil, fmt.Errorf("SSH agent %q has no socket or keys, and SSH_AUTH_SOCK is not set", a.ID)
+		}
+		paths = []string{socket}
+	}
+	if info, err := os.Stat(paths[0]); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if len(paths) > 1 {
+			return nil, fmt.Errorf("SSH agent %q may have either one socket or a list of keys", a.ID)
+		}
+		f.socket = paths[0]
+	} else {
+		keyring := agent.NewKeyring()
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read SSH key for agent %q: %v", a.ID, err)
+			}
+			key, err := ssh.ParseRawPrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load SSH key %s for agent %q: %v", path, a.ID, err)
+			}
+			if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+				return nil, fmt.Errorf("unable to load SSH key %s for agent %q: %v", path, a.ID, err)
+			}
+		}
+		f.keyring = keyring
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a socket for SSH agent %q: %v", a.ID, err)
+	}
+	f.listener = listener
+	go f.serve()
+	return f, nil
+}
+
+// serve accepts connections until the listener is closed.
+func (f *sshForward) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				klog.V(4).Infof("Stopped forwarding SSH agent %q: %v", f.id, err)
+			}
+			return
+		}
+		if f.active.Load() == 0 {
+			klog.V(4).Infof("Refused a connection to SSH agent %q from a RUN instruction which does not mount it", f.id)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			if err := f.handle(conn); err != nil && !errors.Is(err, io.EOF) {
+				klog.V(4).Infof("Error forwarding SSH agent %q: %v", f.id, err)
+			}
+		}()
+	}
+}
+
+// handle forwards one connection to the agent.
+func (f *sshForward) handle(conn net.Conn) error {
+	if f.keyring != nil {
+		return agent.ServeAgent(f.keyring, conn)
+	}
+	upstream, err := net.Dial("unix", f.socket)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	// copy in both directions until either side closes its connection
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, conn)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, upstream)
+		done <- err
+	}()
+	err = <-done
+	conn.Close()
+	upstream.Close()
+	<-done
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// close stops accepting connections.
+func (f *sshForward) close() error {
+	return f.listener.Close()
+}
+
+// sshAgent returns the executor's SSH agent with the given ID.
+func (e *ClientExecutor) sshAgent(id string) (SSHAgent, bool) {
+	for _, a := range e.SSH {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return SSHAgent{}, false
+}
+
+// sshBinds starts forwarding the SSH agents which the RUN instructions in
+// node mount to sockets in a private temporary directory, and returns the
+// binds which mount them into the build container. The forwarding stops when
+// the executor is released. The sockets can only be bound into the container
+// by a daemon which shares our filesystem, so they are refused if the daemon
+// isn't reached through a local socket.
+func (e *ClientExecutor) sshBinds(b *imagebuilder.Builder, node *parser.Node) ([]string, error) {
+	mounts, err := b.RunMounts(node)
+	if err != nil {
+		return nil, err
+	}
+	e.sshTargets = make(map[string]*sshForward)
+	var binds []string
+	var dir string
+	for _, mount := range mounts {
+		if mount.Type != imagebuilder.MountTypeSSH {
+			continue
+		}
+		a, ok := e.sshAgent(mount.ID)
+		if !ok {
+			if mount.Required {
+				return nil, fmt.Errorf("SSH agent %q is required but was not provided", mount.ID)
+			}
+			klog.V(4).Infof("SSH agent %q was not provided, so it will not be mounted at %s", mount.ID, mount.Target)
+			continue
+		}
+		if f, ok := e.sshTargets[mount.Target]; ok {
+			if f.id != mount.ID {
+				return nil, fmt.Errorf("SSH agents %q and %q can't both be mounted at %s", f.id, mount.ID, mount.Target)
+			}
+			continue
+		}
+		if len(dir) == 0 {
+			if e.Client != nil && !isLocalEndpoint(e.Client.Endpoint()) {
+				return nil, fmt.Errorf("SSH agent %q can't be forwarded to the daemon at %s, which doesn't share this host's filesystem", mount.ID, e.Client.Endpoint())
+			}
+			if dir, err = os.MkdirTemp(e.TempDir, "imagebuilder-ssh-"); err != nil {
+				return nil, fmt.Errorf("unable to create a directory for SSH agent sockets: %v", err)
+			}
+			removeDir := dir
+			e.Deferred = append([]func() error{func() error { return os.RemoveAll(removeDir) }}, e.Deferred...)
+		}
+		path := filepath.Join(dir, strconv.Itoa(len(binds)))
+		f, err := newSSHForward(a, path)
+		if err != nil {
+			return nil, err
+		}
+		e.Deferred = append([]func() error{f.close}, e.Deferred...)
+		mode := os.FileMode(0600)
+		if mount.Mode != nil {
+			mode = *mount.Mode
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return nil, fmt.Errorf("unable to set the permissions of the socket for SSH agent %q: %v", mount.ID, err)
+		}
+		if mount.UID != nil || mount.GID != nil {
+			uid, gid := -1, -1
+			if mount.UID != nil {
+				uid = *mount.UID
+			}
+			if mount.GID != nil {
+				gid = *mount.GID
+			}
+			if err := os.Lchown(path, uid, gid); err != nil {
+				return nil, fmt.Errorf("unable to set the owner of the socket for SSH agent %q: %v", mount.ID, err)
+			}
+		}
+		binds = append(binds, path+":"+mount.Target)
+		e.sshTargets[mount.Target] = f
+	}
+	return binds, nil
+}
+
+// isLocalEndpoint returns true if the daemon endpoint is a socket on this
+// host, which is the only case where the daemon can be assumed to see the
+// files that we do.
+func isLocalEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && (u.Scheme == "unix" || u.Scheme == "npipe")
+}
+
+// activateSSH allows the SSH agents which a RUN instruction mounts to be used
+// until the returned function is called, and returns the SSH_AUTH_SOCK
+// setting that the instruction should run with, if it mounts any.
+func (e *ClientExecutor) activateSSH(mounts []imagebuilder.RunMount) (env []string, deactivate func(), err error) {
+	var active []*sshForward
+	deactivate = func() {
+		for _, f := range active {
+			f.active.Add(-1)
+		}
+	}
+	for _, mount := range mounts {
+		if mount.Type != imagebuilder.MountTypeSSH {
+			continue
+		}
+		f, ok := e.sshTargets[mount.Target]
+		if !ok || f.id != mount.ID {
+			if _, provided := e.sshAgent(mount.ID); provided {
+				deactivate()
+				return nil, nil, fmt.Errorf("SSH agent %q could not be mounted at %s, because the container was started before the target was known", mount.ID, mount.Target)
+			}
+			if mount.Required {
+				deactivate()
+				return nil, nil, fmt.Errorf("SSH agent %q is required but was not provided", mount.ID)
+			}
+			continue
+		}
+		f.active.Add(1)
+		active = append(active, f)
+		if env == nil {
+			env = []string{"SSH_AUTH_SOCK=" + mount.Target}
+		}
+	}
+	return env, deactivate, nil
+}
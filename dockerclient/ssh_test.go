@@ -0,0 +1,254 @@
+package dockerclient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestParseSSHAgent(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected SSHAgent
+		err      bool
+	}{
+		{value: "default", expected: SSHAgent{ID: "default"}},
+		{value: "default=/run/user/1000/ssh-agent.sock", expected: SSHAgent{ID: "default", Paths: []string{"/run/user/1000/ssh-agent.sock"}}},
+		{value: "github=/keys/id_ed25519,/keys/id_rsa", expected: SSHAgent{ID: "github", Paths: []string{"/keys/id_ed25519", "/keys/id_rsa"}}},
+		{value: "=/keys/id_rsa", err: true},
+		{value: "default=/keys/id_rsa,", err: true},
+	} {
+		a, err := ParseSSHAgent(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", tc.value, a)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(a, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.value, tc.expected, a)
+		}
+	}
+}
+
+// newTestSSHKey generates a key, and writes it to a file in the OpenSSH
+// format.
+func newTestSSHKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "test key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPublic, path
+}
+
+// startTestSSHAgent runs an agent which holds the key at keyPath, and returns
+// the path of its socket.
+func startTestSSHAgent(t *testing.T, keyPath string) string {
+	t.Helper()
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+// listSSHKeys asks the agent listening at socket for its keys.
+func listSSHKeys(socket string) ([]*agent.Key, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return agent.NewClient(conn).List()
+}
+
+func TestSSHForwarding(t *testing.T) {
+	public, keyPath := newTestSSHKey(t)
+	socket := startTestSSHAgent(t, keyPath)
+
+	node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString(`FROM busybox
+RUN --mount=type=ssh git clone git@example.com:private.git
+RUN --mount=type=ssh,id=keys,target=/tmp/agent.sock,mode=0666 true
+RUN --mount=type=ssh,id=missing true
+RUN ls
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, err := imagebuilder.NewStages(node, imagebuilder.NewBuilder(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(nil)
+	e.TempDir = t.TempDir()
+	e.SSH = []SSHAgent{{ID: "default", Paths: []string{socket}}, {ID: "keys", Paths: []string{keyPath}}}
+	defer func() {
+		for _, err := range e.Release() {
+			t.Error(err)
+		}
+	}()
+	binds, err := e.sshBinds(stages[0].Builder, stages[0].Node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binds) != 2 {
+		t.Fatalf("expected two binds, got %v", binds)
+	}
+	sockets := make(map[string]string)
+	for _, bind := range binds {
+		path, target, _ := strings.Cut(bind, ":")
+		sockets[target] = path
+	}
+	if info, err := os.Stat(sockets["/tmp/agent.sock"]); err != nil || info.Mode().Perm() != 0666 {
+		t.Errorf("expected the socket to have mode 0666, got %v, %v", info.Mode().Perm(), err)
+	}
+
+	// no RUN instruction is running, so the agents can't be used
+	for target, path := range sockets {
+		if keys, err := listSSHKeys(path); err == nil {
+			t.Errorf("%s: expected the connection to be refused, got %v", target, keys)
+		}
+	}
+
+	for _, tc := range []struct {
+		mounts []string
+		env    []string
+		usable []string
+		err    bool
+	}{
+		{mounts: []string{"type=ssh"}, env: []string{"SSH_AUTH_SOCK=/run/buildkit/ssh_agent.0"}, usable: []string{"/run/buildkit/ssh_agent.0"}},
+		{mounts: []string{"type=ssh,id=keys,target=/tmp/agent.sock"}, env: []string{"SSH_AUTH_SOCK=/tmp/agent.sock"}, usable: []string{"/tmp/agent.sock"}},
+		{mounts: []string{"type=ssh,id=missing"}},
+		{mounts: []string{"type=ssh,id=missing,required"}, err: true},
+		{mounts: []string{"type=ssh,target=/elsewhere"}, err: true},
+		{mounts: []string{"type=secret,id=token"}},
+	} {
+		var mounts []imagebuilder.RunMount
+		for _, value := range tc.mounts {
+			mount, err := imagebuilder.ParseRunMount(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mounts = append(mounts, mount)
+		}
+		env, deactivate, err := e.activateSSH(mounts)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.mounts)
+				deactivate()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.mounts, err)
+			continue
+		}
+		if !reflect.DeepEqual(env, tc.env) {
+			t.Errorf("%v: expected env %v, got %v", tc.mounts, tc.env, env)
+		}
+		for target, path := range sockets {
+			keys, err := listSSHKeys(path)
+			usable := err == nil && len(keys) == 1 && bytes.Equal(keys[0].Blob, public.Marshal())
+			if usable != (len(tc.usable) > 0 && tc.usable[0] == target) {
+				t.Errorf("%v: %s: expected usable=%v, got %v, %v", tc.mounts, target, !usable, keys, err)
+			}
+		}
+		deactivate()
+	}
+
+	node, err = imagebuilder.ParseDockerfile(bytes.NewBufferString("FROM busybox\nRUN --mount=type=ssh,required=true true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages, err = imagebuilder.NewStages(node, imagebuilder.NewBuilder(nil)); err != nil {
+		t.Fatal(err)
+	}
+	required := NewClientExecutor(nil)
+	if _, err := required.sshBinds(stages[0].Builder, stages[0].Node); err == nil || !strings.Contains(err.Error(), `SSH agent "default" is required`) {
+		t.Errorf("expected an error for a missing required agent, got %v", err)
+	}
+
+	// a daemon elsewhere can't see the sockets
+	client, err := docker.NewClient("tcp://build.example.com:2376")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := NewClientExecutor(client)
+	remote.TempDir = t.TempDir()
+	remote.SSH = []SSHAgent{{ID: "default", Paths: []string{socket}}}
+	if _, err := remote.sshBinds(stages[0].Builder, stages[0].Node); err == nil || !strings.Contains(err.Error(), "doesn't share this host's filesystem") {
+		t.Errorf("expected an error for a remote daemon, got %v", err)
+	}
+}
+
+func TestIsLocalEndpoint(t *testing.T) {
+	for endpoint, expected := range map[string]bool{
+		"unix:///var/run/docker.sock":        true,
+		"npipe:////./pipe/docker_engine":     true,
+		"tcp://build.example.com:2376":       false,
+		"https://build.example.com:2376":     false,
+		"tcp://127.0.0.1:2375":               false,
+		"ssh://builder@build.example.com:22": false,
+	} {
+		if actual := isLocalEndpoint(endpoint); actual != expected {
+			t.Errorf("%s: expected %v, got %v", endpoint, expected, actual)
+		}
+	}
+}
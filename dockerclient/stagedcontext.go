@@ -0,0 +1,230 @@
+package dockerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// contextMountPath is where the staged build context is mounted in build
+// containers. /dev is a tmpfs while the container runs, so the mount point is
+// not part of the committed image.
+const contextMountPath = "/dev/.imagebuilder-context"
+
+// stagedCopyScript copies items from the staged build context, which is
+// mounted at $1, in the build container. $2 and $3 are the owner and mode to
+// give the copied items, if they are not empty, and the remaining arguments are
+// pairs of a path in the build context and the path to copy it to.
+const stagedCopyScript = `set -e
+context=$1; owner=$2; mode=$3; shift 3
+fix() {
+	if [ -n "$owner" ]; then chown -h "$owner" "$1"; fi
+	if [ -n "$mode" ] && [ ! -L "$1" ]; then chmod "$mode" "$1"; fi
+}
+while [ $# -gt 0 ]; do
+	src=$context/$1; dst=$2; shift 2
+	if [ -d "$src" ] && [ ! -L "$src" ]; then
+		mkdir -p "$dst"
+		cp -a "$src/." "$dst/"
+		if [ -n "$owner$mode" ]; then
+			(cd "$src" && find .) | while IFS= read -r item; do fix "$dst/$item"; done
+		fi
+	else
+		mkdir -p "$(dirname "$dst")"
+		if [ -L "$dst" ] || [ ! -d "$dst" ]; then rm -f "$dst"; fi
+		cp -a "$src" "$dst"
+		fix "$dst"
+	fi
+done`
+
+// stagedContext is the build context after it has been uploaded to a volume,
+// which is shared by all of a build's stages.
+type stagedContext struct {
+	// volume is the name of the volume which holds the build context, if
+	// it has been uploaded
+	volume string
+}
+
+// stagedContextState returns the staged build context which this executor
+// shares with the other stages of its build, creating it if necessary. The
+// volume is removed when the executor which creates it is released.
+func (e *ClientExecutor) stagedContextState() *stagedContext {
+	if e.stagedContext == nil {
+		sc := &stagedContext{}
+		e.stagedContext = sc
+		e.Deferred = append(e.Deferred, func() error {
+			if len(sc.volume) == 0 {
+				return nil
+			}
+			if err := e.Client.RemoveVolume(sc.volume); err != nil && !errors.Is(err, docker.ErrNoSuchVolume) {
+				return fmt.Errorf("unable to remove build context volume %s: %v", sc.volume, err)
+			}
+			sc.volume = ""
+			return nil
+		})
+	}
+	return e.stagedContext
+}
+
+// copiesFromContext returns true if any of the instructions in node are COPY
+// instructions which copy from the build context.
+func copiesFromContext(node *parser.Node) bool {
+	for _, child := range node.Children {
+		if child.Value != command.Copy {
+			continue
+		}
+		fromContext := true
+		for _, flag := range child.Flags {
+			if strings.HasPrefix(flag, "--from=") {
+				fromContext = false
+			}
+		}
+		if fromContext {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldStageContext returns true if the build context should be staged for
+// a stage whose build container runs, and which copies from the context.
+func (e *ClientExecutor) shouldStageContext(node *parser.Node) bool {
+	return e.StageContext && len(e.Directory) > 0 && len(e.ContextArchive) == 0 && copiesFromContext(node)
+}
+
+// stageContext uploads the build context, without the items that are excluded
+// from it, to a volume, unless it has been already, and returns the name of
+// the volume. The upload is performed through a container created from image,
+// which is never started.
+func (e *ClientExecutor) stageContext(ctx context.Context, image string) (string, error) {
+	sc := e.stagedContextState()
+	if len(sc.volume) > 0 {
+		return sc.volume, nil
+	}
+	volumeName, err := e.resourceName(containerNamePrefix)
+	if err != nil {
+		return "", err
+	}
+	labels, err := e.buildLabels()
+	if err != nil {
+		return "", err
+	}
+	if _, err := e.Client.CreateVolume(docker.CreateVolumeOptions{Name: volumeName, Labels: labels, Context: ctx}); err != nil {
+		return "", fmt.Errorf("unable to create volume for the build context: %v", err)
+	}
+	sc.volume = volumeName
+
+	name, err := e.resourceName(containerNamePrefix)
+	if err != nil {
+		return "", err
+	}
+	container, err := e.Client.CreateContainer(docker.CreateContainerOptions{
+		Name: name,
+		Config: &docker.Config{
+			Image:      image,
+			Entrypoint: []string{"/bin/sh", "-c", "#(imagebuilder)"},
+		},
+		HostConfig: e.siblingHostConfig(&docker.HostConfig{
+			Binds: []string{volumeName + ":" + contextMountPath},
+		}),
+		Context: ctx,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create container to stage the build context: %v", err)
+	}
+	defer e.removeContainer(container.ID)
+
+	klog.V(4).Infof("Staging build context %s in volume %s", e.Directory, volumeName)
+	var r io.Reader
+	r, closer, err := archiveFromDisk(e.Directory, ".", contextMountPath+"/", false, e.Excludes, nil)
+	if err != nil {
+		return "", err
+	}
+	if e.SourceDateEpoch != nil {
+		// cp -a keeps the times of the files it copies from the volume
+		if r, err = transformArchive(r, false, clampTimestamps(*e.SourceDateEpoch)); err != nil {
+			closer.Close()
+			return "", err
+		}
+	}
+	var uploaded int64
+	uploadCtx, span := e.startSpan(ctx, "upload", sourceKey.String(e.Directory), destinationKey.String(contextMountPath))
+	err = e.Client.UploadToContainer(container.ID, docker.UploadToContainerOptions{
+		InputStream: e.uploadReader(&countingReader{Reader: r, count: &uploaded}),
+		Path:        "/",
+		Context:     uploadCtx,
+	})
+	if closeErr := closer.Close(); err == nil {
+		err = closeErr
+	}
+	span.SetAttributes(bytesKey.Int64(uploaded))
+	endSpan(span, err)
+	if err != nil {
+		return "", fmt.Errorf("unable to stage the build context: %v", err)
+	}
+	return volumeName, nil
+}
+
+// stagedCopyPairs returns the items in the build context which src refers to,
+// and where each should be copied to, as arguments for stagedCopyScript.
+func stagedCopyPairs(directory, src, dst string, excludes []string, check DirectoryCheck) ([]string, error) {
+	if path.IsAbs(src) {
+		src = strings.TrimPrefix(path.Clean(src), "/")
+		if len(src) == 0 {
+			src = "."
+		}
+	}
+	infos, err := CalcCopyInfo(src, directory, true)
+	if err != nil {
+		return nil, err
+	}
+	options, err := archiveOptionsFor(directory, infos, dst, excludes, false, check)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []string
+	for _, item := range options.IncludeFiles {
+		target, ok := options.RebaseNames[item]
+		if !ok {
+			target = item
+		}
+		pairs = append(pairs, item, path.Join("/", target))
+	}
+	return pairs, nil
+}
+
+// canCopyFromStagedContext returns true if c can be served from the staged
+// build context for src, instead of by uploading an archive.
+func (e *ClientExecutor) canCopyFromStagedContext(container *docker.Container, c imagebuilder.Copy, src string) bool {
+	return e.contextMounted && container == e.Container && container.State.Running &&
+		len(c.From) == 0 && !c.FromFS && !c.Download && !isURL(src)
+}
+
+// copyFromStagedContext copies src from the staged build context to c.Dest in
+// the build container, giving the copied items owner and c.Chmod, if they are
+// set.
+func (e *ClientExecutor) copyFromStagedContext(container *docker.Container, c imagebuilder.Copy, src string, excludes []string, owner string) error {
+	pairs, err := stagedCopyPairs(e.Directory, src, c.Dest, excludes, newDirectoryCheck(e.Client, container.ID))
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	klog.V(5).Infof("Copying %s to %s from the staged build context in %s", src, c.Dest, container.ID)
+	args := append([]string{contextMountPath, owner, c.Chmod}, pairs...)
+	if err := runContainerScript(e.operationContext(), e.Client, container.ID, stagedCopyScript, args...); err != nil {
+		return fmt.Errorf("unable to copy %s from the staged build context: %v", src, err)
+	}
+	return nil
+}
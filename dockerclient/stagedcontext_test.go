@@ -0,0 +1,69 @@
+package dockerclient
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestStagedCopyPairs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"Dockerfile", "dir/a", "dir/b.log", "logs/c.log", "src/x.go", "src/y.go"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes := []string{"logs"}
+
+	for _, tc := range []struct {
+		src, dst string
+		expected []string
+	}{
+		{src: "Dockerfile", dst: "/renamed", expected: []string{"Dockerfile", "/renamed"}},
+		{src: "Dockerfile", dst: "/etc/", expected: []string{"Dockerfile", "/etc/Dockerfile"}},
+		{src: "/Dockerfile", dst: "/etc/", expected: []string{"Dockerfile", "/etc/Dockerfile"}},
+		{src: "dir", dst: "/app", expected: []string{"dir", "/app"}},
+		{src: "src/*.go", dst: "/src/", expected: []string{"src/x.go", "/src/x.go", "src/y.go", "/src/y.go"}},
+		{src: "logs", dst: "/logs"},
+		{src: ".", dst: "/", expected: []string{"Dockerfile", "/Dockerfile", "dir", "/dir", "src", "/src"}},
+	} {
+		pairs, err := stagedCopyPairs(dir, tc.src, tc.dst, excludes, nil)
+		if err != nil {
+			t.Errorf("%s -> %s: %v", tc.src, tc.dst, err)
+			continue
+		}
+		if !reflect.DeepEqual(pairs, tc.expected) {
+			t.Errorf("%s -> %s: expected %v, got %v", tc.src, tc.dst, tc.expected, pairs)
+		}
+	}
+}
+
+func TestCopiesFromContext(t *testing.T) {
+	for dockerfile, expected := range map[string]bool{
+		"FROM busybox\nRUN true\n":                                 false,
+		"FROM busybox\nCOPY --from=base /app /app\nRUN true\n":     false,
+		"FROM busybox\nADD file.tar /\nRUN true\n":                 false,
+		"FROM busybox\nCOPY --chown=1000 . /app\nRUN true\n":       true,
+		"FROM busybox\nCOPY --from=base / /\nCOPY . /app\nRUN x\n": true,
+	} {
+		node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString(dockerfile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stages, err := imagebuilder.NewStages(node, imagebuilder.NewBuilder(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := copiesFromContext(stages[0].Node); actual != expected {
+			t.Errorf("%q: expected %t, got %t", dockerfile, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/storage/pkg/archive"
+	"k8s.io/klog"
+)
+
+// SourceDateEpochArg is the build argument, and the environment variable,
+// which holds the time that reproducible builds set their timestamps to, in
+// seconds since the Unix epoch.
+const SourceDateEpochArg = "SOURCE_DATE_EPOCH"
+
+// ParseSourceDateEpoch parses a time given in seconds since the Unix epoch,
+// as SOURCE_DATE_EPOCH is.
+func ParseSourceDateEpoch(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, expected a number of seconds since the Unix epoch", value)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// clampTimestamps returns a function which changes the times of the files in
+// an archive that are later than epoch to epoch.
+func clampTimestamps(epoch time.Time) TransformFileFunc {
+	return func(h *tar.Header, r io.Reader) ([]byte, bool, bool, error) {
+		clampHeaderTimestamps(h, epoch)
+		return nil, false, false, nil
+	}
+}
+
+// clampHeaderTimestamps changes the times in h that are later than epoch to
+// epoch, and returns true if it changed any.
+func clampHeaderTimestamps(h *tar.Header, epoch time.Time) bool {
+	changed := false
+	for _, t := range []*time.Time{&h.ModTime, &h.AccessTime, &h.ChangeTime} {
+		if t.After(epoch) {
+			*t = epoch
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rewriteImage rewrites the image id, and loads it into the daemon as name, or
+// without a name if name is empty. If the executor has a SourceDateEpoch, the
+// image's creation time, the times in its history, and the times of the files
+// in the layers that the build added to the stage's base image are made no
+// later than it, and the image doesn't record the build container. The base
+// image's layers are left as they are, so that they are still shared with it.
+// If rewriteRunConfig is not nil, it is called with the fields of the image's
+// run config to change them. It returns the rewritten image, and removes the
+// original one.
+func (e *ClientExecutor) rewriteImage(ctx context.Context, id, name string, rewriteRunConfig func(map[string]json.RawMessage) error) (*docker.Image, error) {
+	dir, err := os.MkdirTemp(e.TempDir, "imagebuilder-rewrite-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, ocispec.ImageBlobsDir, digest.SHA256.String()), 0755); err != nil {
+		return nil, err
+	}
+
+	desc, err := exportImageToLayout(ctx, e.Client, dir, id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to save image %s: %v", id, err)
+	}
+	var manifest ocispec.Manifest
+	if err := readJSONFile(blobPath(dir, desc.Digest), &manifest); err != nil {
+		return nil, err
+	}
+	var config map[string]json.RawMessage
+	if err := readJSONFile(blobPath(dir, manifest.Config.Digest), &config); err != nil {
+		return nil, err
+	}
+	var rootfs ocispec.RootFS
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("unable to parse the layers of image %s: %v", id, err)
+	}
+	if len(rootfs.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image %s has %d layers, but its config lists %d", id, len(manifest.Layers), len(rootfs.DiffIDs))
+	}
+
+	if e.SourceDateEpoch != nil {
+		epoch := *e.SourceDateEpoch
+		var baseLayers int
+		if e.Image != nil && e.Image.RootFS != nil {
+			baseLayers = len(e.Image.RootFS.Layers)
+		}
+		if baseLayers > len(manifest.Layers) {
+			return nil, fmt.Errorf("image %s has %d layers, fewer than the %d of its base image", id, len(manifest.Layers), baseLayers)
+		}
+		for i, layer := range manifest.Layers {
+			if i < baseLayers {
+				continue
+			}
+			clamped, diffID, err := clampLayerTimestamps(dir, layer, epoch)
+			if err != nil {
+				return nil, fmt.Errorf("unable to rewrite layer %s: %v", layer.Digest, err)
+			}
+			if clamped != nil {
+				manifest.Layers[i], rootfs.DiffIDs[i] = *clamped, diffID
+			}
+		}
+		if err := clampConfigTimestamps(config, rootfs, epoch); err != nil {
+			return nil, fmt.Errorf("unable to rewrite the config of image %s: %v", id, err)
+		}
+	}
+	if rewriteRunConfig != nil {
+		if err := rewriteConfigFields(config, rewriteRunConfig); err != nil {
+			return nil, fmt.Errorf("unable to rewrite the config of image %s: %v", id, err)
+		}
+	}
+	if manifest.Config, err = writeJSONBlob(dir, ocispec.MediaTypeImageConfig, config); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeDockerArchive(pw, dir, manifest, name))
+	}()
+	defer pr.Close()
+	loaded, loadedWriter := io.Pipe()
+	loadedID := make(chan string, 1)
+	go func() {
+		loadedID <- loadedImageID(loaded)
+	}()
+	err = e.Client.LoadImage(docker.LoadImageOptions{
+		InputStream:  pr,
+		OutputStream: loadedWriter,
+		Context:      ctx,
+	})
+	loadedWriter.Close()
+	newID := <-loadedID
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the rewritten image: %v", err)
+	}
+	if len(name) > 0 {
+		newID = name
+	}
+	if len(newID) == 0 {
+		return nil, fmt.Errorf("unable to determine the ID of the rewritten image")
+	}
+	image, err := e.Client.InspectImage(newID)
+	if err != nil {
+		return nil, err
+	}
+	if image.ID != id {
+		if err := e.Client.RemoveImageExtended(id, docker.RemoveImageOptions{Context: ctx}); err != nil {
+			klog.V(4).Infof("Unable to remove image %s after rewriting it: %v", id, err)
+		}
+	}
+	return image, nil
+}
+
+// clampLayerTimestamps writes an uncompressed copy of layer, whose blob is in
+// the layout in dir, in which the times of files that are later than epoch
+// are epoch, and returns its descriptor and digest. It returns nil if no file
+// in the layer is later than epoch.
+func clampLayerTimestamps(dir string, layer ocispec.Descriptor, epoch time.Time) (*ocispec.Descriptor, digest.Digest, error) {
+	open := func() (io.ReadCloser, error) {
+		f, err := os.Open(blobPath(dir, layer.Digest))
+		if err != nil {
+			return nil, err
+		}
+		dc, err := archive.DecompressStream(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: dc, Closer: closers{dc.Close, f.Close}}, nil
+	}
+
+	// leave layers which don't need to change as they are, so that they
+	// are still shared with other images
+	rc, err := open()
+	if err != nil {
+		return nil, "", err
+	}
+	later := false
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rc.Close()
+			return nil, "", err
+		}
+		if clampHeaderTimestamps(h, epoch) {
+			later = true
+			break
+		}
+	}
+	rc.Close()
+	if !later {
+		return nil, "", nil
+	}
+
+	if rc, err = open(); err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(FilterArchive(rc, pw, clampTimestamps(epoch)))
+	}()
+	defer pr.Close()
+	desc, err := writeBlob(dir, pr)
+	if err != nil {
+		return nil, "", err
+	}
+	desc.MediaType = ocispec.MediaTypeImageLayer
+	return &desc, desc.Digest, nil
+}
+
+// clampConfigTimestamps sets the creation time in an image's config to epoch,
+// and any times in its history that are later than epoch to epoch, records
+// rootfs as its layers, and removes the details of the container it was
+// committed from.
+func clampConfigTimestamps(config map[string]json.RawMessage, rootfs ocispec.RootFS, epoch time.Time) error {
+	var err error
+	if config["created"], err = json.Marshal(epoch); err != nil {
+		return err
+	}
+	if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return err
+	}
+	if history, ok := config["history"]; ok {
+		var entries []map[string]json.RawMessage
+		if err := json.Unmarshal(history, &entries); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var created time.Time
+			if err := json.Unmarshal(entry["created"], &created); err == nil && !created.After(epoch) {
+				continue
+			}
+			if entry["created"], err = json.Marshal(epoch); err != nil {
+				return err
+			}
+		}
+		if config["history"], err = json.Marshal(entries); err != nil {
+			return err
+		}
+	}
+	// the build container's ID is recorded by older daemons, and is used
+	// as the hostname
+	delete(config, "container")
+	delete(config, "container_config")
+	return rewriteConfigFields(config, func(fields map[string]json.RawMessage) error {
+		if _, ok := fields["Hostname"]; ok {
+			fields["Hostname"] = json.RawMessage(`""`)
+		}
+		return nil
+	})
+}
+
+// rewriteConfigFields calls fn with the fields of the run config in an
+// image's config, if it has one, and records the changes that fn makes.
+func rewriteConfigFields(config map[string]json.RawMessage, fn func(map[string]json.RawMessage) error) error {
+	runConfig, ok := config["config"]
+	if !ok || string(runConfig) == "null" {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(runConfig, &fields); err != nil {
+		return err
+	}
+	if err := fn(fields); err != nil {
+		return err
+	}
+	var err error
+	config["config"], err = json.Marshal(fields)
+	return err
+}
+
+// loadedImageID reads the messages that the daemon sends while loading an
+// image, and returns the ID that it reports for an image without a name.
+func loadedImageID(r io.Reader) string {
+	var id string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var message struct {
+			Stream string `json:"stream"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		if loaded, ok := strings.CutPrefix(strings.TrimSpace(message.Stream), "Loaded image ID: "); ok {
+			id = loaded
+		}
+	}
+	io.Copy(io.Discard, r)
+	return id
+}
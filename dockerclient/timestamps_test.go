@@ -0,0 +1,179 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseSourceDateEpoch(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"0":          0,
+		"1700000000": 1700000000,
+		" 42\n":      42,
+	} {
+		epoch, err := ParseSourceDateEpoch(value)
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		if epoch.Unix() != expected || epoch.Location() != time.UTC {
+			t.Errorf("%q: expected %d, got %v", value, expected, epoch)
+		}
+	}
+	for _, value := range []string{"", "-1", "1.5", "yesterday"} {
+		if _, err := ParseSourceDateEpoch(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestClampConfigTimestamps(t *testing.T) {
+	epoch := time.Unix(1700000000, 0).UTC()
+	before := epoch.Add(-time.Hour)
+	rootfs := ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("layer")}}
+
+	var clamped [][]byte
+	for _, build := range []struct {
+		created   time.Time
+		container string
+	}{
+		{created: time.Now(), container: "0123456789ab"},
+		{created: time.Now().Add(time.Minute), container: "ba9876543210"},
+	} {
+		data, err := json.Marshal(map[string]interface{}{
+			"architecture": "amd64",
+			"os":           "linux",
+			"created":      build.created,
+			"container":    build.container,
+			"container_config": map[string]interface{}{
+				"Hostname": build.container,
+			},
+			"config": map[string]interface{}{
+				"Hostname": build.container,
+				"Env":      []string{"PATH=/bin"},
+			},
+			"history": []map[string]interface{}{
+				{"created": before, "created_by": "base"},
+				{"created": build.created, "created_by": "COPY"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config map[string]json.RawMessage
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		if err := clampConfigTimestamps(config, rootfs, epoch); err != nil {
+			t.Fatal(err)
+		}
+		if data, err = json.Marshal(config); err != nil {
+			t.Fatal(err)
+		}
+		clamped = append(clamped, data)
+	}
+	if !bytes.Equal(clamped[0], clamped[1]) {
+		t.Fatalf("expected the same config, got:\n%s\n%s", clamped[0], clamped[1])
+	}
+
+	var image ocispec.Image
+	if err := json.Unmarshal(clamped[0], &image); err != nil {
+		t.Fatal(err)
+	}
+	if image.Created == nil || !image.Created.Equal(epoch) {
+		t.Errorf("expected created to be %s, got %v", epoch, image.Created)
+	}
+	if len(image.History) != 2 || !image.History[0].Created.Equal(before) || !image.History[1].Created.Equal(epoch) {
+		t.Errorf("unexpected history %#v", image.History)
+	}
+	if len(image.RootFS.DiffIDs) != 1 || image.RootFS.DiffIDs[0] != rootfs.DiffIDs[0] {
+		t.Errorf("unexpected rootfs %#v", image.RootFS)
+	}
+	if len(image.Config.Env) != 1 {
+		t.Errorf("expected the rest of the config to be kept, got %s", clamped[0])
+	}
+	if bytes.Contains(clamped[0], []byte("container")) || bytes.Contains(clamped[0], []byte("0123456789ab")) {
+		t.Errorf("expected the build container to be removed, got %s", clamped[0])
+	}
+}
+
+func TestClampLayerTimestamps(t *testing.T) {
+	epoch := time.Unix(1700000000, 0).UTC()
+	before := epoch.Add(-time.Hour)
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ocispec.ImageBlobsDir, digest.SHA256.String()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	layer := func(modified time.Time) ocispec.Descriptor {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "app/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: modified})
+		tw.WriteHeader(&tar.Header{Name: "app/old", Mode: 0644, Size: 3, Typeflag: tar.TypeReg, ModTime: before})
+		tw.Write([]byte("old"))
+		tw.WriteHeader(&tar.Header{Name: "app/new", Mode: 0644, Size: 3, Typeflag: tar.TypeReg, ModTime: modified})
+		tw.Write([]byte("new"))
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		desc, err := writeBlob(dir, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+
+	unchanged, _, err := clampLayerTimestamps(dir, layer(before), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != nil {
+		t.Errorf("expected a layer without later times to be kept, got %#v", unchanged)
+	}
+
+	first, diffID, err := clampLayerTimestamps(dir, layer(time.Now()), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := clampLayerTimestamps(dir, layer(time.Now().Add(time.Minute)), epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == nil || second == nil {
+		t.Fatalf("expected layers with later times to be rewritten")
+	}
+	if first.Digest != second.Digest || first.Digest != diffID || first.MediaType != ocispec.MediaTypeImageLayer {
+		t.Fatalf("expected the same uncompressed layer, got %#v and %#v", first, second)
+	}
+
+	f, err := os.Open(blobPath(dir, first.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	times := make(map[string]time.Time)
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		times[h.Name] = h.ModTime
+	}
+	for name, expected := range map[string]time.Time{"app/": epoch, "app/old": before, "app/new": epoch} {
+		if !times[name].Equal(expected) {
+			t.Errorf("%s: expected %s, got %s", name, expected, times[name])
+		}
+	}
+}
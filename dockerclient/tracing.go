@@ -0,0 +1,69 @@
+package dockerclient
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// tracerName is the name of the tracer that spans are created with.
+const tracerName = "github.com/openshift/imagebuilder/dockerclient"
+
+// The attributes of the spans of a build.
+const (
+	dockerfilesKey   = attribute.Key("imagebuilder.dockerfiles")
+	platformKey      = attribute.Key("imagebuilder.platform")
+	stageKey         = attribute.Key("imagebuilder.stage")
+	stagePositionKey = attribute.Key("imagebuilder.stage.position")
+	instructionKey   = attribute.Key("imagebuilder.instruction")
+	commandKey       = attribute.Key("imagebuilder.instruction.command")
+	startLineKey     = attribute.Key("imagebuilder.instruction.start_line")
+	imageKey         = attribute.Key("imagebuilder.image")
+	imageIDKey       = attribute.Key("imagebuilder.image.id")
+	baseImageIDKey   = attribute.Key("imagebuilder.base_image.id")
+	tagsKey          = attribute.Key("imagebuilder.tags")
+	sourceKey        = attribute.Key("imagebuilder.copy.source")
+	destinationKey   = attribute.Key("imagebuilder.copy.destination")
+	bytesKey         = attribute.Key("imagebuilder.copy.bytes")
+)
+
+// startSpan starts a span named name, as a child of the span in ctx, if
+// there is one, using the executor's TracerProvider, or the global one if it
+// doesn't have one.
+func (e *ClientExecutor) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	provider := e.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	if len(e.Name) > 0 {
+		attrs = append(attrs, stageKey.String(e.Name))
+	}
+	if len(e.Platform) > 0 {
+		attrs = append(attrs, platformKey.String(e.Platform))
+	}
+	return provider.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if it isn't nil, as the reason span failed, and ends
+// it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// instructionAttributes describes the instruction node.
+func instructionAttributes(node *parser.Node) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		instructionKey.String(node.Original),
+		commandKey.String(node.Value),
+		startLineKey.Int(node.StartLine),
+	}
+}
@@ -0,0 +1,78 @@
+package dockerclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// spanAttributes returns the attributes of span by key.
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestStepSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	e := &ClientExecutor{Name: "build", Platform: "linux/arm64", TracerProvider: provider}
+
+	ctx, stage := e.startSpan(context.Background(), "stage", stagePositionKey.Int(1))
+	defer e.withContext(ctx)()
+	e.startStep(0, &parser.Node{Value: "from", Original: "FROM busybox AS build", StartLine: 1})(nil)
+	finish := e.startStep(1, &parser.Node{Value: "run", Original: "RUN make", StartLine: 2})
+	if e.operationContext() == ctx {
+		t.Errorf("expected the step's span to be used while it is in progress")
+	}
+	_, span := e.startSpan(e.operationContext(), "upload")
+	endSpan(span, nil)
+	finish(errors.New("running 'make' failed with exit code 2"))
+	if e.operationContext() != ctx {
+		t.Errorf("expected the stage's context to be restored after the step")
+	}
+	endSpan(stage, nil)
+
+	spans := exporter.GetSpans().Snapshots()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+	from, upload, run, stageSpan := spans[0], spans[1], spans[2], spans[3]
+	if stageSpan.Name() != "stage" || from.Name() != "instruction" || run.Name() != "instruction" || upload.Name() != "upload" {
+		t.Fatalf("unexpected spans: %s, %s, %s, %s", stageSpan.Name(), from.Name(), run.Name(), upload.Name())
+	}
+	for _, span := range []sdktrace.ReadOnlySpan{from, run} {
+		if span.Parent().SpanID() != stageSpan.SpanContext().SpanID() {
+			t.Errorf("expected %s to be a child of the stage", spanAttributes(span)[instructionKey].AsString())
+		}
+	}
+	if upload.Parent().SpanID() != run.SpanContext().SpanID() {
+		t.Errorf("expected the upload to be a child of the instruction in progress")
+	}
+
+	attrs := spanAttributes(run)
+	if attrs[instructionKey].AsString() != "RUN make" || attrs[commandKey].AsString() != "run" || attrs[startLineKey].AsInt64() != 2 {
+		t.Errorf("unexpected attributes of the instruction: %v", attrs)
+	}
+	if attrs[stageKey].AsString() != "build" || attrs[platformKey].AsString() != "linux/arm64" {
+		t.Errorf("expected the instruction to name its stage and platform, got %v", attrs)
+	}
+	if run.Status().Code != codes.Error || len(run.Events()) == 0 {
+		t.Errorf("expected the failure of the instruction to be recorded, got %v", run.Status())
+	}
+	if from.Status().Code == codes.Error {
+		t.Errorf("expected the FROM instruction to succeed, got %v", from.Status())
+	}
+	if spanAttributes(stageSpan)[stagePositionKey].AsInt64() != 1 {
+		t.Errorf("expected the stage's position to be recorded, got %v", spanAttributes(stageSpan))
+	}
+}
@@ -0,0 +1,186 @@
+package dockerclient
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+)
+
+// volumeSnapshotDir is the directory in the build container which holds the
+// snapshots of volumes. It is removed before the container is committed.
+const volumeSnapshotDir = "/.imagebuilder-volumes"
+
+// tarOptionsScript sets $x to the options which let tar preserve extended
+// attributes and numeric owners, if the container's tar supports them. If it
+// doesn't, the check before the first snapshot logs that extended attributes
+// are lost.
+const tarOptionsScript = `x=; if tar --xattrs --help >/dev/null 2>&1; then x="--xattrs --xattrs-include=* --numeric-owner"; fi; `
+
+// ContainerVolumeTracker manages tracking snapshots of specific paths inside a
+// container. The snapshots are archives which are created and extracted by
+// tar inside the container, so that the ownership, permissions and extended
+// attributes of their contents are preserved.
+type ContainerVolumeTracker struct {
+	// paths maps each tracked path to the location of its snapshot in the
+	// container, or to "" if it has no snapshot
+	paths map[string]string
+	// snapshots is the number of snapshots that have been created
+	snapshots int
+	// checked is the container which was found to have the commands that
+	// snapshots need
+	checked string
+	errs    []error
+}
+
+func NewContainerVolumeTracker() *ContainerVolumeTracker {
+	return &ContainerVolumeTracker{
+		paths: make(map[string]string),
+	}
+}
+
+// Empty returns true if the tracker is not watching any paths
+func (t *ContainerVolumeTracker) Empty() bool {
+	return t == nil || len(t.paths) == 0
+}
+
+// Add tracks path unless it already is being tracked.
+func (t *ContainerVolumeTracker) Add(path string) {
+	if _, ok := t.paths[path]; !ok {
+		t.paths[path] = ""
+	}
+}
+
+// Release forgets any stored snapshots. The snapshots themselves are removed
+// with the container, or by Clean.
+func (t *ContainerVolumeTracker) Release() []error {
+	if t == nil {
+		return nil
+	}
+	for path := range t.paths {
+		t.ReleasePath(path)
+	}
+	return t.errs
+}
+
+// ReleasePath forgets the snapshot of path, so that it is taken again by the
+// next call to Save.
+func (t *ContainerVolumeTracker) ReleasePath(path string) {
+	if t == nil {
+		return
+	}
+	if snapshot, ok := t.paths[path]; ok && len(snapshot) > 0 {
+		klog.V(5).Infof("Releasing path %s (%s)", path, snapshot)
+		t.paths[path] = ""
+	}
+}
+
+func (t *ContainerVolumeTracker) Invalidate(path string) {
+	if t == nil {
+		return
+	}
+	set := imagebuilder.VolumeSet{}
+	set.Add(path)
+	for path := range t.paths {
+		if set.Covers(path) {
+			t.ReleasePath(path)
+		}
+	}
+}
+
+// Save ensures that all paths tracked underneath this container are
+// snapshotted or returns an error. The container must be running, and have
+// /bin/sh and tar.
+func (t *ContainerVolumeTracker) Save(ctx context.Context, containerID string, client *docker.Client) error {
+	if t == nil {
+		return nil
+	}
+	set := imagebuilder.VolumeSet{}
+	for dest := range t.paths {
+		set.Add(dest)
+	}
+	// remove snapshots of paths that are covered by other paths
+	for dest := range t.paths {
+		if !set.Has(dest) {
+			t.ReleasePath(dest)
+			delete(t.paths, dest)
+		}
+	}
+	for dest, snapshot := range t.paths {
+		if len(snapshot) > 0 {
+			continue
+		}
+		if err := t.check(ctx, containerID, client); err != nil {
+			return err
+		}
+		t.snapshots++
+		snapshot = path.Join(volumeSnapshotDir, strconv.Itoa(t.snapshots)+".tar")
+		klog.V(4).Infof("Snapshot %s for later use under %s", dest, snapshot)
+		script := "set -e; mkdir -p " + volumeSnapshotDir + "; chmod 0700 " + volumeSnapshotDir + "; " +
+			tarOptionsScript + `set -f; tar -C "$1" $x -cpf "$2" .`
+		if err := runContainerScript(ctx, client, containerID, script, dest, snapshot); err != nil {
+			return fmt.Errorf("unable to preserve the contents of %s: %v", dest, err)
+		}
+		t.paths[dest] = snapshot
+	}
+	return nil
+}
+
+// check verifies that the container has the /bin/sh and tar which snapshots
+// are created and extracted with, so that a build whose image lacks them fails
+// with an error which says so, and notes if tar can't preserve extended
+// attributes.
+func (t *ContainerVolumeTracker) check(ctx context.Context, containerID string, client *docker.Client) error {
+	if t.checked == containerID {
+		return nil
+	}
+	output, err := containerScriptOutput(ctx, client, containerID, `command -v tar >/dev/null || exit 127; tar --xattrs --help >/dev/null 2>&1 || echo no-xattrs`)
+	if err != nil {
+		return fmt.Errorf("the contents of volumes can only be preserved across RUN instructions if the image has /bin/sh and tar: %v", err)
+	}
+	if strings.TrimSpace(output) == "no-xattrs" {
+		klog.V(2).Infof("The tar in container %s does not support --xattrs, so the extended attributes of files in volumes will not be preserved", containerID)
+	}
+	t.checked = containerID
+	return nil
+}
+
+// Restore ensures the paths managed by t exactly match their snapshots. It
+// will return an error if any client operation fails.
+func (t *ContainerVolumeTracker) Restore(ctx context.Context, containerID string, client *docker.Client) error {
+	if t == nil {
+		return nil
+	}
+	for dest, snapshot := range t.paths {
+		if len(snapshot) == 0 {
+			return fmt.Errorf("path %s does not have a snapshot and cannot be restored", dest)
+		}
+		klog.V(4).Infof("Restoring contents of %s from %s", dest, snapshot)
+		script := "set -e; " + tarOptionsScript +
+			`mkdir -p "$1"; rm -rf -- "$1"/* "$1"/.[!.]* "$1"/..?*; set -f; tar -C "$1" $x -xpf "$2"`
+		if err := runContainerScript(ctx, client, containerID, script, dest, snapshot); err != nil {
+			return fmt.Errorf("unable to restore the contents of %s: %v", dest, err)
+		}
+	}
+	return nil
+}
+
+// Clean removes any snapshots from the container, so that they are not
+// committed with it, and forgets them.
+func (t *ContainerVolumeTracker) Clean(ctx context.Context, containerID string, client *docker.Client) error {
+	if t == nil || t.snapshots == 0 {
+		return nil
+	}
+	if err := runContainerScript(ctx, client, containerID, `rm -rf -- "$1"`, volumeSnapshotDir); err != nil {
+		return fmt.Errorf("unable to remove volume snapshots: %v", err)
+	}
+	t.Release()
+	t.snapshots = 0
+	return nil
+}
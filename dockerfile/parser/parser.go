@@ -42,6 +42,7 @@ type Node struct {
 	Flags      []string                 // only top Node should have this set
 	StartLine  int                      // the line in the original dockerfile where the node begins
 	EndLine    int                      // the line in the original dockerfile where the node ends
+	SourceFile string                   // the file where the node begins, if it was preprocessed
 }
 
 // Dump dumps the AST defined by `node` as a list of sexps.
@@ -107,7 +108,7 @@ func (node *Node) AddChild(child *Node, startLine, endLine int) {
 }
 
 var (
-	dispatch             map[string]func(string, *Directive) (*Node, map[string]bool, error)
+	dispatch             map[string]LineParser
 	tokenWhitespace      = sRegexp.Delayed(`[\t\v\f\r ]+`)
 	tokenEscapeCommand   = sRegexp.Delayed(`^#[ \t]*escape[ \t]*=[ \t]*(?P<escapechar>.).*$`)
 	tokenPlatformCommand = sRegexp.Delayed(`^#[ \t]*platform[ \t]*=[ \t]*(?P<platform>.*)$`)
@@ -228,7 +229,7 @@ func init() {
 	// reformulating the arguments according to the rules in the parser
 	// functions. Errors are propagated up by Parse() and the resulting AST can
 	// be incorporated directly into the existing AST as a next.
-	dispatch = map[string]func(string, *Directive) (*Node, map[string]bool, error){
+	dispatch = map[string]LineParser{
 		command.Add:         parseMaybeJSONToList,
 		command.Arg:         parseNameOrNameVal,
 		command.Cmd:         parseMaybeJSON,
@@ -250,6 +251,50 @@ func init() {
 	}
 }
 
+// LineParser parses the arguments of a single instruction, everything after
+// the instruction name and any flags, into the chain of nodes which is stored
+// as the Next field of the instruction's Node. The returned map holds any
+// attributes (such as "json") which should be set on the instruction's Node.
+type LineParser func(rest string, d *Directive) (*Node, map[string]bool, error)
+
+// Line parsers used by built-in instructions, for use by callers of
+// RegisterLineParser.
+var (
+	// ParseString treats the arguments as a single string.
+	ParseString LineParser = parseString
+	// ParseStringsWhitespaceDelimited splits the arguments on whitespace.
+	ParseStringsWhitespaceDelimited LineParser = parseStringsWhitespaceDelimited
+	// ParseMaybeJSON accepts a JSON array, or treats the arguments as a
+	// single string, the way RUN and CMD do.
+	ParseMaybeJSON LineParser = parseMaybeJSON
+	// ParseMaybeJSONToList accepts a JSON array, or splits the arguments
+	// into words, the way COPY and ADD do.
+	ParseMaybeJSONToList LineParser = parseMaybeJSONToList
+	// ParseNameOrNameVal accepts a list of names or name=value pairs, the
+	// way ARG does.
+	ParseNameOrNameVal LineParser = parseNameOrNameVal
+)
+
+// RegisterLineParser adds a parser for an instruction which is not one of the
+// built-in Dockerfile instructions. Without a registered parser, the
+// arguments of an unknown instruction are discarded. Registration is not
+// synchronized with Parse, so it should be done during program
+// initialization.
+func RegisterLineParser(cmd string, fn LineParser) error {
+	cmd = strings.ToLower(cmd)
+	if cmd == "" || tokenWhitespace.MatchString(cmd) {
+		return fmt.Errorf("invalid instruction name %q", cmd)
+	}
+	if fn == nil {
+		return fmt.Errorf("no line parser specified for %s", strings.ToUpper(cmd))
+	}
+	if _, ok := command.Commands[cmd]; ok {
+		return fmt.Errorf("the parser for the built-in %s instruction cannot be replaced", strings.ToUpper(cmd))
+	}
+	dispatch[cmd] = fn
+	return nil
+}
+
 // newNodeFromLine splits the line into parts, and dispatches to a function
 // based on the command and command arguments. A Node is created from the
 // result of the dispatch.
@@ -297,6 +342,19 @@ func (r *Result) PrintWarnings(out io.Writer) {
 // Parse reads lines from a Reader, parses the lines into an AST and returns
 // the AST and escape token
 func Parse(rwc io.Reader) (*Result, error) {
+	return parse(rwc, nil)
+}
+
+// parse is Parse, but if locate is not nil, errors and warnings are prefixed
+// with the location that it returns for the line of input that they are
+// about, where the first line is line 1.
+func parse(rwc io.Reader, locate func(line int) string) (*Result, error) {
+	at := func(line int, err error) error {
+		if locate == nil {
+			return err
+		}
+		return fmt.Errorf("%s: %w", locate(line), err)
+	}
 	d := NewDefaultDirective()
 	currentLine := 0
 	root := &Node{StartLine: -1}
@@ -316,7 +374,7 @@ func Parse(rwc io.Reader) (*Result, error) {
 		}
 		bytesRead, err = processLine(d, bytesRead, true)
 		if err != nil {
-			return nil, err
+			return nil, at(currentLine+1, err)
 		}
 		currentLine++
 
@@ -330,7 +388,7 @@ func Parse(rwc io.Reader) (*Result, error) {
 		for !isEndOfLine && scanner.Scan() {
 			bytesRead, err := processLine(d, scanner.Bytes(), false)
 			if err != nil {
-				return nil, err
+				return nil, at(currentLine+1, err)
 			}
 			currentLine++
 
@@ -346,18 +404,21 @@ func Parse(rwc io.Reader) (*Result, error) {
 
 		if hasEmptyContinuationLine {
 			warning := "[WARNING]: Empty continuation line found in:\n    " + line
+			if locate != nil {
+				warning = "[WARNING]: " + locate(startLine) + ": Empty continuation line found in:\n    " + line
+			}
 			warnings = append(warnings, warning)
 		}
 
 		child, err := newNodeFromLine(line, d)
 		if err != nil {
-			return nil, err
+			return nil, at(startLine, err)
 		}
 
 		if child.canContainHeredoc() {
 			heredocs, err := heredocsFromLine(line)
 			if err != nil {
-				return nil, err
+				return nil, at(startLine, err)
 			}
 
 			for _, heredoc := range heredocs {
@@ -379,7 +440,7 @@ func Parse(rwc io.Reader) (*Result, error) {
 					heredoc.Content += string(bytesRead)
 				}
 				if !terminated {
-					return nil, fmt.Errorf("%s: unterminated heredoc", heredoc.Name)
+					return nil, at(startLine, fmt.Errorf("%s: unterminated heredoc", heredoc.Name))
 				}
 
 				child.Heredocs = append(child.Heredocs, heredoc)
@@ -390,7 +451,7 @@ func Parse(rwc io.Reader) (*Result, error) {
 	}
 
 	if scannerErr := scanner.Err(); scannerErr != nil {
-		return nil, scannerErr
+		return nil, at(currentLine+1, scannerErr)
 	}
 
 	if len(warnings) > 0 {
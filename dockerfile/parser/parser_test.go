@@ -163,3 +163,14 @@ RUN another \
 	assert.Contains(t, warnings[1], "RUN another     thing")
 	assert.Contains(t, warnings[2], "will become errors in a future release")
 }
+
+func TestRegisterLineParser(t *testing.T) {
+	require.NoError(t, RegisterLineParser("SBOMTEST", ParseStringsWhitespaceDelimited))
+	assert.Error(t, RegisterLineParser("copy", ParseString))
+	assert.Error(t, RegisterLineParser("two words", ParseString))
+	assert.Error(t, RegisterLineParser("nilparser", nil))
+
+	result, err := Parse(bytes.NewBufferString("FROM scratch\nsbomtest --format=spdx out.json\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "from \"scratch\"\nsbomtest [\"--format=spdx\"] \"out.json\"", result.AST.Children[0].Dump()+"\n"+result.AST.Children[1].Dump())
+}
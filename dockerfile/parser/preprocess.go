@@ -0,0 +1,379 @@
+package parser
+
+// The preprocessor implements the subset of the C preprocessor that is
+// commonly used with Containerfile.in files: #include, #define, #undef,
+// #ifdef, #ifndef, #else and #endif. Unlike cpp, it leaves every other line,
+// including Dockerfile comments, untouched, and it records where each line
+// of its output came from so that line numbers in the parsed result refer to
+// the files that were actually written.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// maxIncludeDepth limits how deeply #include directives can be nested.
+const maxIncludeDepth = 64
+
+// SourceLocation identifies a line in one of the files read by the
+// preprocessor.
+type SourceLocation struct {
+	File string
+	Line int
+}
+
+// String returns the location in file:line form.
+func (l SourceLocation) String() string {
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// SourceMap records the origin of each line of preprocessed output. Entry i
+// describes line i+1 of the output.
+type SourceMap []SourceLocation
+
+// Lookup returns the origin of the specified line of preprocessed output,
+// where the first line is line 1.
+func (m SourceMap) Lookup(line int) (SourceLocation, bool) {
+	if line < 1 || line > len(m) {
+		return SourceLocation{}, false
+	}
+	return m[line-1], true
+}
+
+// Apply updates the line information in node and its children, which are
+// expected to have been parsed from preprocessed output, to refer to the
+// files and lines that the output was generated from.
+func (m SourceMap) Apply(node *Node) {
+	if node == nil {
+		return
+	}
+	if location, ok := m.Lookup(node.StartLine); ok {
+		node.SourceFile = location.File
+		node.StartLine = location.Line
+	}
+	if location, ok := m.Lookup(node.EndLine); ok {
+		node.EndLine = location.Line
+	}
+	for _, child := range node.Children {
+		m.Apply(child)
+	}
+}
+
+// Preprocessor expands #include and conditional directives in a
+// Containerfile.
+type Preprocessor struct {
+	// Defines are macros which are defined before processing starts. A
+	// macro with a non-empty value is replaced by that value wherever it
+	// appears as a word outside of single or double quotes and variable
+	// references.
+	Defines map[string]string
+	// IncludePaths are directories which are searched for files named in
+	// #include directives. Files named with "quotes" are first looked for
+	// relative to the directory of the file which includes them.
+	IncludePaths []string
+}
+
+// Preprocess processes the named file using a Preprocessor with no predefined
+// macros or include paths.
+func Preprocess(path string) ([]byte, SourceMap, error) {
+	return (&Preprocessor{}).Process(path)
+}
+
+// Process reads the named file, acting on any preprocessor directives in
+// it, and returns the resulting content along with a map from the lines of
+// that content to the lines of the files they came from.
+func (p *Preprocessor) Process(path string) ([]byte, SourceMap, error) {
+	s := &preprocessState{
+		preprocessor: p,
+		defines:      make(map[string]string),
+	}
+	for k, v := range p.Defines {
+		s.defines[k] = v
+	}
+	if err := s.processFile(path); err != nil {
+		return nil, nil, err
+	}
+	return s.out.Bytes(), s.sourceMap, nil
+}
+
+// ParsePreprocessed preprocesses the named file and parses the result. The
+// line numbers in the returned AST refer to the files that the input was
+// read from, and each node's SourceFile records which file that was. Parse
+// errors and warnings are prefixed with the file and line they are about.
+func (p *Preprocessor) ParsePreprocessed(path string) (*Result, error) {
+	content, sourceMap, err := p.Process(path)
+	if err != nil {
+		return nil, err
+	}
+	result, err := parse(bytes.NewReader(content), func(line int) string {
+		if location, ok := sourceMap.Lookup(line); ok {
+			return location.String()
+		}
+		return path
+	})
+	if err != nil {
+		return nil, err
+	}
+	sourceMap.Apply(result.AST)
+	return result, nil
+}
+
+type preprocessState struct {
+	preprocessor *Preprocessor
+	defines      map[string]string
+	out          bytes.Buffer
+	sourceMap    SourceMap
+	includeStack []string
+}
+
+// conditional tracks an #ifdef or #ifndef block.
+type conditional struct {
+	location     SourceLocation
+	parentActive bool
+	active       bool
+	seenElse     bool
+}
+
+func (s *preprocessState) processFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, included := range s.includeStack {
+		if included == abs {
+			return fmt.Errorf("%s: recursive #include", path)
+		}
+	}
+	if len(s.includeStack) >= maxIncludeDepth {
+		return fmt.Errorf("%s: #include nested too deeply", path)
+	}
+	s.includeStack = append(s.includeStack, abs)
+	defer func() { s.includeStack = s.includeStack[:len(s.includeStack)-1] }()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.process(path, f)
+}
+
+func (s *preprocessState) process(path string, r io.Reader) error {
+	var conditionals []conditional
+	active := func() bool {
+		return len(conditionals) == 0 || conditionals[len(conditionals)-1].active
+	}
+
+	scanner := bufio.NewScanner(r)
+	// match the buffer size used by Parse()
+	scanner.Buffer([]byte{}, 2048*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		location := SourceLocation{File: path, Line: lineNumber}
+
+		directive, arg, ok := splitDirective(line)
+		if !ok {
+			if active() {
+				s.emit(s.expand(line), location)
+			}
+			continue
+		}
+
+		switch directive {
+		case "ifdef", "ifndef":
+			name, err := directiveName(directive, arg, location)
+			if err != nil {
+				return err
+			}
+			_, defined := s.defines[name]
+			conditionals = append(conditionals, conditional{
+				location:     location,
+				parentActive: active(),
+				active:       active() && defined == (directive == "ifdef"),
+			})
+		case "else":
+			if len(conditionals) == 0 {
+				return fmt.Errorf("%s: #else without #ifdef or #ifndef", location)
+			}
+			c := &conditionals[len(conditionals)-1]
+			if c.seenElse {
+				return fmt.Errorf("%s: #else after #else", location)
+			}
+			c.seenElse = true
+			c.active = c.parentActive && !c.active
+		case "endif":
+			if len(conditionals) == 0 {
+				return fmt.Errorf("%s: #endif without #ifdef or #ifndef", location)
+			}
+			conditionals = conditionals[:len(conditionals)-1]
+		case "define":
+			if !active() {
+				continue
+			}
+			name, value := arg, ""
+			if i := strings.IndexFunc(arg, unicode.IsSpace); i != -1 {
+				name, value = arg[:i], arg[i:]
+			}
+			name, err := directiveName(directive, name, location)
+			if err != nil {
+				return err
+			}
+			s.defines[name] = strings.TrimSpace(value)
+		case "undef":
+			if !active() {
+				continue
+			}
+			name, err := directiveName(directive, arg, location)
+			if err != nil {
+				return err
+			}
+			delete(s.defines, name)
+		case "include":
+			if !active() {
+				continue
+			}
+			included, err := s.resolveInclude(path, arg, location)
+			if err != nil {
+				return err
+			}
+			if err := s.processFile(included); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(conditionals) > 0 {
+		return fmt.Errorf("%s: unterminated #ifdef or #ifndef", conditionals[len(conditionals)-1].location)
+	}
+	return nil
+}
+
+func (s *preprocessState) emit(line string, location SourceLocation) {
+	s.out.WriteString(line)
+	s.out.WriteByte('\n')
+	s.sourceMap = append(s.sourceMap, location)
+}
+
+// resolveInclude locates the file named by the argument of an #include
+// directive.
+func (s *preprocessState) resolveInclude(includer, arg string, location SourceLocation) (string, error) {
+	var name string
+	var candidates []string
+	switch {
+	case len(arg) > 2 && arg[0] == '"' && arg[len(arg)-1] == '"':
+		name = arg[1 : len(arg)-1]
+		if filepath.IsAbs(name) {
+			return name, nil
+		}
+		candidates = append(candidates, filepath.Join(filepath.Dir(includer), name))
+	case len(arg) > 2 && arg[0] == '<' && arg[len(arg)-1] == '>':
+		name = arg[1 : len(arg)-1]
+		if filepath.IsAbs(name) {
+			return name, nil
+		}
+	default:
+		return "", fmt.Errorf("%s: #include expects \"FILENAME\" or <FILENAME>", location)
+	}
+	for _, dir := range s.preprocessor.IncludePaths {
+		candidates = append(candidates, filepath.Join(dir, name))
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %s: no such file to #include", location, name)
+}
+
+// expand replaces the defined macros in line. Words which are part of a
+// variable reference ($NAME or ${NAME}) or which are inside of single or
+// double quotes are left alone. As in the shell, a quote character inside of
+// the other kind of quotes, or escaped with a backslash outside of single
+// quotes, doesn't start or end a quoted string.
+func (s *preprocessState) expand(line string) string {
+	if len(s.defines) == 0 {
+		return line
+	}
+	var out strings.Builder
+	var quote byte
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(line):
+			out.WriteString(line[i : i+2])
+			i += 2
+			continue
+		case (c == '"' || c == '\'') && quote == 0:
+			quote = c
+		case c == quote:
+			quote = 0
+		case isIdentifierStart(c) && (i == 0 || !isIdentifierPart(line[i-1])):
+			end := i + 1
+			for end < len(line) && isIdentifierPart(line[end]) {
+				end++
+			}
+			word := line[i:end]
+			reference := i > 0 && (line[i-1] == '$' || (line[i-1] == '{' && i > 1 && line[i-2] == '$'))
+			if value, ok := s.defines[word]; ok && value != "" && quote == 0 && !reference {
+				out.WriteString(value)
+			} else {
+				out.WriteString(word)
+			}
+			i = end
+			continue
+		}
+		out.WriteByte(c)
+		i++
+	}
+	return out.String()
+}
+
+// splitDirective checks if line is a preprocessor directive, and if it is,
+// returns the directive's name and its argument. A line which starts with
+// '#' but which isn't followed immediately by one of the directives that we
+// handle is treated as a comment.
+func splitDirective(line string) (string, string, bool) {
+	trimmed := strings.TrimLeftFunc(line, unicode.IsSpace)
+	if !strings.HasPrefix(trimmed, "#") {
+		return "", "", false
+	}
+	directive, arg := trimmed[1:], ""
+	if i := strings.IndexFunc(directive, unicode.IsSpace); i != -1 {
+		directive, arg = directive[:i], directive[i:]
+	}
+	switch directive {
+	case "include", "define", "undef", "ifdef", "ifndef", "else", "endif":
+		return directive, strings.TrimSpace(arg), true
+	}
+	return "", "", false
+}
+
+// directiveName validates the macro name used as a directive's argument.
+func directiveName(directive, name string, location SourceLocation) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("%s: #%s requires a macro name", location, directive)
+	}
+	if !isIdentifierStart(name[0]) || strings.IndexFunc(name, func(r rune) bool { return r > unicode.MaxASCII || !isIdentifierPart(byte(r)) }) != -1 {
+		return "", fmt.Errorf("%s: #%s: invalid macro name %q", location, directive, name)
+	}
+	return name, nil
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isIdentifierPart(c byte) bool {
+	return isIdentifierStart(c) || ('0' <= c && c <= '9')
+}
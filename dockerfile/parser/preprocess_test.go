@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePreprocessorFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestPreprocess(t *testing.T) {
+	dir := writePreprocessorFiles(t, map[string]string{
+		"Containerfile.in": `# a comment which cpp would remove
+FROM mirror.gcr.io/busybox
+#include "common/setup.in"
+#ifdef DEBUG
+RUN echo debug
+#else
+RUN echo release
+#endif
+#ifndef VERSION
+#define VERSION 1.0
+#endif
+LABEL version=VERSION unexpanded="VERSION" reference=$VERSION
+RUN echo 'VERSION' "it's VERSION" \"VERSION\" VERSION
+`,
+		"common/setup.in": `#define GREETING hello
+RUN echo GREETING
+`,
+	})
+	path := filepath.Join(dir, "Containerfile.in")
+	content, sourceMap, err := Preprocess(path)
+	require.NoError(t, err)
+	assert.Equal(t, `# a comment which cpp would remove
+FROM mirror.gcr.io/busybox
+RUN echo hello
+RUN echo release
+LABEL version=1.0 unexpanded="VERSION" reference=$VERSION
+RUN echo 'VERSION' "it's VERSION" \"1.0\" 1.0
+`, string(content))
+	setup := filepath.Join(dir, "common", "setup.in")
+	assert.Equal(t, SourceMap{
+		{File: path, Line: 1},
+		{File: path, Line: 2},
+		{File: setup, Line: 2},
+		{File: path, Line: 7},
+		{File: path, Line: 12},
+		{File: path, Line: 13},
+	}, sourceMap)
+
+	preprocessor := Preprocessor{Defines: map[string]string{"DEBUG": ""}}
+	result, err := preprocessor.ParsePreprocessed(path)
+	require.NoError(t, err)
+	children := result.AST.Children
+	require.Len(t, children, 5)
+	assert.Equal(t, "run \"echo hello\"", children[1].Dump())
+	assert.Equal(t, setup, children[1].SourceFile)
+	assert.Equal(t, 2, children[1].StartLine)
+	assert.Equal(t, "run \"echo debug\"", children[2].Dump())
+	assert.Equal(t, path, children[2].SourceFile)
+	assert.Equal(t, 5, children[2].StartLine)
+	assert.Equal(t, 12, children[3].StartLine)
+}
+
+func TestPreprocessErrors(t *testing.T) {
+	testCases := map[string]string{
+		"unterminated": "#ifdef FOO\nRUN true\n",
+		"stray else":   "#else\n",
+		"stray endif":  "#endif\n",
+		"double else":  "#ifdef FOO\n#else\n#else\n#endif\n",
+		"bad include":  "#include common.in\n",
+		"missing":      "#include \"missing.in\"\n",
+		"recursive":    "#include \"Containerfile.in\"\n",
+		"bad define":   "#define 1FOO bar\n",
+	}
+	for name, content := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir := writePreprocessorFiles(t, map[string]string{"Containerfile.in": content})
+			_, _, err := Preprocess(filepath.Join(dir, "Containerfile.in"))
+			assert.ErrorContains(t, err, "Containerfile.in")
+		})
+	}
+}
+
+func TestParsePreprocessedLocations(t *testing.T) {
+	dir := writePreprocessorFiles(t, map[string]string{
+		"Containerfile.in": "FROM mirror.gcr.io/busybox\n#include \"common.in\"\nRUN true\n",
+		"common.in":        "#ifdef MISSING\nRUN false\n#endif\nRUN echo \\\n\n  done\nENV a=b c\n",
+	})
+	path := filepath.Join(dir, "Containerfile.in")
+	common := filepath.Join(dir, "common.in")
+	_, err := (&Preprocessor{}).ParsePreprocessed(path)
+	assert.ErrorContains(t, err, common+`:7: Syntax error - can't find = in "c"`)
+
+	require.NoError(t, os.WriteFile(common, []byte("#ifdef MISSING\nRUN false\n#endif\nRUN echo \\\n\n  done\n"), 0o644))
+	result, err := (&Preprocessor{}).ParsePreprocessed(path)
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Warnings)
+	assert.Contains(t, result.Warnings[0], common+":4: Empty continuation line")
+}
@@ -101,6 +101,27 @@ func TestReports(t *testing.T) {
 	}
 }
 
+func TestPullReporter(t *testing.T) {
+	var progress []Progress
+	reportFn := pullReporter(func(p Progress) {
+		progress = append(progress, p)
+	})
+	reportFn(report{
+		statusDownloading: &layerDetail{Count: 1, Current: 50, Total: 100},
+		statusComplete:    &layerDetail{Count: 1},
+	})
+	reportFn(report{statusExtracting: &layerDetail{Count: 2}})
+	// nothing is reported once the layers are being extracted
+	reportFn(report{statusComplete: &layerDetail{Count: 2}})
+	expected := []Progress{
+		{Layers: 2, Complete: 1, Percent: 75},
+		{Layers: 2, Complete: 2, Percent: 100, Extracting: true},
+	}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Errorf("expected %#v, got %#v", expected, progress)
+	}
+}
+
 func TestErrorOnCopy(t *testing.T) {
 	// Producer pipe
 	genIn, genOut := io.Pipe()
@@ -5,15 +5,42 @@ import (
 	"io"
 )
 
+// Progress summarizes the state of the layers of an image that is being
+// pulled.
+type Progress struct {
+	// Layers is the number of layers in the image, and Complete is the
+	// number of them which have been downloaded.
+	Layers   int `json:"layers"`
+	Complete int `json:"complete"`
+	// Percent is how much of the image has been downloaded, from 0 to 100.
+	Percent float32 `json:"percent"`
+	// Extracting is true once every layer has been downloaded, and the
+	// layers are being extracted. It is only reported once.
+	Extracting bool `json:"extracting,omitempty"`
+}
+
 // NewPullWriter creates a writer that periodically reports
 // on pull progress of a Docker image. It only reports when the state of the
 // different layers has changed and uses time thresholds to limit the
 // rate of the reports.
 func NewPullWriter(printFn func(string)) io.WriteCloser {
-	return newWriter(pullReporter(printFn), pullLayersChanged)
+	return NewPullProgressWriter(func(p Progress) {
+		if p.Extracting {
+			printFn(fmt.Sprintf("Pulled %[1]d/%[1]d layers, 100%% complete", p.Layers))
+			printFn("Extracting")
+			return
+		}
+		printFn(fmt.Sprintf("Pulled %d/%d layers, %.0f%% complete", p.Complete, p.Layers, p.Percent))
+	})
+}
+
+// NewPullProgressWriter is like NewPullWriter, but passes each report to
+// progressFn rather than describing it.
+func NewPullProgressWriter(progressFn func(Progress)) io.WriteCloser {
+	return newWriter(pullReporter(progressFn), pullLayersChanged)
 }
 
-func pullReporter(printFn func(string)) func(report) {
+func pullReporter(progressFn func(Progress)) func(report) {
 	extracting := false
 	return func(r report) {
 		if extracting {
@@ -23,8 +50,7 @@ func pullReporter(printFn func(string)) func(report) {
 			r.count(statusPending) == 0 &&
 			r.count(statusExtracting) > 0 {
 
-			printFn(fmt.Sprintf("Pulled %[1]d/%[1]d layers, 100%% complete", r.totalCount()))
-			printFn("Extracting")
+			progressFn(Progress{Layers: r.totalCount(), Complete: r.totalCount(), Percent: 100, Extracting: true})
 			extracting = true
 			return
 		}
@@ -34,7 +60,7 @@ func pullReporter(printFn func(string)) func(report) {
 		pctComplete += float32(completeCount) / float32(r.totalCount())
 		pctComplete += float32(r.count(statusDownloading)) / float32(r.totalCount()) * r.percentProgress(statusDownloading) / 100.0
 		pctComplete *= 100.0
-		printFn(fmt.Sprintf("Pulled %d/%d layers, %.0f%% complete", completeCount, r.totalCount(), pctComplete))
+		progressFn(Progress{Layers: r.totalCount(), Complete: completeCount, Percent: pctComplete})
 	}
 }
 
@@ -0,0 +1,73 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// Instruction describes an instruction which is not part of the Dockerfile
+// syntax, but which a caller wants to make available in the Dockerfiles that
+// it builds.
+type Instruction struct {
+	// Name is the instruction's keyword, which is matched without regard
+	// to case.
+	Name string
+	// Parser splits the instruction's arguments into words. If nil,
+	// parser.ParseMaybeJSONToList is used.
+	Parser parser.LineParser
+	// Handler is invoked with the resolved arguments of the instruction.
+	// It will typically update the builder's configuration or append
+	// Copy or Run operations to PendingCopies or PendingRuns for the
+	// executor to carry out.
+	Handler StepFunc
+	// ReplaceEnv causes references to ENV and ARG values in the
+	// arguments to be expanded before Handler is called.
+	ReplaceEnv bool
+	// AllowWordExpansion causes arguments which expand to multiple words
+	// to be split into multiple arguments. Only used if ReplaceEnv is
+	// set.
+	AllowWordExpansion bool
+	// RequiresStart should be set if Handler can append to PendingRuns,
+	// so that executors know that a running container is needed.
+	RequiresStart bool
+}
+
+// requiresStart is the list of instructions which need a running container.
+var requiresStart = map[string]bool{
+	command.Run: true,
+}
+
+// RegisterInstruction adds an instruction to the set which the parser and
+// Builder recognize. Built-in instructions can not be replaced. Registration
+// is not synchronized with parsing or building, so it should be done during
+// program initialization.
+func RegisterInstruction(instruction Instruction) error {
+	name := strings.ToLower(instruction.Name)
+	if instruction.Handler == nil {
+		return fmt.Errorf("no handler specified for %s", strings.ToUpper(name))
+	}
+	if _, ok := evaluateTable[name]; ok {
+		return fmt.Errorf("the %s instruction is already registered", strings.ToUpper(name))
+	}
+	lineParser := instruction.Parser
+	if lineParser == nil {
+		lineParser = parser.ParseMaybeJSONToList
+	}
+	if err := parser.RegisterLineParser(name, lineParser); err != nil {
+		return err
+	}
+	evaluateTable[name] = instruction.Handler
+	if instruction.ReplaceEnv {
+		replaceEnvAllowed[name] = true
+		if instruction.AllowWordExpansion {
+			allowWordExpansion[name] = true
+		}
+	}
+	if instruction.RequiresStart {
+		requiresStart[name] = true
+	}
+	return nil
+}
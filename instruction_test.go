@@ -0,0 +1,78 @@
+package imagebuilder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	buildkitparser "github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+func TestRegisterInstruction(t *testing.T) {
+	pipInstall := func(b *Builder, args []string, attributes map[string]bool, flagArgs []string, original string, heredocs []buildkitparser.Heredoc) error {
+		if len(args) == 0 {
+			return errAtLeastOneArgument("PIPINSTALL")
+		}
+		b.PendingRuns = append(b.PendingRuns, Run{
+			Shell: true,
+			Args:  []string{"pip install " + strings.Join(args, " ")},
+		})
+		return nil
+	}
+	if err := RegisterInstruction(Instruction{
+		Name:               "PIPINSTALL",
+		Parser:             parser.ParseStringsWhitespaceDelimited,
+		Handler:            pipInstall,
+		ReplaceEnv:         true,
+		AllowWordExpansion: true,
+		RequiresStart:      true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterInstruction(Instruction{Name: "pipinstall", Handler: pipInstall}); err == nil {
+		t.Fatal("expected an error registering the same instruction twice")
+	}
+	if err := RegisterInstruction(Instruction{Name: "run", Handler: pipInstall}); err == nil {
+		t.Fatal("expected an error replacing a built-in instruction")
+	}
+
+	node, err := ParseDockerfile(strings.NewReader("FROM busybox\nENV PACKAGES=\"requests six\"\npipinstall $PACKAGES wheel\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	if !b.RequiresStart(node) {
+		t.Fatal("expected the custom instruction to require a running container")
+	}
+	e := &testExecutor{}
+	for _, child := range node.Children {
+		step := b.Step()
+		if err := step.Resolve(child); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Run(step, e, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(e.Unrecognized) != 0 {
+		t.Fatalf("unexpected unrecognized instructions: %#v", e.Unrecognized)
+	}
+	expected := []Run{{Shell: true, Args: []string{"pip install requests six wheel"}}}
+	if !reflect.DeepEqual(expected, e.Runs) {
+		t.Fatalf("expected runs %#v, got %#v", expected, e.Runs)
+	}
+}
+
+func TestRegisterInstructionWithoutHandler(t *testing.T) {
+	err := RegisterInstruction(Instruction{Name: "sbom"})
+	if err == nil {
+		t.Fatal("expected an error registering an instruction without a handler")
+	}
+	if _, ok := evaluateTable["sbom"]; ok {
+		t.Fatalf("instruction without a handler was registered: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package imagebuilder
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// Mount types which RUN --mount accepts.
+const (
+	MountTypeBind   = "bind"
+	MountTypeCache  = "cache"
+	MountTypeTmpfs  = "tmpfs"
+	MountTypeSecret = "secret"
+	MountTypeSSH    = "ssh"
+)
+
+// RunMount is a mount which a RUN instruction requested with --mount.
+type RunMount struct {
+	// Type is one of the MountType constants, and defaults to bind.
+	Type string
+	// ID identifies the secret or SSH agent socket to mount, or the cache
+	// to share.
+	ID string
+	// Source is the path, in the build context or in From, to mount.
+	Source string
+	// From is the stage or image that Source is found in.
+	From string
+	// Target is where the mount appears in the container. For secrets,
+	// it defaults to /run/secrets/ID.
+	Target string
+	// ReadWrite is true if the mount can be written to. Writes to a bind
+	// mount are discarded.
+	ReadWrite bool
+	// Required is true if the build should fail when the secret or SSH
+	// agent socket that ID refers to was not provided.
+	Required bool
+	// Mode, UID and GID set the permissions and owner of a secret or SSH
+	// agent socket, if they are set.
+	Mode     *os.FileMode
+	UID, GID *int
+}
+
+// ParseRunMount parses the value of a RUN instruction's --mount flag, which is
+// a comma-separated list of key=value options.
+func ParseRunMount(value string) (RunMount, error) {
+	r := csv.NewReader(strings.NewReader(value))
+	fields, err := r.Read()
+	if err != nil {
+		return RunMount{}, fmt.Errorf("invalid mount %q: %v", value, err)
+	}
+	mount := RunMount{Type: MountTypeBind}
+	var readOnlySet bool
+	for _, field := range fields {
+		key, val, hasValue := strings.Cut(field, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch key {
+		case "type":
+			mount.Type = strings.ToLower(val)
+		case "id":
+			mount.ID = val
+		case "source", "src":
+			mount.Source = val
+		case "from":
+			mount.From = val
+		case "target", "dst", "destination":
+			mount.Target = val
+		case "readonly", "ro":
+			readOnly, err := parseMountBool(key, val, hasValue)
+			if err != nil {
+				return RunMount{}, err
+			}
+			mount.ReadWrite, readOnlySet = !readOnly, true
+		case "readwrite", "rw":
+			readWrite, err := parseMountBool(key, val, hasValue)
+			if err != nil {
+				return RunMount{}, err
+			}
+			mount.ReadWrite, readOnlySet = readWrite, true
+		case "required":
+			if mount.Required, err = parseMountBool(key, val, hasValue); err != nil {
+				return RunMount{}, err
+			}
+		case "mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil {
+				return RunMount{}, fmt.Errorf("invalid value %q for mount option mode: %v", val, err)
+			}
+			fileMode := os.FileMode(mode)
+			mount.Mode = &fileMode
+		case "uid", "gid":
+			id, err := strconv.Atoi(val)
+			if err != nil || id < 0 {
+				return RunMount{}, fmt.Errorf("invalid value %q for mount option %s", val, key)
+			}
+			if key == "uid" {
+				mount.UID = &id
+			} else {
+				mount.GID = &id
+			}
+		case "sharing":
+			// only meaningful for caches, which are private to a build
+		default:
+			return RunMount{}, fmt.Errorf("unknown mount option %q in %q", key, value)
+		}
+	}
+
+	switch mount.Type {
+	case MountTypeBind, MountTypeCache, MountTypeTmpfs:
+		if len(mount.Target) == 0 {
+			return RunMount{}, fmt.Errorf("mount %q has no target", value)
+		}
+		if mount.Type == MountTypeCache && !readOnlySet {
+			mount.ReadWrite = true
+		}
+	case MountTypeSecret:
+		if len(mount.ID) == 0 && len(mount.Target) > 0 {
+			mount.ID = path.Base(mount.Target)
+		}
+		if len(mount.ID) == 0 {
+			return RunMount{}, fmt.Errorf("secret mount %q needs an id or a target", value)
+		}
+		if len(mount.Target) == 0 {
+			mount.Target = path.Join("/run/secrets", mount.ID)
+		}
+	case MountTypeSSH:
+		if len(mount.ID) == 0 {
+			mount.ID = "default"
+		}
+		if len(mount.Target) == 0 {
+			mount.Target = "/run/buildkit/ssh_agent.0"
+		}
+	default:
+		return RunMount{}, fmt.Errorf("unknown mount type %q", mount.Type)
+	}
+	if !path.IsAbs(mount.Target) {
+		return RunMount{}, fmt.Errorf("mount target %q must be an absolute path", mount.Target)
+	}
+	mount.Target = path.Clean(mount.Target)
+	return mount, nil
+}
+
+// parseMountBool parses a boolean mount option, which is true if it has no
+// value.
+func parseMountBool(key, value string, hasValue bool) (bool, error) {
+	if !hasValue {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for mount option %s", value, key)
+	}
+	return b, nil
+}
+
+// RunMounts returns the mounts which the RUN instructions in node request, so
+// that an executor can arrange for them before it starts the container that
+// the instructions run in. Variables in the --mount flags are expanded using
+// the arguments and environment which are known so far.
+func (b *Builder) RunMounts(node *parser.Node) ([]RunMount, error) {
+	args := make(map[string]string)
+	for k, v := range b.Args {
+		if _, ok := b.AllowedArgs[k]; ok {
+			args[k] = v
+		}
+	}
+	env := mergeEnv(envMapAsSlice(args), b.Env)
+	var mounts []RunMount
+	for _, child := range node.Children {
+		if child.Value != "run" {
+			continue
+		}
+		for _, flag := range child.Flags {
+			value, ok := strings.CutPrefix(flag, "--mount=")
+			if !ok {
+				continue
+			}
+			value, err := ProcessWord(value, env)
+			if err != nil {
+				return nil, err
+			}
+			mount, err := ParseRunMount(value)
+			if err != nil {
+				return nil, err
+			}
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts, nil
+}
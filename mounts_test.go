@@ -0,0 +1,80 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseRunMount(t *testing.T) {
+	mode := os.FileMode(0440)
+	uid, gid := 1000, 0
+	for _, tc := range []struct {
+		value    string
+		expected RunMount
+		err      bool
+	}{
+		{value: "type=secret,id=npmrc", expected: RunMount{Type: MountTypeSecret, ID: "npmrc", Target: "/run/secrets/npmrc"}},
+		{value: "type=secret,target=/root/.npmrc", expected: RunMount{Type: MountTypeSecret, ID: ".npmrc", Target: "/root/.npmrc"}},
+		{
+			value:    "type=secret,id=token,dst=/tmp/token/,required=true,mode=0440,uid=1000,gid=0",
+			expected: RunMount{Type: MountTypeSecret, ID: "token", Target: "/tmp/token", Required: true, Mode: &mode, UID: &uid, GID: &gid},
+		},
+		{value: "type=secret,id=token,required", expected: RunMount{Type: MountTypeSecret, ID: "token", Target: "/run/secrets/token", Required: true}},
+		{value: "target=/src,source=.,from=builder,rw", expected: RunMount{Type: MountTypeBind, Target: "/src", Source: ".", From: "builder", ReadWrite: true}},
+		{value: "type=cache,target=/root/.cache", expected: RunMount{Type: MountTypeCache, Target: "/root/.cache", ReadWrite: true}},
+		{value: "type=ssh", expected: RunMount{Type: MountTypeSSH, ID: "default", Target: "/run/buildkit/ssh_agent.0"}},
+		{value: "type=secret", err: true},
+		{value: "type=bind,source=.", err: true},
+		{value: "type=secret,id=token,target=relative", err: true},
+		{value: "type=secret,id=token,required=maybe", err: true},
+		{value: "type=secret,id=token,mode=rw", err: true},
+		{value: "type=volume,target=/data", err: true},
+		{value: "type=secret,id=token,color=blue", err: true},
+	} {
+		mount, err := ParseRunMount(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", tc.value, mount)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(mount, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.value, tc.expected, mount)
+		}
+	}
+}
+
+func TestRunMounts(t *testing.T) {
+	node, err := ParseDockerfile(bytes.NewBufferString(`FROM busybox
+RUN --mount=type=secret,id=token cat /run/secrets/token
+COPY . /
+RUN --network=none --mount=type=secret,id=${SECRET_ID},target=/root/.npmrc --mount=type=cache,target=/cache true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, err := NewStages(node, NewBuilder(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := stages[0].Builder
+	b.Env = []string{"SECRET_ID=npmrc"}
+	mounts, err := b.RunMounts(stages[0].Node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RunMount{
+		{Type: MountTypeSecret, ID: "token", Target: "/run/secrets/token"},
+		{Type: MountTypeSecret, ID: "npmrc", Target: "/root/.npmrc"},
+		{Type: MountTypeCache, Target: "/cache", ReadWrite: true},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %#v, got %#v", expected, mounts)
+	}
+}